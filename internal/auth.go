@@ -0,0 +1,347 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+
+	// certificateReloadInterval is the interval that serving certificates are checked for changes at.
+	certificateReloadInterval = 10 * time.Second
+
+	// authCacheTTL is the duration that authentication and authorization decisions are cached for.
+	authCacheTTL = time.Minute
+
+	// authCacheSize is the maximum number of authentication, and authorization, decisions cached.
+	authCacheSize = 4096
+)
+
+// servingSecurity secures a server with TLS, and with delegated authentication and authorization for some of its
+// paths, as kube-rbac-proxy does.
+type servingSecurity struct {
+
+	// logger is the logger for rejected requests.
+	logger klog.Logger
+
+	// certificates serves the server's certificate, if it is served over TLS.
+	certificates *certificateReloader
+
+	// authPaths are the paths that require authentication and authorization, each covering all paths under it.
+	authPaths []string
+
+	// auth delegates authentication and authorization to the API server.
+	auth *delegatingAuth
+}
+
+// newServingSecurity returns a new servingSecurity. The server is served over TLS if the given certificate and key files
+// are set, and the given comma-separated paths require authentication and authorization, if any.
+func newServingSecurity(
+	ctx context.Context,
+	client kubernetes.Interface,
+	certFile, keyFile, authPaths string,
+) (*servingSecurity, error) {
+	s := &servingSecurity{logger: klog.FromContext(ctx)}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("expected both a TLS certificate and key file")
+		}
+		var err error
+		s.certificates, err = newCertificateReloader(ctx, certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range strings.Split(authPaths, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			if !strings.HasPrefix(path, "/") {
+				return nil, fmt.Errorf("expected auth path %q to be absolute", path)
+			}
+			s.authPaths = append(s.authPaths, path)
+		}
+	}
+	if len(s.authPaths) > 0 {
+		s.auth = newDelegatingAuth(client)
+		if s.certificates == nil {
+			s.logger.Info("Authenticating paths without TLS sends bearer tokens in plaintext, consider setting a certificate",
+				"authPaths", s.authPaths)
+		}
+	}
+
+	return s, nil
+}
+
+// secure configures the given server to be served as per the security configuration.
+func (s *servingSecurity) secure(server *http.Server) {
+	if s.certificates != nil {
+		server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: s.certificates.getCertificate,
+		}
+	}
+	if s.auth != nil {
+		server.Handler = s.auth.wrap(s.logger, server.Handler, s.requiresAuth)
+	}
+}
+
+// listenAndServe serves the given server, over TLS if configured, and calls the given function once it is listening.
+func (s *servingSecurity) listenAndServe(server *http.Server, listening func()) error {
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return fmt.Errorf("error listening: %w", err)
+	}
+	listening()
+	if s.certificates != nil {
+		// Certificates are served by the TLS configuration.
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != nil {
+		return fmt.Errorf("error serving: %w", err)
+	}
+
+	return nil
+}
+
+// requiresAuth reports whether the given path requires authentication and authorization, i.e., whether it is, or is
+// under, any of the auth paths.
+func (s *servingSecurity) requiresAuth(path string) bool {
+	for _, authPath := range s.authPaths {
+		if path == authPath || strings.HasPrefix(path, strings.TrimSuffix(authPath, "/")+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// certificateReloader serves a certificate from the given files, and reloads it when the files change, so that rotated
+// certificates are served without a restart. A certificate that fails to load is ignored, and the previous one served.
+type certificateReloader struct {
+
+	// certFile is the path to the PEM-encoded certificate.
+	certFile string
+
+	// keyFile is the path to the PEM-encoded private key.
+	keyFile string
+
+	// certificate is the currently served certificate.
+	certificate atomic.Pointer[tls.Certificate]
+
+	// mutex guards modTimes.
+	mutex sync.Mutex
+
+	// modTimes are the modification times of the files that the served certificate was loaded from.
+	modTimes [2]time.Time
+}
+
+// newCertificateReloader loads the certificate from the given files, and reloads it, until the given context is done.
+func newCertificateReloader(ctx context.Context, certFile, keyFile string) (*certificateReloader, error) {
+	c := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	logger := klog.FromContext(ctx)
+	go wait.UntilWithContext(ctx, func(context.Context) {
+		reloaded, err := c.reload()
+		if err != nil {
+			logger.Error(err, "error reloading serving certificate, serving the previous one", "certFile", certFile)
+
+			return
+		}
+		if reloaded {
+			logger.V(1).Info("Reloaded serving certificate", "certFile", certFile)
+		}
+	}, certificateReloadInterval)
+
+	return c, nil
+}
+
+// reload loads the certificate if either file changed since it was last loaded, and reports whether it did.
+func (c *certificateReloader) reload() (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var modTimes [2]time.Time
+	for i, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, fmt.Errorf("error reading serving certificate: %w", err)
+		}
+		modTimes[i] = info.ModTime()
+	}
+	if c.certificate.Load() != nil && modTimes == c.modTimes {
+		return false, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("error loading serving certificate: %w", err)
+	}
+	c.certificate.Store(&certificate)
+	c.modTimes = modTimes
+
+	return true, nil
+}
+
+// getCertificate returns the currently served certificate.
+func (c *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.certificate.Load(), nil
+}
+
+// delegatingAuth authenticates bearer tokens through TokenReviews, and authorizes requests through SubjectAccessReviews
+// for their (non-resource) paths and verbs, caching the decisions.
+type delegatingAuth struct {
+
+	// client is the client that reviews are created with.
+	client kubernetes.Interface
+
+	// authentications caches the users that tokens authenticate as, by the tokens' hashes.
+	authentications *cache.LRUExpireCache
+
+	// authorizations caches whether requests are authorized, by their attributes.
+	authorizations *cache.LRUExpireCache
+}
+
+// newDelegatingAuth returns a new delegatingAuth.
+func newDelegatingAuth(client kubernetes.Interface) *delegatingAuth {
+	return &delegatingAuth{
+		client:          client,
+		authentications: cache.NewLRUExpireCache(authCacheSize),
+		authorizations:  cache.NewLRUExpireCache(authCacheSize),
+	}
+}
+
+// wrap returns a handler that authenticates and authorizes requests for the paths that require it, before passing them
+// on to the given handler.
+func (a *delegatingAuth) wrap(logger klog.Logger, next http.Handler, requiresAuth func(path string) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !requiresAuth(r.URL.Path) {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="crdmetrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+
+			return
+		}
+		user, err := a.authenticate(r.Context(), token)
+		if err != nil {
+			logger.Error(err, "error authenticating request", "path", r.URL.Path)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+
+			return
+		}
+		if user == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="crdmetrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+
+			return
+		}
+		allowed, err := a.authorize(r.Context(), user, strings.ToLower(r.Method), r.URL.Path)
+		if err != nil {
+			logger.Error(err, "error authorizing request", "path", r.URL.Path, "user", user.Username)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+
+			return
+		}
+		if !allowed {
+			http.Error(w, fmt.Sprintf("Forbidden (user=%s, verb=%s, path=%s)", user.Username, strings.ToLower(r.Method), r.URL.Path),
+				http.StatusForbidden)
+
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticate returns the user that the given token authenticates as, or nil if it does not.
+func (a *delegatingAuth) authenticate(ctx context.Context, token string) (*authenticationv1.UserInfo, error) {
+	hash := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(hash[:])
+	if user, ok := a.authentications.Get(key); ok {
+		return user.(*authenticationv1.UserInfo), nil //nolint:forcetypeassert // Only users are cached.
+	}
+	review, err := a.client.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error creating TokenReview: %w", err)
+	}
+	var user *authenticationv1.UserInfo
+	if review.Status.Authenticated {
+		user = &review.Status.User
+	}
+	a.authentications.Add(key, user, authCacheTTL)
+
+	return user, nil
+}
+
+// authorize reports whether the given user may make a request with the given verb, on the given path.
+func (a *delegatingAuth) authorize(ctx context.Context, user *authenticationv1.UserInfo, verb, path string) (bool, error) {
+	key := strings.Join([]string{user.Username, user.UID, strings.Join(user.Groups, ","), verb, path}, "\x00")
+	if allowed, ok := a.authorizations.Get(key); ok {
+		return allowed.(bool), nil //nolint:forcetypeassert // Only decisions are cached.
+	}
+	extra := make(map[string]authorizationv1.ExtraValue, len(user.Extra))
+	for k, v := range user.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+	review, err := a.client.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   user.Username,
+			UID:    user.UID,
+			Groups: user.Groups,
+			Extra:  extra,
+			NonResourceAttributes: &authorizationv1.NonResourceAttributes{
+				Path: path,
+				Verb: verb,
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, fmt.Errorf("error creating SubjectAccessReview: %w", err)
+	}
+	a.authorizations.Add(key, review.Status.Allowed, authCacheTTL)
+
+	return review.Status.Allowed, nil
+}
@@ -0,0 +1,314 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+// reviewServer is an in-process API server that reviews tokens and access, authenticating the "valid" token as "alice",
+// and only allowing "alice" to "get" "/metrics". It records the number of reviews it served.
+type reviewServer struct {
+	mutex          sync.Mutex
+	tokenReviews   int
+	accessReviews  int
+	failAllReviews bool
+}
+
+// ServeHTTP serves TokenReviews and SubjectAccessReviews.
+func (s *reviewServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.failAllReviews {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+
+		return
+	}
+	var response any
+	switch r.URL.Path {
+	case "/apis/authentication.k8s.io/v1/tokenreviews":
+		s.tokenReviews++
+		review := &authenticationv1.TokenReview{}
+		if err := json.NewDecoder(r.Body).Decode(review); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+		if review.Spec.Token == "valid" {
+			review.Status.Authenticated = true
+			review.Status.User = authenticationv1.UserInfo{Username: "alice", Groups: []string{"system:authenticated"}}
+		}
+		response = review
+	case "/apis/authorization.k8s.io/v1/subjectaccessreviews":
+		s.accessReviews++
+		review := &authorizationv1.SubjectAccessReview{}
+		if err := json.NewDecoder(r.Body).Decode(review); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+		attributes := review.Spec.NonResourceAttributes
+		review.Status.Allowed = review.Spec.User == "alice" && attributes != nil && attributes.Verb == "get" && attributes.Path == "/metrics"
+		response = review
+	default:
+		http.NotFound(w, r)
+
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+func TestDelegatingAuth(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name           string
+		path           string
+		token          string
+		failAllReviews bool
+		wantStatus     int
+	}{
+		{
+			name:       "unprotected path",
+			path:       "/healthz",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "missing token",
+			path:       "/metrics",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "invalid token",
+			path:       "/metrics",
+			token:      "invalid",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "forbidden path",
+			path:       "/debug/pprof/heap",
+			token:      "valid",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "allowed",
+			path:       "/metrics",
+			token:      "valid",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:           "failed review",
+			path:           "/metrics",
+			token:          "valid",
+			failAllReviews: true,
+			wantStatus:     http.StatusInternalServerError,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			reviews := &reviewServer{failAllReviews: tc.failAllReviews}
+			apiServer := httptest.NewServer(reviews)
+			defer apiServer.Close()
+			client, err := kubernetes.NewForConfig(&rest.Config{Host: apiServer.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+			security, err := newServingSecurity(context.Background(), client, "", "", "/metrics, /debug/pprof/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})}
+			security.secure(server)
+
+			// Requests are repeated, so that the second one is served from the caches.
+			for range 2 {
+				request := httptest.NewRequest(http.MethodGet, tc.path, http.NoBody)
+				if tc.token != "" {
+					request.Header.Set("Authorization", "Bearer "+tc.token)
+				}
+				recorder := httptest.NewRecorder()
+				server.Handler.ServeHTTP(recorder, request)
+				if got := recorder.Code; got != tc.wantStatus {
+					t.Fatalf("got status %d, want %d", got, tc.wantStatus)
+				}
+				if tc.wantStatus == http.StatusUnauthorized && recorder.Header().Get("WWW-Authenticate") == "" {
+					t.Fatal("got no WWW-Authenticate header for an unauthorized request")
+				}
+			}
+			reviews.mutex.Lock()
+			defer reviews.mutex.Unlock()
+			if reviews.tokenReviews > 1 || reviews.accessReviews > 1 {
+				t.Fatalf("got %d token and %d access reviews, want at most one of each", reviews.tokenReviews, reviews.accessReviews)
+			}
+		})
+	}
+}
+
+func TestServingSecurityRequiresAuth(t *testing.T) {
+	t.Parallel()
+
+	security, err := newServingSecurity(context.Background(), nil, "", "", "/metrics,/debug/pprof/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]bool{
+		"/metrics":                 true,
+		"/metrics/resources/foo":   true,
+		"/debug/pprof/":            true,
+		"/debug/pprof/heap":        true,
+		"/debug/pprofile":          false,
+		"/readyz":                  false,
+		"/metrics-and-then-others": false,
+	} {
+		if got := security.requiresAuth(path); got != want {
+			t.Errorf("got requiresAuth(%q) = %t, want %t", path, got, want)
+		}
+	}
+
+	for _, tc := range []struct {
+		name                        string
+		certFile, keyFile, authPath string
+	}{
+		{name: "relative auth path", authPath: "metrics"},
+		{name: "certificate without key", certFile: "tls.crt"},
+		{name: "missing certificate", certFile: "missing.crt", keyFile: "missing.key"},
+	} {
+		if _, err = newServingSecurity(context.Background(), nil, tc.certFile, tc.keyFile, tc.authPath); err == nil {
+			t.Errorf("%s: got no error", tc.name)
+		}
+	}
+}
+
+func TestCertificateReloader(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeTestCertificate(t, certFile, keyFile, "foo")
+
+	ctx, cancel := context.WithCancel(klog.NewContext(context.Background(), klog.Background()))
+	defer cancel()
+	reloader, err := newCertificateReloader(ctx, certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertServedCommonName(t, reloader, "foo")
+
+	// Unchanged files are not reloaded.
+	if reloaded, err := reloader.reload(); err != nil || reloaded {
+		t.Fatalf("got reloaded=%t, err=%v, want no reload", reloaded, err)
+	}
+
+	// Rotated files are.
+	writeTestCertificate(t, certFile, keyFile, "bar")
+	future := time.Now().Add(time.Minute)
+	for _, file := range []string{certFile, keyFile} {
+		if err = os.Chtimes(file, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reloaded, err := reloader.reload(); err != nil || !reloaded {
+		t.Fatalf("got reloaded=%t, err=%v, want a reload", reloaded, err)
+	}
+	assertServedCommonName(t, reloader, "bar")
+
+	// Broken files keep the previous certificate served.
+	if err = os.WriteFile(certFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(certFile, future.Add(time.Minute), future.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = reloader.reload(); err == nil {
+		t.Fatal("got no error reloading a broken certificate")
+	}
+	assertServedCommonName(t, reloader, "bar")
+}
+
+// writeTestCertificate writes a self-signed certificate, with the given common name, and its key, to the given files.
+func writeTestCertificate(t *testing.T, certFile, keyFile, commonName string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// assertServedCommonName asserts that the given reloader serves a certificate with the given common name.
+func assertServedCommonName(t *testing.T, reloader *certificateReloader, commonName string) {
+	t.Helper()
+
+	certificate, err := reloader.getCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := leaf.Subject.CommonName; got != commonName {
+		t.Fatalf("got served certificate for %q, want %q", got, commonName)
+	}
+}
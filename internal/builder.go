@@ -19,14 +19,9 @@ package internal
 import (
 	"context"
 	"fmt"
+	"time"
 
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/apimachinery/pkg/watch"
-	"k8s.io/client-go/dynamic"
-	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
 )
 
@@ -36,77 +31,39 @@ type gvkr struct {
 	schema.GroupVersionResource
 }
 
-// buildStore builds a cache.store for the metrics store.
+// storeIdentity identifies the watch backing a store. Stores with the same identity observe the same set of objects,
+// and only differ in how they render them.
+type storeIdentity struct {
+	gvkr
+	labelSelector, fieldSelector string
+
+	// metadataOnly is set if the store only reads the objects' metadata, in which case only that is watched.
+	metadataOnly bool
+}
+
+// buildStore builds the metrics store, and subscribes it to the shared informer for its identity.
 func buildStore(
 	ctx context.Context,
-	dynamicClientset dynamic.Interface,
-	gvkWithR gvkr,
-	metricFamilies []*FamilyType,
-	tryNoCache bool,
-	labelSelector, fieldSelector string,
-	resolver ResolverType,
-	labelKeys []string, labelValues []string,
-) *StoreType {
+	informers *informerPool,
+	identity storeIdentity,
+	plan *storePlan,
+	telemetry storeTelemetry,
+	sharding sharding,
+	snapshotDebounce time.Duration,
+) (*StoreType, error) {
 	logger := klog.FromContext(ctx)
 
-	// Create the reflector's LW.
-	gvr := gvkWithR.GroupVersionResource
-	lwo := metav1.ListOptions{
-		LabelSelector: labelSelector,
-		FieldSelector: fieldSelector,
-	}
-	resourceVersionLatestBestEffort := "0"
-	if tryNoCache {
-		lwo.ResourceVersionMatch = metav1.ResourceVersionMatchNotOlderThan
-		lwo.ResourceVersion = resourceVersionLatestBestEffort
-	}
-	listerwatcher := &cache.ListWatch{
-		ListFunc: func(_ metav1.ListOptions) (runtime.Object, error) {
-			o, err := dynamicClientset.Resource(gvr).List(ctx, lwo)
-			if err != nil {
-				err = fmt.Errorf("error listing %s with options %v: %w", gvr.String(), lwo, err)
-			}
-
-			return o, err
-		},
-		WatchFunc: func(_ metav1.ListOptions) (watch.Interface, error) {
-			o, err := dynamicClientset.Resource(gvr).Watch(ctx, lwo)
-			if err != nil {
-				err = fmt.Errorf("error watching %s with options %v: %w", gvr.String(), lwo, err)
-			}
+	// Instantiate a new store. Resolutions are bound to the store's context, so stopping the store cancels them.
+	s := newStore(ctx, logger, plan)
+	s.identity = identity
+	s.telemetry = telemetry
+	s.sharding = sharding
+	s.snapshotDebounce = snapshotDebounce
+	if err := informers.subscribe(s); err != nil {
+		s.cancel()
 
-			return o, err
-		},
+		return nil, fmt.Errorf("error building store for %s: %w", identity.GroupVersionResource.String(), err)
 	}
 
-	// Build metric headers.
-	headers := make([]string, len(metricFamilies))
-	for i, f := range metricFamilies {
-		headers[i] = f.buildHeaders()
-	}
-
-	// Set the default resolver.
-	if resolver == ResolverTypeNone {
-		resolver = ResolverTypeUnstructured
-	}
-
-	// Instantiate a new store.
-	s := newStore(
-		logger,
-		headers,
-		metricFamilies,
-		resolver,
-		labelKeys, labelValues,
-	)
-
-	// Create and start the reflector.
-	wrapper := &unstructured.Unstructured{}
-	wrapper.SetGroupVersionKind(gvkWithR.GroupVersionKind)
-	reflector := cache.NewReflectorWithOptions(listerwatcher, wrapper, s, cache.ReflectorOptions{
-		Name:         fmt.Sprintf("%#q reflector", gvr.String()),
-		ResyncPeriod: 0,
-	})
-	go reflector.Run(ctx.Done())
-
-	return s
+	return s, nil
 }
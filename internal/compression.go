@@ -0,0 +1,150 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"cmp"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+
+	// encodingGzip is the gzip content coding.
+	encodingGzip = "gzip"
+
+	// encodingZstd is the zstd content coding.
+	encodingZstd = "zstd"
+)
+
+// gzipWriters pools gzip writers across responses, since each holds sizeable compression state.
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// zstdWriters pools zstd writers across responses, since each holds sizeable compression state.
+var zstdWriters = sync.Pool{
+	New: func() interface{} {
+		// Responses are compressed on the request's goroutine.
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.SpeedFastest))
+		if err != nil {
+			// Responses fall back to the next acceptable coding, see compressedResponseWriter.
+			return nil
+		}
+
+		return encoder
+	},
+}
+
+// negotiateEncodings returns the given offered content codings that are acceptable as per the given Accept-Encoding
+// header, from the most to the least preferred by the client, and in the given order of preference among the ones it
+// prefers equally. Codings that the header does not list are acceptable if it lists "*". The identity coding is always
+// acceptable as a last resort, and is not returned.
+func negotiateEncodings(acceptEncoding string, offered []string) []string {
+	qualities := map[string]float64{}
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, found := strings.Cut(strings.TrimSpace(param), "=")
+			if !found || strings.ToLower(strings.TrimSpace(key)) != "q" {
+				continue
+			}
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				q = 0
+			}
+			quality = q
+		}
+		qualities[name] = quality
+	}
+	qualityOf := func(encoding string) float64 {
+		if quality, ok := qualities[encoding]; ok {
+			return quality
+		}
+
+		return qualities["*"]
+	}
+	acceptable := make([]string, 0, len(offered))
+	for _, encoding := range offered {
+		if qualityOf(encoding) > 0 {
+			acceptable = append(acceptable, encoding)
+		}
+	}
+	slices.SortStableFunc(acceptable, func(a, b string) int {
+		return cmp.Compare(qualityOf(b), qualityOf(a))
+	})
+
+	return acceptable
+}
+
+// compressedResponseWriter wraps the given response writer with one that compresses the response with the most
+// preferred of the given content codings that is acceptable for the given request, and that a writer can be created
+// for. The returned function must be called once the response has been written out, to flush any buffered data.
+func compressedResponseWriter(w http.ResponseWriter, r *http.Request, offered []string) (io.Writer, func() error) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	for _, encoding := range negotiateEncodings(r.Header.Get("Accept-Encoding"), offered) {
+		switch encoding {
+		case encodingGzip:
+			w.Header().Set("Content-Encoding", encodingGzip)
+			gz, _ := gzipWriters.Get().(*gzip.Writer)
+			gz.Reset(w)
+
+			return gz, func() error {
+				defer gzipWriters.Put(gz)
+				if err := gz.Close(); err != nil {
+					return fmt.Errorf("error flushing gzip writer: %w", err)
+				}
+
+				return nil
+			}
+		case encodingZstd:
+			// Fall back to the next acceptable coding if a zstd writer could not be created.
+			zw, _ := zstdWriters.Get().(*zstd.Encoder)
+			if zw == nil {
+				continue
+			}
+			w.Header().Set("Content-Encoding", encodingZstd)
+			zw.Reset(w)
+
+			return zw, func() error {
+				defer zstdWriters.Put(zw)
+				if err := zw.Close(); err != nil {
+					return fmt.Errorf("error flushing zstd writer: %w", err)
+				}
+
+				return nil
+			}
+		}
+	}
+
+	return w, func() error { return nil }
+}
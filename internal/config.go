@@ -18,13 +18,13 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/rexagod/crdmetrics/pkg/apis/crdmetrics/v1alpha1"
+	"github.com/rexagod/crdmetrics/pkg/resolver"
 	"gopkg.in/yaml.v3"
-	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/client-go/dynamic"
 )
 
 // configure defines behaviours for working with configuration(s), can be implemented to use configurations other than
@@ -35,11 +35,18 @@ type configure interface {
 	parse(raw string) error
 
 	// build builds the given configuration.
-	build(ctx context.Context, crdmetricsUIDToStoresMap map[types.UID][]*StoreType, tryNoCache bool)
+	build(ctx context.Context, existing []*StoreType) (*reconciliation, error)
 }
 
 // configuration defines the structured representation of a CEL-based YAML configuration.
 type configuration struct {
+
+	// CELCostLimit overrides the global CEL cost limit for all stores of the resource.
+	CELCostLimit uint64 `yaml:"celCostLimit,omitempty"`
+
+	// CELEvaluationTimeout overrides the global CEL evaluation timeout for all stores of the resource.
+	CELEvaluationTimeout time.Duration `yaml:"celEvaluationTimeout,omitempty"`
+
 	Stores []*StoreType `yaml:"stores"`
 }
 
@@ -49,11 +56,23 @@ type configurer struct {
 	// configuration is the structured configuration.
 	configuration configuration
 
-	// dynamicClientset is the dynamic clientset used to build stores for different objects.
-	dynamicClientset dynamic.Interface
+	// informers is the pool of shared informers that stores subscribe to.
+	informers *informerPool
 
 	// resource is the resource to build stores for.
 	resource *v1alpha1.CRDMetricsResource
+
+	// resolverOptions are the options resolvers are built with. Any resource-level overrides are applied when parsing.
+	resolverOptions resolver.Options
+
+	// storeTelemetry holds the self metrics the built stores report to.
+	storeTelemetry storeTelemetry
+
+	// sharding decides the objects that the built stores render.
+	sharding sharding
+
+	// snapshotDebounce is the interval that the built stores coalesce their mutations within, before publishing them.
+	snapshotDebounce time.Duration
 }
 
 // configurer implements the configure interface.
@@ -61,12 +80,20 @@ var _ configure = &configurer{}
 
 // newConfigurer returns a new configurer.
 func newConfigurer(
-	dynamicClientset dynamic.Interface,
+	informers *informerPool,
 	resource *v1alpha1.CRDMetricsResource,
+	resolverOptions resolver.Options,
+	storeTelemetry storeTelemetry,
+	sharding sharding,
+	snapshotDebounce time.Duration,
 ) *configurer {
 	return &configurer{
-		dynamicClientset: dynamicClientset,
+		informers:        informers,
 		resource:         resource,
+		resolverOptions:  resolverOptions,
+		storeTelemetry:   storeTelemetry,
+		sharding:         sharding,
+		snapshotDebounce: snapshotDebounce,
 	}
 }
 
@@ -74,34 +101,145 @@ func newConfigurer(
 func (c *configurer) parse(raw string) error {
 	err := yaml.Unmarshal([]byte(raw), &c.configuration)
 	if err != nil {
-		err = fmt.Errorf("error unmarshalling configuration: %w", err)
+		return fmt.Errorf("error unmarshalling configuration: %w", err)
+	}
+
+	// Apply resource-level overrides.
+	if c.configuration.CELCostLimit > 0 {
+		c.resolverOptions.CEL.CostLimit = c.configuration.CELCostLimit
+	}
+	if c.configuration.CELEvaluationTimeout > 0 {
+		c.resolverOptions.CEL.Timeout = c.configuration.CELEvaluationTimeout
 	}
 
-	return err
+	err = c.validate()
+	if err != nil {
+		return err
+	}
+
+	return c.compile()
 }
 
-// build knows how to build the given configuration.
-func (c *configurer) build(ctx context.Context, crdmetricsUIDToStoresMap map[types.UID][]*StoreType, tryNoCache bool) {
+// validate checks the parsed configuration for values that cannot be processed.
+func (c *configurer) validate() error {
+	for i, s := range c.configuration.Stores {
+		if err := errors.Join(
+			s.Resolver.validate(), s.OnResolutionFailure.validate(), validateDefaultValue(s.DefaultValue),
+		); err != nil {
+			return fmt.Errorf("invalid configuration for store %d: %w", i, err)
+		}
+		for _, f := range s.Families {
+			if err := f.validate(); err != nil {
+				return fmt.Errorf("invalid configuration for family %q: %w", f.Name, err)
+			}
+			for j, m := range f.Metrics {
+				if err := errors.Join(
+					m.Resolver.validate(), m.OnResolutionFailure.validate(), validateDefaultValue(m.DefaultValue),
+				); err != nil {
+					return fmt.Errorf("invalid configuration for metric %d of family %q: %w", j, f.Name, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// compile compiles each store's configuration into its rendering plan.
+func (c *configurer) compile() error {
+	for i, s := range c.configuration.Stores {
+		plan, err := newStorePlan(s, c.resolverOptions)
+		if err != nil {
+			return fmt.Errorf("error compiling store %d: %w", i, err)
+		}
+		rawStoreConfiguration, err := yaml.Marshal(s)
+		if err != nil {
+			return fmt.Errorf("error marshalling store %d: %w", i, err)
+		}
+		plan.fingerprint = fmt.Sprintf("%s\ncostLimit: %d\ntimeout: %s",
+			rawStoreConfiguration, c.resolverOptions.CEL.CostLimit, c.resolverOptions.CEL.Timeout)
+		s.plan = plan
+	}
+
+	return nil
+}
+
+// reconciliation describes how a configuration is reconciled against the stores built for a previous one.
+type reconciliation struct {
+
+	// stores are all stores for the configuration, in the configured order.
+	stores []*StoreType
+
+	// started are the stores built for the configuration. They need to sync before being swapped in.
+	started []*StoreType
+
+	// replans are the new plans for the existing stores that are kept, but render differently.
+	replans map[*StoreType]*storePlan
+
+	// stale are the existing stores that are not kept. They need to be stopped once swapped out.
+	stale []*StoreType
+}
+
+// apply swaps in the new plans for the existing stores that are kept, re-rendering them from their cached objects.
+func (r *reconciliation) apply() error {
+	var errs []error
+	for s, plan := range r.replans {
+		errs = append(errs, s.replan(plan))
+	}
+
+	return errors.Join(errs...)
+}
+
+// build knows how to build the given configuration, reusing the given existing stores where possible. Existing stores
+// are matched to the configured ones by identity, i.e., GVK/R and selectors:
+//   - existing stores with an identical configuration are kept as is,
+//   - existing stores whose configuration only differs in rendering are kept, and re-rendered without a relist,
+//   - all other configured stores are built, and subscribed to their informers.
+//
+// Nothing is registered, or stopped, here, unless building fails, in which case all built stores are stopped.
+func (c *configurer) build(ctx context.Context, existing []*StoreType) (*reconciliation, error) {
+	r := &reconciliation{
+		stores:  make([]*StoreType, 0, len(c.configuration.Stores)),
+		replans: map[*StoreType]*storePlan{},
+	}
+
+	// Index the existing stores by identity. Identities need not be unique, so match them in order.
+	kept := map[*StoreType]bool{}
+	existingByIdentity := map[storeIdentity][]*StoreType{}
+	for _, s := range existing {
+		existingByIdentity[s.identity] = append(existingByIdentity[s.identity], s)
+	}
+
 	for _, storeConfiguration := range c.configuration.Stores {
-		g, v, k, r := storeConfiguration.Group, storeConfiguration.Version, storeConfiguration.Kind, storeConfiguration.ResourceName
-		gvkWithR := gvkr{
-			GroupVersionKind:     schema.GroupVersionKind{Group: g, Version: v, Kind: k},
-			GroupVersionResource: schema.GroupVersionResource{Group: g, Version: v, Resource: r},
+		identity := storeConfiguration.watchIdentity()
+		if candidates := existingByIdentity[identity]; len(candidates) > 0 {
+			s := candidates[0]
+			existingByIdentity[identity] = candidates[1:]
+			kept[s] = true
+			if s.plan.fingerprint != storeConfiguration.plan.fingerprint {
+				r.replans[s] = storeConfiguration.plan
+			}
+			r.stores = append(r.stores, s)
+
+			continue
 		}
-		ls, fs := storeConfiguration.Selectors.Label, storeConfiguration.Selectors.Field
-		families := storeConfiguration.Families
-		resolver := storeConfiguration.Resolver
-		labelKeys, labelValues := storeConfiguration.LabelKeys, storeConfiguration.LabelValues
-		s := buildStore(
-			ctx, c.dynamicClientset,
-			gvkWithR,
-			families,
-			tryNoCache,
-			ls, fs,
-			resolver,
-			labelKeys, labelValues,
-		)
-		resourceUID := c.resource.GetUID()
-		crdmetricsUIDToStoresMap[resourceUID] = append(crdmetricsUIDToStoresMap[resourceUID], s)
+		s, err := buildStore(ctx, c.informers, identity, storeConfiguration.plan, c.storeTelemetry, c.sharding, c.snapshotDebounce)
+		if err != nil {
+			for _, started := range r.started {
+				started.stop()
+			}
+
+			return nil, err
+		}
+		r.stores = append(r.stores, s)
+		r.started = append(r.started, s)
 	}
+
+	for _, s := range existing {
+		if !kept[s] {
+			r.stale = append(r.stale, s)
+		}
+	}
+
+	return r, nil
 }
@@ -0,0 +1,277 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rexagod/crdmetrics/pkg/resolver"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/klog/v2"
+)
+
+// reconcileTestConfiguration is a configuration with two stores for the same GVK/R, told apart by their selectors.
+const reconcileTestConfiguration = `
+stores:
+  - g: "samplecontroller.k8s.io"
+    v: "v1alpha1"
+    k: "Foo"
+    r: "foos"
+    selectors:
+      label: "tier=a"
+    families:
+      - name: "foo_replicas"
+        help: "HELP_A"
+        metrics:
+          - labelKeys: [name]
+            labelValues: [metadata.name]
+            value: "spec.replicas"
+  - g: "samplecontroller.k8s.io"
+    v: "v1alpha1"
+    k: "Foo"
+    r: "foos"
+    selectors:
+      label: "tier=b"
+    families:
+      - name: "foo_replicas_b"
+        help: "HELP_B"
+        metrics:
+          - labelKeys: [name]
+            labelValues: [metadata.name]
+            value: "spec.replicas"
+`
+
+// newTestConfigurer parses the given configuration, and returns the configurer along with stores built for it, that
+// are not backed by reflectors.
+func newTestConfigurer(t *testing.T, raw string) (*configurer, []*StoreType) {
+	t.Helper()
+
+	c := newConfigurer(nil, nil, resolver.Options{Logger: klog.Background()}, storeTelemetry{}, sharding{}, 0)
+	if err := c.parse(raw); err != nil {
+		t.Fatalf("failed to parse configuration: %v", err)
+	}
+	stores := make([]*StoreType, len(c.configuration.Stores))
+	for i, s := range c.configuration.Stores {
+		stores[i] = newStore(context.Background(), klog.Background(), s.plan)
+		stores[i].identity = s.watchIdentity()
+	}
+
+	return c, stores
+}
+
+func TestConfigurerBuildReconciles(t *testing.T) {
+	t.Parallel()
+
+	_, existing := newTestConfigurer(t, reconcileTestConfiguration)
+	addTestObject(t, existing[1], newTestObject("foo", 3))
+
+	for _, tc := range []struct {
+		name        string
+		raw         string
+		wantStores  []*StoreType
+		wantReplans []*StoreType
+		wantStale   []*StoreType
+	}{
+		{
+			name:       "unchanged configuration keeps all stores",
+			raw:        reconcileTestConfiguration,
+			wantStores: existing,
+		},
+		{
+			name:        "render-only change replans the affected store",
+			raw:         strings.Replace(reconcileTestConfiguration, "HELP_B", "HELP_B_CHANGED", 1),
+			wantStores:  existing,
+			wantReplans: []*StoreType{existing[1]},
+		},
+		{
+			name: "removed store is stale",
+			raw: reconcileTestConfiguration[:strings.LastIndex(reconcileTestConfiguration,
+				`  - g: "samplecontroller.k8s.io"`)],
+			wantStores: existing[:1],
+			wantStale:  existing[1:],
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, _ := newTestConfigurer(t, tc.raw)
+			r, err := c.build(context.Background(), existing)
+			if err != nil {
+				t.Fatalf("failed to build configuration: %v", err)
+			}
+			if !slices.Equal(r.stores, tc.wantStores) {
+				t.Errorf("got stores %v, want %v", r.stores, tc.wantStores)
+			}
+			if len(r.started) != 0 {
+				t.Errorf("got %d started stores, want none", len(r.started))
+			}
+			if len(r.replans) != len(tc.wantReplans) {
+				t.Errorf("got %d replanned stores, want %d", len(r.replans), len(tc.wantReplans))
+			}
+			for _, s := range tc.wantReplans {
+				if _, ok := r.replans[s]; !ok {
+					t.Errorf("store %v was not replanned", s.identity)
+				}
+			}
+			if !slices.Equal(r.stale, tc.wantStale) {
+				t.Errorf("got stale stores %v, want %v", r.stale, tc.wantStale)
+			}
+		})
+	}
+}
+
+func TestConfigurerValidatesDefaultValues(t *testing.T) {
+	t.Parallel()
+
+	metric := strings.Replace(reconcileTestConfiguration, `          - labelKeys: [name]`, `          - onResolutionFailure: "defaultValue"
+            %s
+            labelKeys: [name]`, 1)
+	for _, tc := range []struct {
+		name    string
+		raw     string
+		wantErr bool
+	}{
+		{
+			name: "numeric default value",
+			raw:  fmt.Sprintf(metric, `defaultValue: "-1"`),
+		},
+		{
+			name: "non-numeric default label value",
+			raw:  fmt.Sprintf(metric, `defaultLabelValue: "unknown"`),
+		},
+		{
+			name:    "non-numeric default value",
+			raw:     fmt.Sprintf(metric, `defaultValue: "unknown"`),
+			wantErr: true,
+		},
+		{
+			name: "non-numeric inherited default value",
+			raw: strings.Replace(reconcileTestConfiguration, `      label: "tier=a"`, `      label: "tier=a"
+    defaultValue: "unknown"`, 1),
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := newConfigurer(nil, nil, resolver.Options{Logger: klog.Background()}, storeTelemetry{}, sharding{}, 0)
+			if err := c.parse(tc.raw); (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestStoreReplan(t *testing.T) {
+	t.Parallel()
+
+	_, stores := newTestConfigurer(t, reconcileTestConfiguration)
+	s := stores[0]
+	addTestObject(t, s, newTestObject("foo", 3))
+
+	c, _ := newTestConfigurer(t, strings.ReplaceAll(reconcileTestConfiguration, `"foo_replicas"`, `"foo_replicas_renamed"`))
+	if err := s.replan(c.configuration.Stores[0].plan); err != nil {
+		t.Fatalf("failed to replan store: %v", err)
+	}
+
+	out := &strings.Builder{}
+	if err := newMetricsWriter(s).writeAllTo(out); err != nil {
+		t.Fatalf("failed to write metrics: %v", err)
+	}
+	want := `kube_customresource_foo_replicas_renamed{name="foo",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 3`
+	if !strings.Contains(out.String(), want) {
+		t.Fatalf("got metrics:\n%s\nwant them to contain:\n%s", out.String(), want)
+	}
+}
+
+// celTestConfiguration is a configuration with a single store of Foo objects, whose value is a comprehension over the
+// objects' items, that is resolved with CEL.
+const celTestConfiguration = `
+stores:
+  - g: "samplecontroller.k8s.io"
+    v: "v1alpha1"
+    k: "Foo"
+    r: "foos"
+    resolver: "cel"
+    onResolutionFailure: "failObject"
+    families:
+      - name: "foo_items"
+        help: "Number of items for each Foo instance"
+        metrics:
+          - labelKeys: [name]
+            labelValues: [o.metadata.name]
+            value: "o.spec.items.map(x, x.name).size()"
+`
+
+func TestConfigurerCELOverrides(t *testing.T) {
+	t.Parallel()
+
+	object := newTestObject("foo", 1)
+	items := make([]interface{}, 1000)
+	for i := range items {
+		items[i] = map[string]interface{}{"name": "item"}
+	}
+	if err := unstructured.SetNestedSlice(object.Object, items, "spec", "items"); err != nil {
+		t.Fatalf("failed to set items: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name           string
+		overrides      string
+		wantCompileErr bool
+		wantRenderErr  bool
+	}{
+		{
+			name: "global options",
+		},
+		{
+			// The global limit admits the expression's worst-case cost, but the resource's does not.
+			name:           "tighter resource cost limit",
+			overrides:      "celCostLimit: 10\n",
+			wantCompileErr: true,
+		},
+		{
+			name:          "resource evaluation timeout",
+			overrides:     "celEvaluationTimeout: 1ns\n",
+			wantRenderErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			global := resolver.Options{Logger: klog.Background()}
+			global.CEL.Timeout = time.Minute
+			c := newConfigurer(nil, nil, global, storeTelemetry{}, sharding{}, 0)
+			err := c.parse(tc.overrides + celTestConfiguration)
+			if gotErr := err != nil; gotErr != tc.wantCompileErr {
+				t.Fatalf("got error %v parsing configuration, want error %t", err, tc.wantCompileErr)
+			}
+			if tc.wantCompileErr {
+				return
+			}
+			_, err = c.configuration.Stores[0].plan.render(context.Background(), klog.Background(), object)
+			if gotErr := err != nil; gotErr != tc.wantRenderErr {
+				t.Fatalf("got error %v rendering object, want error %t", err, tc.wantRenderErr)
+			}
+		})
+	}
+}
@@ -27,10 +27,6 @@ import (
 	"time"
 
 	"github.com/google/go-cmp/cmp"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/collectors"
-	versioncollector "github.com/prometheus/client_golang/prometheus/collectors/version"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/rexagod/crdmetrics/internal/version"
 	"github.com/rexagod/crdmetrics/pkg/apis/crdmetrics/v1alpha1"
 	clientset "github.com/rexagod/crdmetrics/pkg/generated/clientset/versioned"
@@ -40,13 +36,13 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/metadata"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
@@ -65,6 +61,9 @@ type Controller struct {
 	// dynamicClientset is a clientset for CRD operations.
 	dynamicClientset dynamic.Interface
 
+	// metadataClientset is a clientset for CRD operations that only require metadata.
+	metadataClientset metadata.Interface
+
 	// crdmetricsInformerFactory is a shared informer factory for managed resources.
 	crdmetricsInformerFactory informers.SharedInformerFactory
 
@@ -76,11 +75,28 @@ type Controller struct {
 	// recorder is an event recorder for recording event resources.
 	recorder record.EventRecorder
 
-	// crdmetricsUIDToStores is the handler's internal stores map. It records all stores associated with a managed resource.
-	crdmetricsUIDToStores map[types.UID][]*StoreType
+	// informerPool is the pool of shared informers that stores subscribe to.
+	informerPool *informerPool
+
+	// sharding decides the objects that the stores render.
+	sharding sharding
+
+	// storeRegistry records all stores associated with each managed resource. It is shared between the workers and the
+	// main server.
+	storeRegistry *storeRegistry
 
 	// options is the collection of command-line options.
 	options *Options
+
+	// telemetry holds the self metrics.
+	telemetry *telemetry
+
+	// health tracks the controller's state for the probes.
+	health *controllerHealth
+
+	// handler handles events for managed resources. It is shared across workers, so that the family conflicts it emits
+	// are tracked across events.
+	handler *crdmetricsHandler
 }
 
 // NewController returns a new sample controller.
@@ -90,6 +106,7 @@ func NewController(
 	kubeClientset kubernetes.Interface,
 	crdmetricsClientset clientset.Interface,
 	dynamicClientset dynamic.Interface,
+	metadataClientset metadata.Interface,
 ) *Controller {
 	logger := klog.FromContext(ctx)
 
@@ -121,10 +138,12 @@ func NewController(
 		kubeclientset:             kubeClientset,
 		crdmetricsClientset:       crdmetricsClientset,
 		dynamicClientset:          dynamicClientset,
+		metadataClientset:         metadataClientset,
 		crdmetricsInformerFactory: informers.NewSharedInformerFactory(crdmetricsClientset, 0),
 		workqueue:                 workqueue.NewTypedRateLimitingQueue[[2]string](ratelimiter),
 		recorder:                  recorder,
 		options:                   options,
+		telemetry:                 newTelemetry(),
 	}
 
 	// Set up event handlers for managed resources.
@@ -199,45 +218,94 @@ func (c *Controller) Run(ctx context.Context, workers int) error {
 
 	// Start the informer factories to begin populating the informer caches.
 	c.crdmetricsInformerFactory.Start(ctx.Done())
-	if ok := cache.WaitForCacheSync(ctx.Done(), c.crdmetricsInformerFactory.Crdmetrics().V1alpha1().CRDMetricsResources().Informer().HasSynced); !ok {
+	resourceInformer := c.crdmetricsInformerFactory.Crdmetrics().V1alpha1().CRDMetricsResources().Informer()
+	if ok := cache.WaitForCacheSync(ctx.Done(), resourceInformer.HasSynced); !ok {
 		return stderrors.New("failed to wait for caches to sync")
 	}
 
-	// Build the telemetry registry.
-	registry := prometheus.NewRegistry()
-	registry.MustRegister(
-		versioncollector.NewCollector(version.ControllerName),
-		collectors.NewGoCollector(),
-		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{Namespace: version.ControllerName, ReportErrors: true}),
-	)
-	requestDurationVec := promauto.With(registry).NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "http_request_duration_seconds",
-			Help:    "A histogram of requests for the main server's metrics endpoint.",
-			Buckets: prometheus.DefBuckets,
-		}, []string{"method", "code"},
-	)
+	// Resolve the shard of objects to render.
+	var err error
+	c.sharding, err = newSharding(ctx, c.kubeclientset, c.options)
+	if err != nil {
+		return fmt.Errorf("failed to resolve sharding: %w", err)
+	}
+	logger.V(1).Info("Resolved sharding", "shard", c.sharding.shard, "totalShards", c.sharding.totalShards)
 
 	// Build servers.
-	c.crdmetricsUIDToStores = make(map[types.UID][]*StoreType)
+	c.storeRegistry = newStoreRegistry()
+	c.informerPool = newInformerPool(ctx, c.dynamicClientset, c.metadataClientset, *c.options.TryNoCache, c.telemetry.liveReflectors)
+	c.handler = newCRDMetricsHandler(c.kubeclientset, c.crdmetricsClientset, c.informerPool, c.options, c.telemetry, c.sharding)
 	selfHost := *c.options.SelfHost
 	selfPort := *c.options.SelfPort
 	selfAddr := net.JoinHostPort(selfHost, strconv.Itoa(selfPort))
 	logger.V(1).Info("Configuring self server", "address", selfAddr)
 	selfInstance := newSelfServer(
 		net.JoinHostPort(selfHost, strconv.Itoa(selfPort)),
+		c.storeRegistry,
+		*c.options.SelfIntrospection,
 	)
-	self := selfInstance.build(ctx, c.kubeclientset, registry)
 	mainHost := *c.options.MainHost
 	mainPort := *c.options.MainPort
 	mainAddr := net.JoinHostPort(mainHost, strconv.Itoa(mainPort))
 	logger.V(1).Info("Configuring main server", "address", mainAddr)
 	mainInstance := newMainServer(
 		mainAddr,
-		c.crdmetricsUIDToStores,
-		requestDurationVec,
+		c.storeRegistry,
+		c.telemetry.requestDurationVec,
+		*c.options.MainZstd,
 	)
-	main := mainInstance.build(ctx, c.kubeclientset, registry)
+
+	// Track the controller's health for the probes. Resources present on startup need to be processed before the
+	// controller is ready.
+	c.health = newControllerHealth(
+		resourceInformer.HasSynced,
+		c.workqueue.Len,
+		workqueueStallTimeout(*c.options.StoreSyncTimeout),
+		selfInstance.source, mainInstance.source,
+	)
+	c.health.expectReconciled(resourceInformer.GetStore().ListKeys()...)
+
+	self := selfInstance.build(ctx, c.health, c.telemetry.registry)
+	selfSecurity, err := newServingSecurity(
+		ctx, c.kubeclientset, *c.options.SelfTLSCertFile, *c.options.SelfTLSKeyFile, *c.options.SelfAuthPaths,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to secure self server: %w", err)
+	}
+	selfSecurity.secure(self)
+	if *c.options.SelfIntrospection && !selfSecurity.requiresAuth("/debug/stores") {
+		logger.Info("Introspection paths are served without authentication, consider covering /debug with --self-auth-paths")
+	}
+	main := mainInstance.build(ctx, c.health, c.telemetry.registry)
+	mainSecurity, err := newServingSecurity(
+		ctx, c.kubeclientset, *c.options.MainTLSCertFile, *c.options.MainTLSKeyFile, *c.options.MainAuthPaths,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to secure main server: %w", err)
+	}
+	mainSecurity.secure(main)
+
+	// Push to the remote-write endpoint, if configured.
+	if *c.options.RemoteWriteURL != "" {
+		var remoteWriterInstance *remoteWriter
+		remoteWriterInstance, err = newRemoteWriter(c.storeRegistry, c.telemetry, c.options)
+		if err != nil {
+			return fmt.Errorf("failed to configure remote-write: %w", err)
+		}
+		logger.V(1).Info("Starting remote-write", "endpoint", remoteWriterInstance.endpoint, "interval", remoteWriterInstance.interval)
+		go remoteWriterInstance.run(ctx)
+	}
+
+	// Export to the OTLP endpoint, if configured.
+	if *c.options.OTLPEndpoint != "" {
+		var otlpExporterInstance *otlpExporter
+		otlpExporterInstance, err = newOTLPExporter(c.storeRegistry, c.telemetry, c.options)
+		if err != nil {
+			return fmt.Errorf("failed to configure OTLP export: %w", err)
+		}
+		logger.V(1).Info("Starting OTLP export", "endpoint", otlpExporterInstance.endpoint, "interval", otlpExporterInstance.interval)
+		go otlpExporterInstance.run(ctx)
+	}
 
 	// Launch `workers` amount of goroutines to process the work queue.
 	logger.V(1).Info("Starting workers")
@@ -252,13 +320,17 @@ func (c *Controller) Run(ctx context.Context, workers int) error {
 	// Start serving.
 	go func() {
 		logger.V(1).Info("Starting telemetry server")
-		if err := self.ListenAndServe(); err != nil {
+		err := selfSecurity.listenAndServe(self, func() { c.health.setServing(selfInstance.source, true) })
+		c.health.setServing(selfInstance.source, false)
+		if err != nil {
 			logger.Error(err, "stopping telemetry server")
 		}
 	}()
 	go func() {
 		logger.V(1).Info("Starting main server")
-		if err := main.ListenAndServe(); err != nil {
+		err := mainSecurity.listenAndServe(main, func() { c.health.setServing(mainInstance.source, true) })
+		c.health.setServing(mainInstance.source, false)
+		if err != nil {
 			logger.Error(err, "stopping main server")
 		}
 	}()
@@ -266,7 +338,7 @@ func (c *Controller) Run(ctx context.Context, workers int) error {
 	// Stop serving on context cancellation.
 	<-ctx.Done()
 	logger.V(1).Info("Shutting down servers")
-	err := self.Shutdown(ctx)
+	err = self.Shutdown(ctx)
 	if err != nil {
 		logger.Error(err, "error shutting down telemetry server")
 	}
@@ -290,11 +362,14 @@ func (c *Controller) processNextWorkItem(ctx context.Context) bool {
 	}
 
 	// Wrap this block in a func, so we can defer c.workqueue.Done. Forget the item if its invalid or processed.
+	item := c.health.startProcessing()
 	err := func(objectWithEvent [2]string) error {
 		defer c.workqueue.Done(objectWithEvent)
 		key := objectWithEvent[0]
 		event := objectWithEvent[1]
-		if err := c.syncHandler(ctx, key, event); err != nil {
+		err := c.syncHandler(withProgress(ctx, c.health, item), key, event)
+		c.health.finishProcessing(item, key, err == nil)
+		if err != nil {
 			// Put the item back on the workqueue to handle any transient errors.
 			c.workqueue.AddRateLimited(objectWithEvent)
 
@@ -340,6 +415,7 @@ func (c *Controller) syncHandler(ctx context.Context, key string, event string)
 		}
 
 		resource = &v1alpha1.CRDMetricsResource{}
+		resource.SetNamespace(namespace)
 		resource.SetName(name)
 	}
 
@@ -385,9 +461,7 @@ func (c *Controller) handleObject(ctx context.Context, objectI interface{}, even
 	logger.V(1).Info("Processing object")
 	switch o := object.(type) {
 	case *v1alpha1.CRDMetricsResource:
-		handler := newCRDMetricsHandler(c.kubeclientset, c.crdmetricsClientset, c.dynamicClientset)
-
-		return handler.handleEvent(ctx, c.crdmetricsUIDToStores, event, o, *c.options.TryNoCache)
+		return c.handler.handleEvent(ctx, c.storeRegistry, event, o)
 	default:
 		logger.Error(stderrors.New("unknown object type"), "cannot handle object")
 
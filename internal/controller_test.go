@@ -0,0 +1,193 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rexagod/crdmetrics/pkg/apis/crdmetrics/v1alpha1"
+	"github.com/rexagod/crdmetrics/pkg/generated/clientset/versioned/fake"
+	informers "github.com/rexagod/crdmetrics/pkg/generated/informers/externalversions"
+	"github.com/rexagod/crdmetrics/pkg/resolver"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/klog/v2"
+)
+
+func TestControllerEmitsConflictsOnce(t *testing.T) {
+	t.Parallel()
+
+	ctx := klog.NewContext(context.Background(), klog.Background())
+	client := fake.NewSimpleClientset(
+		&v1alpha1.CRDMetricsResource{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "a"}},
+		&v1alpha1.CRDMetricsResource{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "b"}},
+	)
+	registry := newStoreRegistry()
+	registry.swap("ns/a", nil, newTestStore(t, []*FamilyType{newTestFamily("foo_replicas", "Replicas")}))
+	registry.swap("ns/b", nil, newTestStore(t, []*FamilyType{newTestFamily("foo_replicas", "Other replicas")}))
+	newController := func() *Controller {
+		c := &Controller{
+			crdmetricsClientset:       client,
+			crdmetricsInformerFactory: informers.NewSharedInformerFactory(client, 0),
+			storeRegistry:             registry,
+			options:                   &Options{},
+			telemetry:                 newTelemetry(),
+		}
+		c.handler = newCRDMetricsHandler(nil, client, nil, c.options, c.telemetry, sharding{})
+
+		return c
+	}
+	statusUpdates := func() int {
+		var n int
+		for _, action := range client.Actions() {
+			if action.GetVerb() == "update" && action.GetSubresource() == "status" {
+				n++
+			}
+		}
+
+		return n
+	}
+
+	// Conflicts are recomputed on every event, for e.g., the deletion of an unrelated resource, but only emitted once.
+	c := newController()
+	if err := c.syncHandler(ctx, "ns/c", deleteEvent.String()); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	actions := len(client.Actions())
+	if err := c.syncHandler(ctx, "ns/c", deleteEvent.String()); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	if got := statusUpdates(); got != 1 {
+		t.Fatalf("got %d status updates, want 1", got)
+	}
+	for _, action := range client.Actions() {
+		if get, ok := action.(clienttesting.GetAction); ok && get.GetName() == "a" {
+			t.Fatalf("got a request for a resource without conflicts")
+		}
+	}
+	if got := client.Actions()[actions:]; len(got) != 0 {
+		t.Fatalf("got %d requests for unchanged conflicts, want none", len(got))
+	}
+	resource, err := client.CrdmetricsV1alpha1().CRDMetricsResources("ns").Get(ctx, "b", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get resource: %v", err)
+	}
+	if len(resource.Status.Conditions) != 1 || resource.Status.Conditions[0].Type != v1alpha1.ConditionType[v1alpha1.ConditionTypeConflicted] {
+		t.Fatalf("got conditions %v, want a single conflicted condition", resource.Status.Conditions)
+	}
+
+	// Conflicts already present on the resources are not emitted again, for e.g., after a restart.
+	if err = newController().syncHandler(ctx, "ns/c", deleteEvent.String()); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	if got := statusUpdates(); got != 1 {
+		t.Fatalf("got %d status updates after a restart, want 1", got)
+	}
+
+	// Conflicts emitted before a restart are cleared once resolved, as recorded when processing the resource.
+	c = newController()
+	c.handler.recordEmittedConflicts(resource)
+	registry.swap("ns/b", registry.get("ns/b"), newTestStore(t, []*FamilyType{newTestFamily("foo_replicas", "Replicas")}))
+	if err = c.syncHandler(ctx, "ns/c", deleteEvent.String()); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	if resource, err = client.CrdmetricsV1alpha1().CRDMetricsResources("ns").Get(ctx, "b", metav1.GetOptions{}); err != nil {
+		t.Fatalf("failed to get resource: %v", err)
+	}
+	if len(resource.Status.Conditions) != 1 || resource.Status.Conditions[0].Status != metav1.ConditionFalse {
+		t.Fatalf("got conditions %v, want a single resolved conflicted condition", resource.Status.Conditions)
+	}
+}
+
+func TestHandlerKeepsStoresOnSyncTimeout(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(klog.NewContext(context.Background(), klog.Background()))
+	defer cancel()
+
+	// The informers of the new stores never sync, since listing always fails.
+	gvr := schema.GroupVersionResource{Group: "samplecontroller.k8s.io", Version: "v1alpha1", Resource: "foos"}
+	dynamicClientset := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(
+		runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{gvr: "FooList"},
+	)
+	dynamicClientset.PrependReactor("list", "foos", func(clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("list unavailable")
+	})
+	telemetry := newTelemetry()
+	pool := newInformerPool(ctx, dynamicClientset, nil, false, telemetry.liveReflectors)
+
+	resource := &v1alpha1.CRDMetricsResource{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "a"},
+		Spec:       v1alpha1.CRDMetricsResourceSpec{Configuration: reconcileTestConfiguration},
+	}
+	client := fake.NewSimpleClientset(resource)
+	registry := newStoreRegistry()
+	existing := newTestStore(t, nil, newTestObject("foo", 1))
+	registry.swap("ns/a", nil, existing)
+
+	costLimit, evaluationTimeout, syncTimeout, debounce := resolver.DefaultCostLimit, time.Duration(0), 100*time.Millisecond, time.Duration(0)
+	options := &Options{
+		CELCostLimit:          &costLimit,
+		CELEvaluationTimeout:  &evaluationTimeout,
+		StoreSyncTimeout:      &syncTimeout,
+		StoreSnapshotDebounce: &debounce,
+	}
+	handler := newCRDMetricsHandler(nil, client, pool, options, telemetry, sharding{})
+	if err := handler.handleEvent(ctx, registry, updateEvent.String(), resource); err != nil {
+		t.Fatalf("failed to handle event: %v", err)
+	}
+
+	// The existing stores keep serving, and the update is reported as failed.
+	if got := registry.get("ns/a"); !slices.Equal(got, []*StoreType{existing}) {
+		t.Fatalf("got stores %v, want the existing ones", got)
+	}
+	got, err := client.CrdmetricsV1alpha1().CRDMetricsResources("ns").Get(ctx, "a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get resource: %v", err)
+	}
+	var failed, processed *metav1.Condition
+	for i, condition := range got.Status.Conditions {
+		switch condition.Type {
+		case v1alpha1.ConditionType[v1alpha1.ConditionTypeFailed]:
+			failed = &got.Status.Conditions[i]
+		case v1alpha1.ConditionType[v1alpha1.ConditionTypeProcessed]:
+			processed = &got.Status.Conditions[i]
+		}
+	}
+	if failed == nil || failed.Status != metav1.ConditionTrue || !strings.Contains(failed.Message, "Failed to sync stores, keeping existing stores") {
+		t.Fatalf("got failed condition %+v, want one for the sync timeout", failed)
+	}
+	if processed != nil && processed.Status == metav1.ConditionTrue {
+		t.Fatalf("got processed condition %+v, want it unset", processed)
+	}
+
+	// The stores that did not sync were stopped, along with their informers.
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if got := len(pool.informers); got != 0 {
+		t.Fatalf("got %d running informers, want none", got)
+	}
+}
@@ -0,0 +1,296 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rexagod/crdmetrics/pkg/resolver"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/klog/v2"
+)
+
+const (
+
+	// maxResolutionErrors is the number of recent resolution errors kept per store.
+	maxResolutionErrors = 10
+
+	// objectQueryParameter is the query parameter that selects the object, as namespace/name (or name, if cluster-scoped),
+	// to introspect the series of.
+	objectQueryParameter = "object"
+
+	// resourceQueryParameter is the query parameter that narrows down introspection to the given resource.
+	resourceQueryParameter = "resource"
+)
+
+// resolutionRecord is the outcome of resolving a query against an object.
+type resolutionRecord struct {
+	Time     time.Time               `json:"time"`
+	Object   string                  `json:"object"`
+	Family   string                  `json:"family"`
+	Query    string                  `json:"query"`
+	Resolved map[string]string       `json:"resolved,omitempty"`
+	Error    string                  `json:"error,omitempty"`
+	Policy   ResolutionFailurePolicy `json:"onResolutionFailure,omitempty"`
+}
+
+// resolutionRecorder records the outcomes of the queries resolved under a context, see withResolutionRecorder. A nil
+// recorder records nothing.
+type resolutionRecorder struct {
+
+	// limit is the number of records kept, dropping the oldest ones first, or 0 to keep all records.
+	limit int
+
+	// onlyFailures is set if only failed resolutions are recorded.
+	onlyFailures bool
+
+	// mutex guards records.
+	mutex sync.Mutex
+
+	// records are the recorded resolutions, oldest first.
+	records []resolutionRecord
+}
+
+// newResolutionRecorder returns a new resolutionRecorder.
+func newResolutionRecorder(limit int, onlyFailures bool) *resolutionRecorder {
+	return &resolutionRecorder{limit: limit, onlyFailures: onlyFailures}
+}
+
+// resolutionRecorderKey is the context key for resolution recorders.
+type resolutionRecorderKey struct{}
+
+// withResolutionRecorder returns a context that records all resolutions under it with the given recorder.
+func withResolutionRecorder(ctx context.Context, recorder *resolutionRecorder) context.Context {
+	return context.WithValue(ctx, resolutionRecorderKey{}, recorder)
+}
+
+// resolutionRecorderFrom returns the given context's recorder, or nil if it has none.
+func resolutionRecorderFrom(ctx context.Context) *resolutionRecorder {
+	recorder, _ := ctx.Value(resolutionRecorderKey{}).(*resolutionRecorder)
+
+	return recorder
+}
+
+// record records the resolution of the given query of the given metric plan against the given object.
+func (r *resolutionRecorder) record(m *metricPlan, u *unstructured.Unstructured, query string, resolved map[string]string, err error) {
+	if r == nil || (r.onlyFailures && err == nil) {
+		return
+	}
+	record := resolutionRecord{
+		Time:     time.Now(),
+		Object:   klog.KObj(u).String(),
+		Family:   m.family,
+		Query:    query,
+		Resolved: resolved,
+	}
+	if err != nil {
+		record.Error = err.Error()
+		record.Policy = m.onResolutionFailure
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.records = append(r.records, record)
+	if r.limit > 0 && len(r.records) > r.limit {
+		r.records = r.records[len(r.records)-r.limit:]
+	}
+}
+
+// recorded returns a copy of the recorded resolutions, oldest first.
+func (r *resolutionRecorder) recorded() []resolutionRecord {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]resolutionRecord(nil), r.records...)
+}
+
+// debugResource is the introspection of a resource's stores, as served on /debug/stores.
+type debugResource struct {
+	Name   string       `json:"name"`
+	Stores []debugStore `json:"stores"`
+}
+
+// debugStore is the introspection of a store.
+type debugStore struct {
+	Group                  string             `json:"group"`
+	Version                string             `json:"version"`
+	Kind                   string             `json:"kind"`
+	Resource               string             `json:"resource"`
+	LabelSelector          string             `json:"labelSelector,omitempty"`
+	FieldSelector          string             `json:"fieldSelector,omitempty"`
+	MetadataOnly           bool               `json:"metadataOnly"`
+	Synced                 bool               `json:"synced"`
+	Objects                int                `json:"objects"`
+	Series                 int                `json:"series"`
+	RecentResolutionErrors []resolutionRecord `json:"recentResolutionErrors"`
+}
+
+// debugObjectSeries is the introspection of an object's series in a store, as served on /debug/series.
+type debugObjectSeries struct {
+	Resource string             `json:"resource"`
+	Store    int                `json:"store"`
+	Group    string             `json:"group"`
+	Version  string             `json:"version"`
+	Kind     string             `json:"kind"`
+	Series   []string           `json:"series"`
+	Error    string             `json:"error,omitempty"`
+	Trace    []resolutionRecord `json:"trace"`
+}
+
+// introspect returns the introspection of the store, as of its latest snapshot.
+func (s *StoreType) introspect() debugStore {
+	s.mutex.RLock()
+	objects := len(s.keys)
+	s.mutex.RUnlock()
+
+	series := 0
+	for _, f := range s.loadSnapshot().families {
+		series += bytes.Count(f.series, []byte("\n"))
+	}
+
+	return debugStore{
+		Group:                  s.identity.GroupVersionKind.Group,
+		Version:                s.identity.GroupVersionKind.Version,
+		Kind:                   s.identity.GroupVersionKind.Kind,
+		Resource:               s.identity.GroupVersionResource.Resource,
+		LabelSelector:          s.identity.labelSelector,
+		FieldSelector:          s.identity.fieldSelector,
+		MetadataOnly:           s.identity.metadataOnly,
+		Synced:                 s.hasSynced != nil && s.hasSynced(),
+		Objects:                objects,
+		Series:                 series,
+		RecentResolutionErrors: s.resolutionErrors.recorded(),
+	}
+}
+
+// introspectObject returns the series of the object with the given key, as currently served, along with a trace of its
+// resolutions, or false if the store does not hold the object. The object is rendered anew for the trace, without
+// affecting the store, or the resource's CEL evaluation cost.
+func (s *StoreType) introspectObject(ctx context.Context, logger klog.Logger, key string) (debugObjectSeries, bool) {
+	s.mutex.RLock()
+	plan := s.plan
+	_, ok := slices.BinarySearchFunc(s.keys, key, compareObjectKeys)
+	var object *unstructured.Unstructured
+	var served []renderedFamily
+	if ok {
+		object, ok, _ = s.objectLocked(key)
+		served = s.metrics[key]
+	}
+	s.mutex.RUnlock()
+	if !ok {
+		return debugObjectSeries{}, false
+	}
+
+	introspection := debugObjectSeries{
+		Group:   plan.gvk.Group,
+		Version: plan.gvk.Version,
+		Kind:    plan.gvk.Kind,
+		Series:  []string{},
+	}
+	for _, f := range served {
+		for _, line := range strings.SplitAfter(string(f.series), "\n") {
+			if line != "" {
+				introspection.Series = append(introspection.Series, strings.TrimSuffix(line, "\n"))
+			}
+		}
+	}
+	recorder := newResolutionRecorder(0, false)
+	ctx = resolver.WithoutCostObserver(withResolutionRecorder(ctx, recorder))
+	if _, err := plan.render(ctx, logger, object); err != nil {
+		introspection.Error = err.Error()
+	}
+	introspection.Trace = recorder.recorded()
+
+	return introspection, true
+}
+
+// storesHandler returns an http.Handler that lists every resource's stores, as served on /debug/stores.
+func storesHandler(logger klog.Logger, registry *storeRegistry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		snapshot := registry.snapshot()
+		resources := make([]debugResource, 0, len(snapshot.keys))
+		for _, key := range snapshot.keys {
+			resource := debugResource{Name: key, Stores: make([]debugStore, 0, len(snapshot.stores[key]))}
+			for _, s := range snapshot.stores[key] {
+				resource.Stores = append(resource.Stores, s.introspect())
+			}
+			resources = append(resources, resource)
+		}
+		writeDebugResponse(logger, w, resources)
+	})
+}
+
+// seriesHandler returns an http.Handler that introspects the series of the object given by the `object` query
+// parameter, across all stores, or those of the resource given by the `resource` query parameter, as served on
+// /debug/series.
+func seriesHandler(logger klog.Logger, registry *storeRegistry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		object := query.Get(objectQueryParameter)
+		if object == "" {
+			http.Error(w, fmt.Sprintf("expected an %s query parameter, as namespace/name", objectQueryParameter), http.StatusBadRequest)
+
+			return
+		}
+		snapshot := registry.snapshot()
+		keys := snapshot.keys
+		if resource := query.Get(resourceQueryParameter); resource != "" {
+			if _, ok := snapshot.stores[resource]; !ok {
+				http.Error(w, fmt.Sprintf("resource %q not found", resource), http.StatusNotFound)
+
+				return
+			}
+			keys = []string{resource}
+		}
+		introspections := []debugObjectSeries{}
+		for _, key := range keys {
+			for i, s := range snapshot.stores[key] {
+				introspection, ok := s.introspectObject(r.Context(), logger, object)
+				if !ok {
+					continue
+				}
+				introspection.Resource, introspection.Store = key, i
+				introspections = append(introspections, introspection)
+			}
+		}
+		if len(introspections) == 0 {
+			http.Error(w, fmt.Sprintf("object %q not found in any store", object), http.StatusNotFound)
+
+			return
+		}
+		writeDebugResponse(logger, w, introspections)
+	})
+}
+
+// writeDebugResponse writes out the given introspection as indented JSON.
+func writeDebugResponse(logger klog.Logger, w http.ResponseWriter, introspection any) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(introspection); err != nil {
+		logger.Error(err, "error writing introspection")
+	}
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rexagod/crdmetrics/pkg/resolver"
+	"k8s.io/klog/v2"
+)
+
+// newTestDebugServer returns a test server serving the self server's handlers, for a registry holding a single store,
+// whose second family never resolves, with the given number of objects.
+func newTestDebugServer(t *testing.T, objects int) *httptest.Server {
+	t.Helper()
+
+	plan, err := newStorePlan(&StoreType{
+		Group:   "samplecontroller.k8s.io",
+		Version: "v1alpha1",
+		Kind:    "Foo",
+		Families: []*FamilyType{
+			{
+				Name: "foo_replicas",
+				Help: "Replicas",
+				Metrics: []*MetricType{{
+					LabelKeys:   []string{"name"},
+					LabelValues: []string{"metadata.name"},
+					Value:       "spec.replicas",
+				}},
+			},
+			{
+				Name:                "foo_missing",
+				Help:                "Missing",
+				OnResolutionFailure: ResolutionFailurePolicySkipSeries,
+				Metrics: []*MetricType{{
+					LabelKeys:   []string{"name"},
+					LabelValues: []string{"metadata.name"},
+					Value:       "spec.missing",
+				}},
+			},
+		},
+	}, resolver.Options{Logger: klog.Background()})
+	if err != nil {
+		t.Fatalf("failed to compile plan: %v", err)
+	}
+	s := newStore(context.Background(), klog.Background(), plan)
+	s.identity.GroupVersionResource.Resource = "foos"
+	for i := range objects {
+		addTestObject(t, s, newTestObject(fmt.Sprintf("foo-%02d", i), int64(i)))
+	}
+	registry := newStoreRegistry()
+	registry.swap("default/foo", nil, s)
+	server := httptest.NewServer(
+		newSelfServer("", registry, true).build(context.Background(), newTestControllerHealth(), prometheus.NewRegistry()).Handler,
+	)
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// getDebug decodes the introspection served on the given path of the given server into the given value, and returns
+// the response's status.
+func getDebug(t *testing.T, server *httptest.Server, path string, into any) int {
+	t.Helper()
+
+	request, err := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL+path, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusOK {
+		if err = json.NewDecoder(response.Body).Decode(into); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return response.StatusCode
+}
+
+func TestDebugStores(t *testing.T) {
+	t.Parallel()
+
+	server := newTestDebugServer(t, maxResolutionErrors+2)
+	var resources []debugResource
+	if status := getDebug(t, server, "/debug/stores", &resources); status != http.StatusOK {
+		t.Fatalf("got status %d, want %d", status, http.StatusOK)
+	}
+	if len(resources) != 1 || resources[0].Name != "default/foo" || len(resources[0].Stores) != 1 {
+		t.Fatalf("got resources %+v, want a single store for default/foo", resources)
+	}
+	store := resources[0].Stores[0]
+	if store.Resource != "foos" || store.Objects != maxResolutionErrors+2 || store.Series != maxResolutionErrors+2 {
+		t.Fatalf("got resource %q, with %d objects and %d series, want foos, with %d of each",
+			store.Resource, store.Objects, store.Series, maxResolutionErrors+2)
+	}
+
+	// Only the most recent errors are kept.
+	if got := len(store.RecentResolutionErrors); got != maxResolutionErrors {
+		t.Fatalf("got %d recent resolution errors, want %d", got, maxResolutionErrors)
+	}
+	last := store.RecentResolutionErrors[maxResolutionErrors-1]
+	if last.Object != fmt.Sprintf("default/foo-%02d", maxResolutionErrors+1) || last.Family != "foo_missing" ||
+		last.Query != "spec.missing" || last.Policy != ResolutionFailurePolicySkipSeries || last.Error == "" {
+		t.Fatalf("got last resolution error %+v, want one for spec.missing of the last object", last)
+	}
+}
+
+func TestDebugSeries(t *testing.T) {
+	t.Parallel()
+
+	server := newTestDebugServer(t, 2)
+	var introspections []debugObjectSeries
+	query := url.Values{objectQueryParameter: {"default/foo-01"}}.Encode()
+	if status := getDebug(t, server, "/debug/series?"+query, &introspections); status != http.StatusOK {
+		t.Fatalf("got status %d, want %d", status, http.StatusOK)
+	}
+	if len(introspections) != 1 {
+		t.Fatalf("got %d introspections, want 1", len(introspections))
+	}
+	introspection := introspections[0]
+	wantSeries := []string{
+		`kube_customresource_foo_replicas{name="foo-01",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1.000000`,
+	}
+	if diff := cmp.Diff(wantSeries, introspection.Series); diff != "" {
+		t.Fatalf("unexpected series (-want +got):\n%s", diff)
+	}
+	type step struct {
+		Family, Query, Error string
+	}
+	var gotTrace []step
+	for _, record := range introspection.Trace {
+		if record.Object != "default/foo-01" {
+			t.Fatalf("got trace for object %q, want default/foo-01", record.Object)
+		}
+		gotTrace = append(gotTrace, step{record.Family, record.Query, record.Error})
+	}
+	wantTrace := []step{
+		{"foo_replicas", "metadata.name", ""},
+		{"foo_replicas", "spec.replicas", ""},
+		{"foo_missing", "metadata.name", ""},
+		{"foo_missing", "spec.missing", "failed to resolve query: field not found"},
+	}
+	if diff := cmp.Diff(wantTrace, gotTrace); diff != "" {
+		t.Fatalf("unexpected trace (-want +got):\n%s", diff)
+	}
+
+	// Unknown objects and resources, and missing objects, are reported.
+	for path, want := range map[string]int{
+		"/debug/series":                                    http.StatusBadRequest,
+		"/debug/series?object=default/bar":                 http.StatusNotFound,
+		"/debug/series?object=default/foo-01&resource=qux": http.StatusNotFound,
+	} {
+		if status := getDebug(t, server, path, nil); status != want {
+			t.Fatalf("got status %d for %s, want %d", status, path, want)
+		}
+	}
+}
+
+func TestDebugIntrospectionDisabled(t *testing.T) {
+	t.Parallel()
+
+	registry := newStoreRegistry()
+	registry.swap("default/foo", nil, newTestStore(t, nil, newTestObject("foo-01", 1)))
+	server := httptest.NewServer(
+		newSelfServer("", registry, false).build(context.Background(), newTestControllerHealth(), prometheus.NewRegistry()).Handler,
+	)
+	t.Cleanup(server.Close)
+
+	// Introspection paths are not served unless enabled.
+	for _, path := range []string{"/debug/stores", "/debug/series?object=default/foo-01"} {
+		if status := getDebug(t, server, path, nil); status != http.StatusNotFound {
+			t.Fatalf("got status %d for %s, want %d", status, path, http.StatusNotFound)
+		}
+	}
+}
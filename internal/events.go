@@ -20,22 +20,27 @@ import (
 	"context"
 	stderrors "errors"
 	"fmt"
+	"reflect"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rexagod/crdmetrics/internal/version"
 	"github.com/rexagod/crdmetrics/pkg/apis/crdmetrics/v1alpha1"
 	clientset "github.com/rexagod/crdmetrics/pkg/generated/clientset/versioned"
+	"github.com/rexagod/crdmetrics/pkg/resolver"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
-	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
 )
 
+// metadataUpdateTimeout is the time that updating the metadata of a managed resource is retried for.
+const metadataUpdateTimeout = time.Minute
+
 // eventType represents the type of event received from the informer.
 type eventType int
 
@@ -58,30 +63,52 @@ type crdmetricsHandler struct {
 	// crdmetricsClientset is the clientset used to update the status of the managed resource.
 	crdmetricsClientset clientset.Interface
 
-	// dynamicClientset is the dynamic clientset used to build stores for different objects.
-	dynamicClientset dynamic.Interface
+	// informers is the pool of shared informers that stores subscribe to.
+	informers *informerPool
+
+	// options is the collection of command-line options.
+	options *Options
+
+	// telemetry holds the self metrics.
+	telemetry *telemetry
+
+	// sharding decides the objects that the stores render.
+	sharding sharding
+
+	// conflictsMutex guards emittedConflicts, and serializes emitting conflicts.
+	conflictsMutex sync.Mutex
+
+	// emittedConflicts are the family conflicts last emitted on each resource, by resource key. Resources without an
+	// entry have no conflicts emitted on them.
+	emittedConflicts map[string]string
 }
 
 // newCRDMetricsHandler creates a new crdmetricsHandler.
 func newCRDMetricsHandler(
 	kubeClientset kubernetes.Interface,
 	crdmetricsClientset clientset.Interface,
-	dynamicClientset dynamic.Interface,
+	informers *informerPool,
+	options *Options,
+	telemetry *telemetry,
+	sharding sharding,
 ) *crdmetricsHandler {
 	return &crdmetricsHandler{
 		kubeClientset:       kubeClientset,
 		crdmetricsClientset: crdmetricsClientset,
-		dynamicClientset:    dynamicClientset,
+		informers:           informers,
+		options:             options,
+		telemetry:           telemetry,
+		sharding:            sharding,
+		emittedConflicts:    map[string]string{},
 	}
 }
 
 // HandleEvent handles events received from the informer.
 func (h *crdmetricsHandler) handleEvent(
 	ctx context.Context,
-	crdmetricsUIDToStoresMap map[types.UID][]*StoreType,
+	registry *storeRegistry,
 	event string,
 	o metav1.Object,
-	tryNoCache bool,
 ) error {
 	logger := klog.FromContext(ctx)
 
@@ -94,6 +121,19 @@ func (h *crdmetricsHandler) handleEvent(
 	}
 	kObj := klog.KObj(resource).String()
 
+	// Drop all associated stores. The resource no longer exists, so there is no metadata or status to update, but the
+	// families it conflicted with may now be exposed.
+	if event == deleteEvent.String() {
+		stopStores(logger, registry.drop(kObj))
+		h.telemetry.deleteResource(kObj)
+		h.conflictsMutex.Lock()
+		delete(h.emittedConflicts, kObj)
+		h.conflictsMutex.Unlock()
+		h.emitConflicts(ctx, registry)
+
+		return nil
+	}
+
 	// Preemptively update the resource metadata. We poll here to avoid same resource versions across update bursts.
 	err := h.updateMetadata(ctx, resource)
 	if err != nil {
@@ -101,6 +141,7 @@ func (h *crdmetricsHandler) handleEvent(
 
 		return nil // Do not requeue.
 	}
+	reportProgress(ctx)
 
 	// Update resource status.
 	resource, err = h.emitSuccessOnResource(ctx, resource, metav1.ConditionFalse, fmt.Sprintf("Event handler received event: %s", event))
@@ -109,6 +150,8 @@ func (h *crdmetricsHandler) handleEvent(
 
 		return nil // Do not requeue.
 	}
+	h.recordEmittedConflicts(resource)
+	reportProgress(ctx)
 
 	// Process the fetched configuration.
 	configurationYAML := resource.Spec.Configuration
@@ -119,22 +162,23 @@ func (h *crdmetricsHandler) handleEvent(
 
 		return nil
 	}
-	configurerInstance := newConfigurer(h.dynamicClientset, resource)
-
-	// dropStores drops associated stores between resource changes.
-	dropStores := func() {
-		resourceUID := resource.GetUID()
-		if _, ok = crdmetricsUIDToStoresMap[resourceUID]; ok {
-			// The associated stores are only reachable through the map. Deleting them will trigger the GC.
-			delete(crdmetricsUIDToStoresMap, resourceUID)
-		}
-	}
+	celCostTotal := h.telemetry.celCostTotalVec.WithLabelValues(kObj)
+	configurerInstance := newConfigurer(h.informers, resource, resolver.Options{
+		Logger: logger,
+		CEL: resolver.CELOptions{
+			CostLimit: *h.options.CELCostLimit,
+			Timeout:   *h.options.CELEvaluationTimeout,
+			CostObserver: func(cost uint64) {
+				celCostTotal.Add(float64(cost))
+			},
+		},
+	}, h.telemetry.forResource(kObj), h.sharding, *h.options.StoreSnapshotDebounce)
 
 	// Handle the event.
 	switch event {
-	// Build all associated stores.
+	// Build all associated stores, and swap them in for the existing ones once synced. The existing stores keep serving
+	// until then, and are kept if the new ones cannot be built.
 	case addEvent.String(), updateEvent.String():
-		dropStores()
 		err = configurerInstance.parse(configurationYAML)
 		if err != nil {
 			logger.Error(fmt.Errorf("failed to parse configuration YAML: %w", err), "cannot process the resource")
@@ -142,11 +186,40 @@ func (h *crdmetricsHandler) handleEvent(
 
 			return nil
 		}
-		configurerInstance.build(ctx, crdmetricsUIDToStoresMap, tryNoCache)
+		// Only stores whose watch changed are rebuilt, the rest are reused.
+		existing := registry.get(kObj)
+		r, err := configurerInstance.build(ctx, existing)
+		if err != nil {
+			logger.Error(fmt.Errorf("failed to build stores: %w", err), "cannot process the resource, keeping existing stores")
+			h.emitFailureOnResource(ctx, resource, fmt.Sprintf("Failed to build stores, keeping existing stores: %s", err))
 
-	// Drop all associated stores.
-	case deleteEvent.String():
-		dropStores()
+			return nil
+		}
+		reportProgress(ctx)
+		logger.V(1).Info("Reconciling stores",
+			"kept", len(r.stores)-len(r.started), "replanned", len(r.replans), "started", len(r.started), "stale", len(r.stale))
+		err = waitForStoresSync(ctx, r.started, *h.options.StoreSyncTimeout)
+		if err != nil {
+			stopStores(logger, r.started)
+			logger.Error(fmt.Errorf("failed to sync stores: %w", err), "cannot process the resource, keeping existing stores")
+			h.emitFailureOnResource(ctx, resource, fmt.Sprintf("Failed to sync stores, keeping existing stores: %s", err))
+
+			return nil
+		}
+		reportProgress(ctx)
+		if !registry.swap(kObj, existing, r.stores...) {
+			stopStores(logger, r.started)
+
+			return fmt.Errorf("stores for %s changed while reconciling, requeuing", kObj)
+		}
+		if err = r.apply(); err != nil {
+			logger.Error(fmt.Errorf("failed to re-render stores: %w", err), "some objects will not generate metrics")
+		}
+		stopStores(logger, r.stale)
+		reportProgress(ctx)
+
+		// Report any families that conflict with the ones being exposed, on this resource, as well as on the others.
+		h.emitConflicts(ctx, registry)
 
 	// This should never happen.
 	default:
@@ -167,6 +240,30 @@ func (h *crdmetricsHandler) handleEvent(
 	return nil
 }
 
+// waitForStoresSync blocks until all given stores have synced, or until the given timeout elapses.
+func waitForStoresSync(ctx context.Context, stores []*StoreType, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for i, s := range stores {
+		if err := s.waitForSync(ctx); err != nil {
+			return fmt.Errorf("store %d (%s): %w", i, s.plan.gvk.String(), err)
+		}
+	}
+
+	return nil
+}
+
+// stopStores stops the given stores, that must no longer be reachable through the registry.
+func stopStores(logger klog.Logger, stores []*StoreType) {
+	for _, s := range stores {
+		s.stop()
+	}
+	if len(stores) > 0 {
+		logger.V(1).Info("Stopped stores", "count", len(stores))
+	}
+}
+
 // emitSuccessOnResource emits a success condition on the given resource.
 func (h *crdmetricsHandler) emitSuccessOnResource(
 	ctx context.Context,
@@ -195,6 +292,89 @@ func (h *crdmetricsHandler) emitSuccessOnResource(
 	return resource, nil
 }
 
+// emitConflicts recomputes the family conflicts across all resources in the given registry, since changing the stores
+// of any one resource may introduce, or resolve, conflicts on the others, and emits them on each resource whose
+// conflicts changed since they were last emitted. Resources whose conflicts did not change are not requested at all.
+func (h *crdmetricsHandler) emitConflicts(ctx context.Context, registry *storeRegistry) {
+	logger := klog.FromContext(ctx)
+
+	h.conflictsMutex.Lock()
+	defer h.conflictsMutex.Unlock()
+
+	snapshot := registry.snapshot()
+	conflicts := registryConflicts(snapshot)
+	for _, key := range snapshot.keys {
+		message := strings.Join(conflicts[key], "; ")
+		if h.emittedConflicts[key] == message {
+			continue
+		}
+		if message != "" {
+			logger.Error(fmt.Errorf("found conflicting families for %s: %s", key, message), "some families will not be exposed")
+		}
+		if err := h.emitConflictsOnResource(ctx, key, conflicts[key]); err != nil {
+			logger.Error(fmt.Errorf("failed to emit conflicts on %s: %w", key, err), "cannot update the resource")
+
+			continue
+		}
+		h.emittedConflicts[key] = message
+		reportProgress(ctx)
+	}
+}
+
+// recordEmittedConflicts records the family conflicts present on the given resource as emitted, so that conflicts
+// emitted before a restart are cleared once resolved, and not emitted again otherwise.
+func (h *crdmetricsHandler) recordEmittedConflicts(resource *v1alpha1.CRDMetricsResource) {
+	h.conflictsMutex.Lock()
+	defer h.conflictsMutex.Unlock()
+
+	var message string
+	for _, condition := range resource.Status.Conditions {
+		if condition.Type == v1alpha1.ConditionType[v1alpha1.ConditionTypeConflicted] && condition.Status == metav1.ConditionTrue {
+			message = condition.Message
+		}
+	}
+	h.emittedConflicts[klog.KObj(resource).String()] = message
+}
+
+// emitConflictsOnResource emits the given family conflicts on the resource with the given key, or clears any previously
+// emitted ones if there are none.
+func (h *crdmetricsHandler) emitConflictsOnResource(ctx context.Context, key string, conflicts []string) error {
+	namespace, name := splitObjectKey(key)
+	resource, err := h.crdmetricsClientset.CrdmetricsV1alpha1().CRDMetricsResources(namespace).
+		Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %w", key, err)
+	}
+	conditionType := v1alpha1.ConditionType[v1alpha1.ConditionTypeConflicted]
+	condition := metav1.Condition{
+		Type:    conditionType,
+		Status:  metav1.ConditionTrue,
+		Message: strings.Join(conflicts, "; "),
+	}
+	if len(conflicts) == 0 {
+		// Avoid an update if there were no conflicts to begin with.
+		if !slices.ContainsFunc(resource.Status.Conditions, func(c metav1.Condition) bool { return c.Type == conditionType }) {
+			return nil
+		}
+		condition.Status = metav1.ConditionFalse
+		condition.Message = "Conflicts were resolved"
+	}
+	updated := resource.DeepCopy()
+	updated.Status.Set(updated, condition)
+
+	// Avoid an update if the conflicts were already emitted, for e.g., before a restart.
+	if reflect.DeepEqual(updated.Status, resource.Status) {
+		return nil
+	}
+	_, err = h.crdmetricsClientset.CrdmetricsV1alpha1().CRDMetricsResources(updated.GetNamespace()).
+		UpdateStatus(ctx, updated, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to update the status of %s: %w", key, err)
+	}
+
+	return nil
+}
+
 // emitFailureOnResource emits a failure condition on the given resource.
 func (h *crdmetricsHandler) emitFailureOnResource(
 	ctx context.Context,
@@ -229,7 +409,7 @@ func (h *crdmetricsHandler) updateMetadata(ctx context.Context, resource *v1alph
 	logger := klog.FromContext(ctx)
 	kObj := klog.KObj(resource).String()
 
-	err := wait.PollUntilContextTimeout(ctx, time.Second, time.Minute, false, func(context.Context) (
+	err := wait.PollUntilContextTimeout(ctx, time.Second, metadataUpdateTimeout, false, func(context.Context) (
 		bool,
 		error,
 	) {
@@ -17,13 +17,12 @@ limitations under the License.
 package internal
 
 import (
+	"errors"
 	"fmt"
-	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/rexagod/crdmetrics/pkg/resolver"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"k8s.io/klog/v2"
 )
 
 const (
@@ -38,36 +37,173 @@ const (
 	kubeCustomResourcePrefix = "kube_customresource_"
 )
 
-// ResolverType represents the type of resolver to use to evaluate the labelset expressions.
+// ResolverType represents the type of resolver to use to evaluate the labelset expressions. Resolvers are looked up by
+// name in the resolver registry, see resolver.Register.
 type ResolverType string
 
 const (
 
 	// ResolverTypeCEL represents the CEL resolver.
-	ResolverTypeCEL ResolverType = "cel"
+	ResolverTypeCEL ResolverType = resolver.CELResolverName
 
 	// ResolverTypeUnstructured represents the Unstructured resolver.
-	ResolverTypeUnstructured ResolverType = "unstructured"
+	ResolverTypeUnstructured ResolverType = resolver.UnstructuredResolverName
 
 	// ResolverTypeNone represents an empty resolver.
 	ResolverTypeNone ResolverType = ""
 )
 
+// validate checks if the resolver is registered.
+func (r ResolverType) validate() error {
+	if r == ResolverTypeNone {
+		return nil
+	}
+	if _, ok := resolver.Lookup(string(r)); !ok {
+		return fmt.Errorf("unknown resolver %q, expected one of %q", r, resolver.Names())
+	}
+
+	return nil
+}
+
+// ResolutionFailurePolicy represents the action to take when a query cannot be resolved against an object.
+type ResolutionFailurePolicy string
+
+const (
+
+	// ResolutionFailurePolicyLiteral uses the query itself as the resolved value.
+	ResolutionFailurePolicyLiteral ResolutionFailurePolicy = "literal"
+
+	// ResolutionFailurePolicySkipSeries drops the series that the query belongs to.
+	ResolutionFailurePolicySkipSeries ResolutionFailurePolicy = "skipSeries"
+
+	// ResolutionFailurePolicyEmptyLabel uses an empty string as the resolved label value. Series whose value cannot be
+	// resolved are dropped.
+	ResolutionFailurePolicyEmptyLabel ResolutionFailurePolicy = "emptyLabel"
+
+	// ResolutionFailurePolicyDefaultValue uses the configured default label value, or default value, as the resolved label
+	// value, or metric value, respectively. Series whose value cannot be resolved are dropped if no default value is
+	// configured.
+	ResolutionFailurePolicyDefaultValue ResolutionFailurePolicy = "defaultValue"
+
+	// ResolutionFailurePolicyFailObject drops all series generated for the object.
+	ResolutionFailurePolicyFailObject ResolutionFailurePolicy = "failObject"
+
+	// ResolutionFailurePolicyNone represents an empty policy.
+	ResolutionFailurePolicyNone ResolutionFailurePolicy = ""
+)
+
+// validate checks if the policy is a known one.
+func (p ResolutionFailurePolicy) validate() error {
+	switch p {
+	case ResolutionFailurePolicyNone,
+		ResolutionFailurePolicyLiteral,
+		ResolutionFailurePolicySkipSeries,
+		ResolutionFailurePolicyEmptyLabel,
+		ResolutionFailurePolicyDefaultValue,
+		ResolutionFailurePolicyFailObject:
+		return nil
+	default:
+		return fmt.Errorf("unknown resolution failure policy %q", p)
+	}
+}
+
+// validateDefaultValue checks if the given default value, if any, can be parsed as a metric value.
+func validateDefaultValue(value string) error {
+	if value == "" {
+		return nil
+	}
+	if _, err := strconv.ParseFloat(value, 64); err != nil {
+		return fmt.Errorf("expected default value %q to be numeric: %w", value, err)
+	}
+
+	return nil
+}
+
+// FamilyKind represents the OpenMetrics type of a metric family. All families are exposed as gauges in the Prometheus
+// text format (see metricTypeGauge), and only OpenMetrics exposes their kind.
+type FamilyKind string
+
+const (
+
+	// FamilyKindGauge represents a gauge family.
+	FamilyKindGauge FamilyKind = "gauge"
+
+	// FamilyKindCounter represents a counter family. Its series are suffixed with `_total`, and, if enabled, are
+	// accompanied by `_created` series holding the objects' creation timestamps under OpenMetrics.
+	FamilyKindCounter FamilyKind = "counter"
+
+	// FamilyKindInfo represents an info family. Its series are suffixed with `_info`, and always have a value of 1.
+	FamilyKindInfo FamilyKind = "info"
+
+	// FamilyKindStateSet represents a stateset family. Each of its metrics must have a label key named after the family,
+	// that denotes the state, and their values are either 1 (if set) or 0.
+	FamilyKindStateSet FamilyKind = "stateset"
+
+	// FamilyKindNone represents an empty kind, that defaults to FamilyKindGauge.
+	FamilyKindNone FamilyKind = ""
+)
+
+// validate checks if the kind is a known one.
+func (k FamilyKind) validate() error {
+	switch k {
+	case FamilyKindNone, FamilyKindGauge, FamilyKindCounter, FamilyKindInfo, FamilyKindStateSet:
+		return nil
+	default:
+		return fmt.Errorf("unknown family kind %q", k)
+	}
+}
+
+// suffix returns the suffix of the series of the kind.
+func (k FamilyKind) suffix() string {
+	switch k {
+	case FamilyKindCounter:
+		return "_total"
+	case FamilyKindInfo:
+		return "_info"
+	case FamilyKindNone, FamilyKindGauge, FamilyKindStateSet:
+		fallthrough
+	default:
+		return ""
+	}
+}
+
+// validate checks if the family's kind, and its attributes, are compatible with OpenMetrics.
+func (f *FamilyType) validate() error {
+	if err := errors.Join(
+		f.Kind.validate(), f.Resolver.validate(), f.OnResolutionFailure.validate(), validateDefaultValue(f.DefaultValue),
+	); err != nil {
+		return err
+	}
+	if f.Unit != "" && !strings.HasSuffix(f.Name, "_"+f.Unit) {
+		return fmt.Errorf("expected name to be suffixed with its unit %q", f.Unit)
+	}
+	if f.Created && f.Kind != FamilyKindCounter {
+		return fmt.Errorf("created timestamps are only supported for %q families", FamilyKindCounter)
+	}
+
+	return nil
+}
+
+// errObjectFailed is returned when an object's resolution failed under the ResolutionFailurePolicyFailObject policy.
+var errObjectFailed = errors.New("object failed to resolve")
+
 // FamilyType represents a metric family (a group of metrics with the same name).
 type FamilyType struct {
 
-	// logger is the family's logger.
-	logger klog.Logger
-
 	// Name is the Name of the metric family.
 	Name string `yaml:"name"`
 
 	// Help is the Help text for the metric family.
 	Help string `yaml:"help"`
 
-	// t is the type of the metric family.
-	// NOTE: This will always be pinned to `gauge`, and thus not exported for unmarshalling.
-	t string
+	// Kind is the OpenMetrics type of the metric family.
+	Kind FamilyKind `yaml:"kind,omitempty"`
+
+	// Unit is the OpenMetrics unit of the metric family. The family's name must be suffixed with it.
+	Unit string `yaml:"unit,omitempty"`
+
+	// Created exposes the objects' creation timestamps as the created timestamps of counter families, under OpenMetrics.
+	Created bool `yaml:"created,omitempty"`
 
 	// Metrics is a slice of Metrics that belong to the MetricType family.
 	Metrics []*MetricType `yaml:"metrics"`
@@ -75,129 +211,18 @@ type FamilyType struct {
 	// Resolver is the resolver to use to evaluate the labelset expressions.
 	Resolver ResolverType `yaml:"resolver"`
 
-	// LabelKeys is the set of inherited or defined label keys.
+	// LabelKeys is the set of label keys, inherited by all metrics of the family.
 	LabelKeys []string `yaml:"labelKeys,omitempty"`
 
-	// LabelValues is the set of inherited or defined label values.
+	// LabelValues is the set of label values, inherited by all metrics of the family.
 	LabelValues []string `yaml:"labelValues,omitempty"`
-}
 
-// rawFrom returns the given family in its byte representation.
-func (f *FamilyType) rawFrom(unstructured *unstructured.Unstructured) string {
-	logger := f.logger.WithValues("family", f.Name)
-
-	familyRawBuilder := strings.Builder{}
-	for _, metric := range f.Metrics {
-		metricRawBuilder := strings.Builder{}
-
-		// Inherit the label keys and values.
-		metric.LabelKeys = append(metric.LabelKeys, f.LabelKeys...)
-		metric.LabelValues = append(metric.LabelValues, f.LabelValues...)
-
-		// Inherit the resolver.
-		resolverInstance, err := f.resolver(metric.Resolver)
-		if err != nil {
-			logger.V(1).Error(fmt.Errorf("error resolving metric: %w", err), "skipping")
-
-			continue
-		}
-
-		// Resolve the labelset.
-		var (
-			resolvedLabelKeys   []string
-			resolvedLabelValues []string
-		)
-		for i, query := range metric.LabelValues {
-			resolvedLabelset := resolverInstance.Resolve(query, unstructured.Object)
-
-			// If the query is found in the resolved labelset, append the resolved value.
-			if resolvedLabelValue, ok := resolvedLabelset[query]; ok {
-				resolvedLabelValues = append(resolvedLabelValues, resolvedLabelValue)
-
-				// Label keys are not resolved if the returned labelset for the same label key exists.
-				resolvedLabelKeys = append(resolvedLabelKeys, strings.ToLower(regexp.MustCompile(`\W`).
-					ReplaceAllString(metric.LabelKeys[i], "_")))
-
-				// If the query is not found in the resolved labelset, it is now redundant as a label value.
-			} else {
-				for k, v := range resolvedLabelset {
-					resolvedLabelValues = append(resolvedLabelValues, v)
-
-					// Label keys are resolved (with the original label keys being the new label key's prefix) if the
-					// returned labelset for the same label key does not exist.
-					resolvedLabelKeys = append(resolvedLabelKeys, strings.ToLower(regexp.MustCompile(`\W`).
-						ReplaceAllString(metric.LabelKeys[i]+k, "_")))
-				}
-			}
-		}
-
-		// Resolve the metric value.
-		resolvedValue, found := resolverInstance.Resolve(metric.Value, unstructured.Object)[metric.Value]
-		if !found {
-			logger.V(1).Error(fmt.Errorf("error resolving metric value %q", metric.Value), "skipping")
-
-			continue
-		}
-
-		// Write the metric.
-		metricRawBuilder.WriteString(kubeCustomResourcePrefix)
-		metricRawBuilder.WriteString(f.Name)
-		err = writeMetricTo(
-			&metricRawBuilder,
-			unstructured.GroupVersionKind().Group, unstructured.GroupVersionKind().Version, unstructured.GroupVersionKind().Kind,
-			resolvedValue,
-			resolvedLabelKeys, resolvedLabelValues,
-		)
-		if err != nil {
-			logger.V(1).Error(fmt.Errorf("error writing metric: %w", err), "skipping")
-
-			continue
-		}
-
-		familyRawBuilder.WriteString(metricRawBuilder.String())
-	}
+	// OnResolutionFailure is the policy to apply when a query cannot be resolved.
+	OnResolutionFailure ResolutionFailurePolicy `yaml:"onResolutionFailure,omitempty"`
 
-	return familyRawBuilder.String()
-}
-
-func (f *FamilyType) resolver(inheritedResolver ResolverType) (resolver.Resolver, error) {
-	var resolverInstance resolver.Resolver
-	if inheritedResolver == ResolverTypeNone {
-		inheritedResolver = f.Resolver
-	}
-	switch inheritedResolver {
-	case ResolverTypeNone:
-		fallthrough
-	case ResolverTypeCEL:
-		resolverInstance = resolver.NewCELResolver(f.logger)
-	case ResolverTypeUnstructured:
-		resolverInstance = resolver.NewUnstructuredResolver(f.logger)
-	default:
-		return nil, fmt.Errorf("error resolving metric: unknown resolver %q", inheritedResolver)
-	}
-
-	return resolverInstance, nil
-}
+	// DefaultValue is the metric value to use under the ResolutionFailurePolicyDefaultValue policy. It must be numeric.
+	DefaultValue string `yaml:"defaultValue,omitempty"`
 
-// buildHeaders generates the header for the given family.
-func (f *FamilyType) buildHeaders() string {
-	header := strings.Builder{}
-
-	// Write the help text.
-	header.WriteString("# HELP ")
-	header.WriteString(kubeCustomResourcePrefix)
-	header.WriteString(f.Name)
-	header.WriteString(" ")
-	header.WriteString(f.Help)
-	header.WriteString("\n")
-
-	// Write the type text.
-	header.WriteString("# TYPE ")
-	header.WriteString(kubeCustomResourcePrefix)
-	header.WriteString(f.Name)
-	header.WriteString(" ")
-	f.t = metricTypeGauge
-	header.WriteString(f.t)
-
-	return header.String()
+	// DefaultLabelValue is the label value to use under the ResolutionFailurePolicyDefaultValue policy.
+	DefaultLabelValue string `yaml:"defaultLabelValue,omitempty"`
 }
@@ -0,0 +1,319 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+const (
+
+	// familyQueryParameter is the query parameter that narrows down a scrape to the given families.
+	familyQueryParameter = "family"
+
+	// matchQueryParameter is the query parameter that narrows down a scrape to the series matching any of the given
+	// series selectors, as with Prometheus' federation endpoint.
+	matchQueryParameter = "match[]"
+)
+
+// seriesFilter narrows down the families, and series, written out for a scrape. Families are filtered as per their
+// snapshots, and only the series of the remaining families are inspected, if need be.
+type seriesFilter struct {
+
+	// families are the names of the families to write out, either with or without their kind's suffix, or all if empty.
+	families map[string]bool
+
+	// selectors are the series selectors that series must match any of to be written out, or all if empty.
+	selectors [][]*labels.Matcher
+}
+
+// newSeriesFilter returns a filter for the given query. A query without any filters filters nothing.
+func newSeriesFilter(query url.Values) (*seriesFilter, error) {
+	families, selectors := query[familyQueryParameter], query[matchQueryParameter]
+	filter := &seriesFilter{}
+	if len(families) > 0 {
+		filter.families = map[string]bool{}
+		for _, family := range families {
+			filter.families[family] = true
+		}
+	}
+	for _, selector := range selectors {
+		matchers, err := parseSelector(selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s selector %q: %w", matchQueryParameter, selector, err)
+		}
+		filter.selectors = append(filter.selectors, matchers)
+	}
+
+	return filter, nil
+}
+
+// familySelectors returns the selectors that the given family's series may match, based on its name alone, and
+// whether the family should be written out at all.
+func (f *seriesFilter) familySelectors(family *familySnapshot) ([][]*labels.Matcher, bool) {
+	if f.families != nil && !f.families[kubeCustomResourcePrefix+family.name] && !f.families[family.sampleName] {
+		return nil, false
+	}
+	if len(f.selectors) == 0 {
+		return nil, true
+	}
+	var selectors [][]*labels.Matcher
+	for _, matchers := range f.selectors {
+		if matchesName(matchers, family.sampleName) {
+			selectors = append(selectors, matchers)
+		}
+	}
+
+	return selectors, len(selectors) > 0
+}
+
+// matchesName reports whether the given name matches all name matchers in the given matchers.
+func matchesName(matchers []*labels.Matcher, name string) bool {
+	for _, m := range matchers {
+		if m.Name == labels.MetricName && !m.Matches(name) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// onlyMatchNames reports whether all given selectors only match on names, i.e., whether they can be decided without
+// inspecting the series.
+func onlyMatchNames(selectors [][]*labels.Matcher) bool {
+	for _, matchers := range selectors {
+		for _, m := range matchers {
+			if m.Name != labels.MetricName {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// filterSeries returns the series of the given family that match any of the given selectors, which must have been
+// returned by familySelectors, and whether any series were inspected. The given series, and their ends, are either the
+// family's series or its OpenMetrics ones, so created series follow the series they accompany. Series are matched on
+// their protobuf metrics, as with filterMetrics, and only the bytes of the matching ones are copied.
+func filterSeries(family *familySnapshot, selectors [][]*labels.Matcher, series []byte, ends []int) ([]byte, bool) {
+	matching, filtered := matchingSeries(family, selectors)
+	if !filtered {
+		return series, false
+	}
+	var size int
+	for _, i := range matching {
+		size += ends[i] - seriesStart(ends, i)
+	}
+	out := make([]byte, 0, size)
+	for _, i := range matching {
+		out = append(out, series[seriesStart(ends, i):ends[i]]...)
+	}
+
+	return out, true
+}
+
+// seriesStart returns the offset that the series at the given index starts at, given the offsets that all series end
+// at.
+func seriesStart(ends []int, i int) int {
+	if i == 0 {
+		return 0
+	}
+
+	return ends[i-1]
+}
+
+// filterMetrics returns the protobuf metrics of the given family that match any of the given selectors, which must have
+// been returned by familySelectors, and whether any metrics were inspected.
+func filterMetrics(family *familySnapshot, selectors [][]*labels.Matcher) ([]*dto.Metric, bool) {
+	metrics := family.protobufSeries.metrics
+	matching, filtered := matchingSeries(family, selectors)
+	if !filtered {
+		return metrics, false
+	}
+	out := make([]*dto.Metric, 0, len(matching))
+	for _, i := range matching {
+		out = append(out, metrics[i])
+	}
+
+	return out, true
+}
+
+// matchingSeries returns the indices of the protobuf metrics of the given family that match any of the given
+// selectors, which must have been returned by familySelectors, and whether any metrics were inspected.
+func matchingSeries(family *familySnapshot, selectors [][]*labels.Matcher) ([]int, bool) {
+	if onlyMatchNames(selectors) {
+		return nil, false
+	}
+	metrics := family.protobufSeries.metrics
+	matching := make([]int, 0, len(metrics))
+	builder := labels.NewScratchBuilder(0)
+	for i, metric := range metrics {
+		builder.Reset()
+		builder.Add(labels.MetricName, family.sampleName)
+		for _, label := range metric.GetLabel() {
+			builder.Add(label.GetName(), label.GetValue())
+		}
+		builder.Sort()
+		lset := builder.Labels()
+		for _, matchers := range selectors {
+			if matchesLabels(matchers, lset) {
+				matching = append(matching, i)
+
+				break
+			}
+		}
+	}
+
+	return matching, true
+}
+
+// matchesLabels reports whether the given labelset matches all given matchers.
+func matchesLabels(matchers []*labels.Matcher, lset labels.Labels) bool {
+	for _, m := range matchers {
+		if !m.Matches(lset.Get(m.Name)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseSelector parses the given series selector, i.e., a metric name, a set of label matchers in braces, or both, as
+// with Prometheus' instant vector selectors without any modifiers. As with Prometheus, at least one matcher must not
+// match the empty string.
+func parseSelector(selector string) ([]*labels.Matcher, error) {
+	rest := strings.TrimSpace(selector)
+	var matchers []*labels.Matcher
+	if name := rest[:nameLength(rest, true)]; name != "" {
+		matchers = append(matchers, labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, name))
+		rest = strings.TrimSpace(rest[len(name):])
+	}
+	if rest != "" {
+		if rest[0] != '{' || rest[len(rest)-1] != '}' {
+			return nil, errors.New("expected a metric name, a set of label matchers in braces, or both")
+		}
+		rest = strings.TrimSpace(rest[1 : len(rest)-1])
+		for rest != "" {
+			var m *labels.Matcher
+			var err error
+			m, rest, err = parseMatcher(rest)
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, m)
+			if rest != "" {
+				if rest[0] != ',' {
+					return nil, fmt.Errorf("expected a comma after matcher %s", m)
+				}
+				rest = strings.TrimSpace(rest[1:])
+			}
+		}
+	}
+	for _, m := range matchers {
+		if !m.Matches("") {
+			return matchers, nil
+		}
+	}
+
+	return nil, errors.New("expected at least one matcher that does not match the empty string")
+}
+
+// parseMatcher parses the label matcher that the given string starts with, and returns it along with the remainder of
+// the string, without any leading whitespace.
+func parseMatcher(s string) (*labels.Matcher, string, error) {
+	name := s[:nameLength(s, false)]
+	if name == "" {
+		return nil, "", fmt.Errorf("expected a label name at %q", s)
+	}
+	s = strings.TrimSpace(s[len(name):])
+	var matchType labels.MatchType
+	switch {
+	case strings.HasPrefix(s, "=~"):
+		matchType = labels.MatchRegexp
+	case strings.HasPrefix(s, "!~"):
+		matchType = labels.MatchNotRegexp
+	case strings.HasPrefix(s, "!="):
+		matchType = labels.MatchNotEqual
+	case strings.HasPrefix(s, "="):
+		matchType = labels.MatchEqual
+	default:
+		return nil, "", fmt.Errorf("expected a match operator after label %q", name)
+	}
+	s = strings.TrimSpace(s[len(matchType.String()):])
+	value, s, err := parseQuoted(s)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid value for label %q: %w", name, err)
+	}
+	m, err := labels.NewMatcher(matchType, name, value)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid matcher for label %q: %w", name, err)
+	}
+
+	return m, strings.TrimSpace(s), nil
+}
+
+// parseQuoted parses the double-quoted, single-quoted, or raw string that the given string starts with, and returns it
+// unquoted, along with the remainder of the string.
+func parseQuoted(s string) (string, string, error) {
+	if s == "" || !strings.ContainsRune("\"'`", rune(s[0])) {
+		return "", "", fmt.Errorf("expected a quoted string at %q", s)
+	}
+	quote := s[0]
+	end := 1
+	for ; end < len(s) && s[end] != quote; end++ {
+		if s[end] == '\\' && quote != '`' {
+			end++
+		}
+	}
+	if end >= len(s) {
+		return "", "", fmt.Errorf("unterminated string %q", s)
+	}
+	quoted := s[:end+1]
+
+	// Single-quoted strings are unquoted as double-quoted ones, since Go reserves single quotes for runes.
+	if quote == '\'' {
+		quoted = `"` + strings.NewReplacer(`\\`, `\\`, `\"`, `\"`, `\'`, `'`, `"`, `\"`).Replace(quoted[1:end]) + `"`
+	}
+	unquoted, err := strconv.Unquote(quoted)
+	if err != nil {
+		return "", "", fmt.Errorf("malformed string %s: %w", s[:end+1], err)
+	}
+
+	return unquoted, s[end+1:], nil
+}
+
+// nameLength returns the length of the metric name, if metric is set, or the label name, that the given string starts
+// with.
+func nameLength(s string, metric bool) int {
+	for i, c := range s {
+		if c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9' || metric && c == ':' {
+			continue
+		}
+
+		return i
+	}
+
+	return len(s)
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSeriesFilter(t *testing.T) {
+	t.Parallel()
+
+	stores := []*StoreType{
+		newTestStore(t, []*FamilyType{newTestFamily("foo_replicas", "Replicas")}, newTestObject("a", 1)),
+		newTestStore(t, []*FamilyType{newTestFamily("foo_other", "Other")}, newTestObject("b", 1)),
+		newTestStore(t, []*FamilyType{newTestFamily("foo_replicas", "Replicas")}, newTestObject("c", 1)),
+	}
+	replicasHeader := "# HELP kube_customresource_foo_replicas Replicas\n# TYPE kube_customresource_foo_replicas gauge\n"
+	otherHeader := "# HELP kube_customresource_foo_other Other\n# TYPE kube_customresource_foo_other gauge\n"
+	seriesA := `kube_customresource_foo_replicas{name="a",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1.000000` + "\n"
+	seriesB := `kube_customresource_foo_other{name="b",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1.000000` + "\n"
+	seriesC := `kube_customresource_foo_replicas{name="c",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1.000000` + "\n"
+
+	for _, tc := range []struct {
+		name    string
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "no filters",
+			query: "",
+			want:  replicasHeader + seriesA + seriesC + otherHeader + seriesB,
+		},
+		{
+			name:  "family",
+			query: "family=kube_customresource_foo_other",
+			want:  otherHeader + seriesB,
+		},
+		{
+			name:  "unknown family",
+			query: "family=foo_other",
+			want:  "",
+		},
+		{
+			name:  "name selector",
+			query: "match[]=kube_customresource_foo_replicas",
+			want:  replicasHeader + seriesA + seriesC,
+		},
+		{
+			name:  "label selector",
+			query: `match[]={name=~"a|b"}`,
+			want:  replicasHeader + seriesA + otherHeader + seriesB,
+		},
+		{
+			name:  "selectors and family",
+			query: `family=kube_customresource_foo_replicas&match[]={name="c"}&match[]=kube_customresource_foo_other`,
+			want:  replicasHeader + seriesC,
+		},
+		{
+			name:    "invalid selector",
+			query:   `match[]={name=}`,
+			wantErr: true,
+		},
+	} {
+		query, err := url.ParseQuery(tc.query)
+		if err != nil {
+			t.Fatalf("%s: failed to parse query: %v", tc.name, err)
+		}
+		filter, err := newSeriesFilter(query)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("%s: got error %v, want error %t", tc.name, err, tc.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		out := &strings.Builder{}
+		if err = newFilteredMetricsWriter(filter, stores...).writeAllTo(out); err != nil {
+			t.Fatalf("%s: failed to write metrics: %v", tc.name, err)
+		}
+		if got := out.String(); got != tc.want {
+			t.Errorf("%s: got metrics:\n%s\nwant:\n%s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		selector string
+		want     string
+		wantErr  bool
+	}{
+		{selector: "foo_bar:baz", want: `__name__="foo_bar:baz"`},
+		{selector: `{a!=""}`, want: `a!=""`},
+		{
+			selector: " foo { a = \"x\\\"y\" , b!~'c\\'d\"', c=~`a.*\\.`, } ",
+			want:     `__name__="foo",a="x\"y",b!~"c'd\"",c=~"a.*\\."`,
+		},
+		{selector: "", wantErr: true},
+		{selector: `{a=""}`, wantErr: true},
+		{selector: `{a=}`, wantErr: true},
+		{selector: `{a="x}`, wantErr: true},
+		{selector: `foo{a="x"`, wantErr: true},
+		{selector: `foo bar`, wantErr: true},
+		{selector: `{a="x" b="y"}`, wantErr: true},
+		{selector: `{a=~"("}`, wantErr: true},
+		{selector: `{1a="x"}`, wantErr: true},
+	} {
+		matchers, err := parseSelector(tc.selector)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("%q: got error %v, want error %t", tc.selector, err, tc.wantErr)
+		}
+		got := make([]string, 0, len(matchers))
+		for _, m := range matchers {
+			got = append(got, m.String())
+		}
+		if !tc.wantErr && strings.Join(got, ",") != tc.want {
+			t.Fatalf("%q: got matchers %s, want %s", tc.selector, strings.Join(got, ","), tc.want)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+// workqueueStallGrace is the time, beyond the longest wait of any single phase of processing a work item, that a work
+// item may go without progress for, or that queued items may wait for a worker, before the workqueue is considered
+// stalled.
+const workqueueStallGrace = time.Minute
+
+// workqueueStallTimeout returns the time after which the workqueue is considered stalled, given the store sync timeout.
+// Work items report progress after each phase, so this only needs to outlast the longest one, i.e., either polling to
+// update the metadata, or waiting for the stores to sync, along with the API calls that follow either.
+func workqueueStallTimeout(storeSyncTimeout time.Duration) time.Duration {
+	return max(storeSyncTimeout, metadataUpdateTimeout) + workqueueStallGrace
+}
+
+// healthCheck is a named check of the controller's state, run by probes.
+type healthCheck struct {
+
+	// name is the name of the check, as reported by probes.
+	name string
+
+	// check returns an error if the check fails.
+	check func() error
+}
+
+// controllerHealth tracks the controller's state that health checks are run against.
+type controllerHealth struct {
+
+	// informersSynced reports whether the managed resources' informer has synced.
+	informersSynced cache.InformerSynced
+
+	// queueLen returns the number of items waiting in the workqueue.
+	queueLen func() int
+
+	// stallTimeout is the time after which the workqueue is considered stalled.
+	stallTimeout time.Duration
+
+	// mutex guards the fields below.
+	mutex sync.Mutex
+
+	// unreconciled are the keys of the managed resources that were present on startup, and are yet to be processed.
+	unreconciled map[string]bool
+
+	// lastStarted is the time that a worker last started processing an item.
+	lastStarted time.Time
+
+	// processing are the times that the items being processed last made progress at, by their identifiers.
+	processing map[uint64]time.Time
+
+	// nextItem is the identifier handed out to the next item that is processed.
+	nextItem uint64
+
+	// serving reports whether each server is serving, by source.
+	serving map[string]bool
+}
+
+// newControllerHealth returns a new controllerHealth, for the given servers, none of which are serving yet.
+func newControllerHealth(
+	informersSynced cache.InformerSynced,
+	queueLen func() int,
+	stallTimeout time.Duration,
+	servers ...string,
+) *controllerHealth {
+	h := &controllerHealth{
+		informersSynced: informersSynced,
+		queueLen:        queueLen,
+		stallTimeout:    stallTimeout,
+		unreconciled:    map[string]bool{},
+		lastStarted:     time.Now(),
+		processing:      map[uint64]time.Time{},
+		serving:         map[string]bool{},
+	}
+	for _, server := range servers {
+		h.serving[server] = false
+	}
+
+	return h
+}
+
+// expectReconciled marks the managed resources with the given keys as ones that must be processed before the
+// controller is ready.
+func (h *controllerHealth) expectReconciled(keys ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, key := range keys {
+		h.unreconciled[key] = true
+	}
+}
+
+// startProcessing records that a worker started processing an item, and returns the item's identifier.
+func (h *controllerHealth) startProcessing() uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	item := h.nextItem
+	h.nextItem++
+	h.lastStarted = time.Now()
+	h.processing[item] = h.lastStarted
+
+	return item
+}
+
+// progress records that the item with the given identifier made progress, i.e., that it finished a phase of its
+// processing.
+func (h *controllerHealth) progress(item uint64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if _, ok := h.processing[item]; ok {
+		h.processing[item] = time.Now()
+	}
+}
+
+// progressKey is the context key for the item being processed, whose progress is reported under the context.
+type progressKey struct{}
+
+// processingItem is an item being processed, along with the health tracker it reports progress to.
+type processingItem struct {
+	health *controllerHealth
+	item   uint64
+}
+
+// withProgress returns a context that reports progress on the item with the given identifier to the given tracker.
+func withProgress(ctx context.Context, h *controllerHealth, item uint64) context.Context {
+	return context.WithValue(ctx, progressKey{}, processingItem{health: h, item: item})
+}
+
+// reportProgress reports progress on the item being processed under the given context, if any.
+func reportProgress(ctx context.Context) {
+	if p, ok := ctx.Value(progressKey{}).(processingItem); ok {
+		p.health.progress(p.item)
+	}
+}
+
+// finishProcessing records that the item with the given identifier, of the managed resource with the given key, was
+// processed, and whether the resource is done with, i.e., that the item will not be retried.
+func (h *controllerHealth) finishProcessing(item uint64, key string, done bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	delete(h.processing, item)
+	if done {
+		delete(h.unreconciled, key)
+	}
+}
+
+// setServing records whether the server with the given source is serving.
+func (h *controllerHealth) setServing(source string, serving bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.serving[source] = serving
+}
+
+// livenessChecks returns the checks that fail if the controller needs to be restarted.
+func (h *controllerHealth) livenessChecks() []healthCheck {
+	return []healthCheck{
+		{name: "workqueue", check: h.checkWorkqueue},
+		{name: "servers", check: h.checkServers},
+	}
+}
+
+// readinessChecks returns the checks that fail if the controller is not ready to be scraped.
+func (h *controllerHealth) readinessChecks() []healthCheck {
+	return []healthCheck{
+		{name: "informers", check: h.checkInformers},
+		{name: "stores", check: h.checkStores},
+		{name: "servers", check: h.checkServers},
+	}
+}
+
+// checks returns all checks.
+func (h *controllerHealth) checks() []healthCheck {
+	return []healthCheck{
+		{name: "informers", check: h.checkInformers},
+		{name: "stores", check: h.checkStores},
+		{name: "workqueue", check: h.checkWorkqueue},
+		{name: "servers", check: h.checkServers},
+	}
+}
+
+// checkInformers fails if the managed resources' informer has not synced.
+func (h *controllerHealth) checkInformers() error {
+	if !h.informersSynced() {
+		return errors.New("managed resources' informer has not synced")
+	}
+
+	return nil
+}
+
+// checkStores fails if any of the managed resources present on startup are yet to be processed. Stores are only served
+// once synced, so this covers the initial sync of their stores, whereas later rebuilds keep serving the existing stores
+// until the new ones have synced.
+func (h *controllerHealth) checkStores() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if unreconciled := len(h.unreconciled); unreconciled > 0 {
+		return fmt.Errorf("%d managed resource(s) present on startup have not been processed", unreconciled)
+	}
+
+	return nil
+}
+
+// checkWorkqueue fails if a worker has been processing an item without progress for longer than the stall timeout, or
+// if queued items have not been picked up by any worker within it.
+func (h *controllerHealth) checkWorkqueue() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := time.Now()
+	for _, started := range h.processing {
+		if elapsed := now.Sub(started); elapsed > h.stallTimeout {
+			return fmt.Errorf("a worker has been processing an item without progress for %s", elapsed.Round(time.Second))
+		}
+	}
+	if queued := h.queueLen(); queued > 0 {
+		if elapsed := now.Sub(h.lastStarted); elapsed > h.stallTimeout {
+			return fmt.Errorf("%d item(s) queued, but none processed for %s", queued, elapsed.Round(time.Second))
+		}
+	}
+
+	return nil
+}
+
+// checkServers fails if any of the servers is not serving.
+func (h *controllerHealth) checkServers() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var notServing []string
+	for source, serving := range h.serving {
+		if !serving {
+			notServing = append(notServing, source)
+		}
+	}
+	if len(notServing) > 0 {
+		slices.Sort(notServing)
+
+		return fmt.Errorf("not serving: %v", notServing)
+	}
+
+	return nil
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// newTestControllerHealth returns a controllerHealth with synced informers, an empty workqueue, and all servers serving.
+func newTestControllerHealth() *controllerHealth {
+	h := newControllerHealth(func() bool { return true }, func() int { return 0 }, time.Minute, "self", "main")
+	h.setServing("self", true)
+	h.setServing("main", true)
+
+	return h
+}
+
+func TestControllerHealthChecks(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name      string
+		mutate    func(h *controllerHealth, queued *int)
+		wantCheck string
+		wantErr   string
+	}{
+		{
+			name: "healthy",
+		},
+		{
+			name: "informers not synced",
+			mutate: func(h *controllerHealth, _ *int) {
+				h.informersSynced = func() bool { return false }
+			},
+			wantCheck: "informers",
+			wantErr:   "informer has not synced",
+		},
+		{
+			name: "resources not reconciled",
+			mutate: func(h *controllerHealth, _ *int) {
+				h.expectReconciled("default/foo", "default/bar")
+				item := h.startProcessing()
+				h.finishProcessing(item, "default/foo", true)
+				item = h.startProcessing()
+				h.finishProcessing(item, "default/bar", false)
+			},
+			wantCheck: "stores",
+			wantErr:   "1 managed resource(s)",
+		},
+		{
+			name: "item processed without progress for too long",
+			mutate: func(h *controllerHealth, _ *int) {
+				h.startProcessing()
+				h.stallTimeout = 0
+			},
+			wantCheck: "workqueue",
+			wantErr:   "a worker has been processing an item without progress",
+		},
+		{
+			name: "item processed for long, with progress",
+			mutate: func(h *controllerHealth, _ *int) {
+				item := h.startProcessing()
+				h.processing[item] = time.Now().Add(-2 * time.Minute)
+				reportProgress(withProgress(context.Background(), h, item))
+			},
+		},
+		{
+			name: "queued items not picked up",
+			mutate: func(h *controllerHealth, queued *int) {
+				*queued = 2
+				h.lastStarted = time.Now().Add(-2 * time.Minute)
+			},
+			wantCheck: "workqueue",
+			wantErr:   "2 item(s) queued",
+		},
+		{
+			name: "server not serving",
+			mutate: func(h *controllerHealth, _ *int) {
+				h.setServing("main", false)
+			},
+			wantCheck: "servers",
+			wantErr:   "not serving: [main]",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			h := newTestControllerHealth()
+			queued := 0
+			h.queueLen = func() int { return queued }
+			if tc.mutate != nil {
+				tc.mutate(h, &queued)
+			}
+			for _, c := range h.checks() {
+				err := c.check()
+				if c.name != tc.wantCheck {
+					if err != nil {
+						t.Fatalf("got %s check error %v, want none", c.name, err)
+					}
+
+					continue
+				}
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got %s check error %v, want one containing %q", c.name, err, tc.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestGenericProbe(t *testing.T) {
+	t.Parallel()
+
+	h := newTestControllerHealth()
+	h.expectReconciled("default/foo")
+	handler := newReadyz("self").probe(klog.Background(), h)
+	get := func(query string) (int, string) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz"+query, http.NoBody))
+		body, err := io.ReadAll(recorder.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return recorder.Code, string(body)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "failing",
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   "[+]informers ok\n[-]stores failed: reason withheld\n[+]servers ok\nreadyz check failed\n",
+		},
+		{
+			name:       "failing, verbose",
+			query:      "?verbose",
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody: "[+]informers ok\n" +
+				"[-]stores failed: 1 managed resource(s) present on startup have not been processed\n" +
+				"[+]servers ok\n" +
+				"readyz check failed\n",
+		},
+	} {
+		if status, body := get(tc.query); status != tc.wantStatus || body != tc.wantBody {
+			t.Fatalf("%s: got %d %q, want %d %q", tc.name, status, body, tc.wantStatus, tc.wantBody)
+		}
+	}
+
+	// Passing probes are terse, unless verbose.
+	h.finishProcessing(h.startProcessing(), "default/foo", true)
+	if status, body := get(""); status != http.StatusOK || body != "ok" {
+		t.Fatalf("got %d %q, want %d %q", status, body, http.StatusOK, "ok")
+	}
+	want := "[+]informers ok\n[+]stores ok\n[+]servers ok\nreadyz check passed\n"
+	if status, body := get("?verbose=true"); status != http.StatusOK || body != want {
+		t.Fatalf("got %d %q, want %d %q", status, body, http.StatusOK, want)
+	}
+}
@@ -0,0 +1,257 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// resourceVersionLatestBestEffort is the resource version that lists ask for under tryNoCache.
+const resourceVersionLatestBestEffort = "0"
+
+// sharedInformer is an informer shared by all stores with the same identity.
+type sharedInformer struct {
+
+	// informer is the underlying informer.
+	informer cache.SharedIndexInformer
+
+	// refs is the number of stores subscribed to the informer.
+	refs int
+
+	// cancel stops the informer.
+	cancel context.CancelFunc
+
+	// done is closed once the informer has stopped.
+	done chan struct{}
+}
+
+// informerPool hands out reference-counted informers, one per store identity, so that the load on the API server scales
+// with the number of distinct watches rather than with the number of stores.
+type informerPool struct {
+
+	// ctx is the context that all informers are bound to.
+	ctx context.Context //nolint:containedctx
+
+	// dynamicClientset is the dynamic clientset used to list and watch objects.
+	dynamicClientset dynamic.Interface
+
+	// metadataClientset is the metadata clientset used to list and watch objects, for stores that only read metadata.
+	metadataClientset metadata.Interface
+
+	// tryNoCache forces the API server to [GET/LIST] the most recent versions.
+	tryNoCache bool
+
+	// liveReflectors is the gauge tracking the number of running reflectors, one per informer.
+	liveReflectors prometheus.Gauge
+
+	// mutex guards informers.
+	mutex sync.Mutex
+
+	// informers are the running informers, indexed by identity.
+	informers map[storeIdentity]*sharedInformer
+}
+
+// newInformerPool returns a new, empty informerPool.
+func newInformerPool(
+	ctx context.Context,
+	dynamicClientset dynamic.Interface,
+	metadataClientset metadata.Interface,
+	tryNoCache bool,
+	liveReflectors prometheus.Gauge,
+) *informerPool {
+	return &informerPool{
+		ctx:               ctx,
+		dynamicClientset:  dynamicClientset,
+		metadataClientset: metadataClientset,
+		tryNoCache:        tryNoCache,
+		liveReflectors:    liveReflectors,
+		informers:         map[storeIdentity]*sharedInformer{},
+	}
+}
+
+// subscribe fans out the events of the informer for the store's identity to the store, starting the informer if needed.
+// Stores attaching to an already running informer receive the existing objects first, and read objects from the
+// informer's cache afterwards, instead of keeping copies of their own. The store is unsubscribed when stopped.
+func (p *informerPool) subscribe(s *StoreType) error {
+	shared := p.acquire(s.identity)
+	s.mutex.Lock()
+	s.objects = shared.informer.GetStore()
+	s.sharedObjects = true
+	s.mutex.Unlock()
+	registration, err := shared.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(objectI interface{}) {
+			if err := s.Add(objectI); err != nil {
+				s.logger.V(1).Error(err, "error handling add event")
+			}
+		},
+		UpdateFunc: func(oldObjectI, objectI interface{}) {
+			if err := s.update(oldObjectI, objectI); err != nil {
+				s.logger.V(1).Error(err, "error handling update event")
+			}
+		},
+		DeleteFunc: func(objectI interface{}) {
+			if err := s.Delete(objectI); err != nil {
+				s.logger.V(1).Error(err, "error handling delete event")
+			}
+		},
+	})
+	if err != nil {
+		p.release(s.identity)
+
+		return fmt.Errorf("error subscribing to informer: %w", err)
+	}
+	s.hasSynced = registration.HasSynced
+	s.detach = func() {
+		if err := shared.informer.RemoveEventHandler(registration); err != nil {
+			s.logger.V(1).Error(err, "error unsubscribing from informer")
+		}
+		p.release(s.identity)
+	}
+
+	return nil
+}
+
+// acquire returns the informer for the given identity, creating and starting it if needed, and takes a reference on it.
+func (p *informerPool) acquire(identity storeIdentity) *sharedInformer {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	shared, ok := p.informers[identity]
+	if !ok {
+		shared = p.start(identity)
+		p.informers[identity] = shared
+	}
+	shared.refs++
+
+	return shared
+}
+
+// release drops a reference on the informer for the given identity. The last reference stops the informer, and blocks
+// until it has returned, i.e., until its in-flight list or watch calls have been drained.
+func (p *informerPool) release(identity storeIdentity) {
+	p.mutex.Lock()
+	shared, ok := p.informers[identity]
+	if !ok {
+		p.mutex.Unlock()
+
+		return
+	}
+	shared.refs--
+	if shared.refs > 0 {
+		p.mutex.Unlock()
+
+		return
+	}
+	delete(p.informers, identity)
+	p.mutex.Unlock()
+
+	shared.cancel()
+	<-shared.done
+}
+
+// start creates and starts an informer for the given identity.
+func (p *informerPool) start(identity storeIdentity) *sharedInformer {
+	logger := klog.FromContext(p.ctx)
+	ctx, cancel := context.WithCancel(p.ctx)
+	gvr := identity.GroupVersionResource
+
+	// Honour the reflector's options (resource versions, pagination, timeouts, bookmarks), so that watches resume from
+	// the listed resource version instead of replaying the complete state of the collection.
+	withSelectors := func(options metav1.ListOptions) metav1.ListOptions {
+		options.LabelSelector = identity.labelSelector
+		options.FieldSelector = identity.fieldSelector
+
+		return options
+	}
+	listerwatcher := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options = withSelectors(options)
+
+			// Ask for the most recent versions on a best-effort basis, if asked to bypass the cache.
+			if p.tryNoCache && options.Continue == "" {
+				options.ResourceVersionMatch = metav1.ResourceVersionMatchNotOlderThan
+				options.ResourceVersion = resourceVersionLatestBestEffort
+			}
+			var o runtime.Object
+			var err error
+			if identity.metadataOnly {
+				o, err = p.metadataClientset.Resource(gvr).List(ctx, options)
+			} else {
+				o, err = p.dynamicClientset.Resource(gvr).List(ctx, options)
+			}
+			if err != nil {
+				err = fmt.Errorf("error listing %s with options %v: %w", gvr.String(), options, err)
+			}
+
+			return o, err
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options = withSelectors(options)
+			var o watch.Interface
+			var err error
+			if identity.metadataOnly {
+				o, err = p.metadataClientset.Resource(gvr).Watch(ctx, options)
+			} else {
+				o, err = p.dynamicClientset.Resource(gvr).Watch(ctx, options)
+			}
+			if err != nil {
+				err = fmt.Errorf("error watching %s with options %v: %w", gvr.String(), options, err)
+			}
+
+			return o, err
+		},
+	}
+
+	// Create and start the informer. Metadata-only informers receive PartialObjectMetadata objects, that only hold the
+	// object's metadata, instead of the whole object.
+	var exampleObject runtime.Object = &metav1.PartialObjectMetadata{}
+	if !identity.metadataOnly {
+		wrapper := &unstructured.Unstructured{}
+		wrapper.SetGroupVersionKind(identity.GroupVersionKind)
+		exampleObject = wrapper
+	}
+	informer := cache.NewSharedIndexInformerWithOptions(listerwatcher, exampleObject, cache.SharedIndexInformerOptions{
+		ObjectDescription: fmt.Sprintf("%#q", gvr.String()),
+	})
+	shared := &sharedInformer{
+		informer: informer,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	p.liveReflectors.Inc()
+	go func() {
+		defer close(shared.done)
+		defer p.liveReflectors.Dec()
+		informer.Run(ctx.Done())
+		logger.V(1).Info("Stopped informer", "gvr", gvr.String(), "labelSelector", identity.labelSelector,
+			"fieldSelector", identity.fieldSelector, "metadataOnly", identity.metadataOnly)
+	}()
+
+	return shared
+}
@@ -0,0 +1,231 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rexagod/crdmetrics/pkg/resolver"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	metadatafake "k8s.io/client-go/metadata/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/klog/v2"
+)
+
+func TestInformerPoolSharesInformers(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	gvr := schema.GroupVersionResource{Group: "samplecontroller.k8s.io", Version: "v1alpha1", Resource: "foos"}
+	dynamicClientset := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(
+		runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{gvr: "FooList"},
+		newTestObject("foo", 3),
+	)
+	liveReflectors := prometheus.NewGauge(prometheus.GaugeOpts{Name: "live_reflectors"})
+	pool := newInformerPool(ctx, dynamicClientset, nil, false, liveReflectors)
+
+	// Subscribe stores, two of which share an identity.
+	identity := storeIdentity{gvkr: gvkr{GroupVersionResource: gvr}}
+	identity.GroupVersionKind = gvr.GroupVersion().WithKind("Foo")
+	otherIdentity := identity
+	otherIdentity.labelSelector = "tier=a"
+	var stores []*StoreType
+	for _, id := range []storeIdentity{identity, identity, otherIdentity} {
+		s := newTestStore(t, nil)
+		s.identity = id
+		if err := pool.subscribe(s); err != nil {
+			t.Fatalf("failed to subscribe store: %v", err)
+		}
+		stores = append(stores, s)
+	}
+	if got, want := testutil.ToFloat64(liveReflectors), 2.0; got != want {
+		t.Fatalf("got %f live reflectors, want %f", got, want)
+	}
+
+	// All stores sharing the informer receive its objects.
+	syncCtx, syncCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer syncCancel()
+	for i, s := range stores[:2] {
+		if err := s.waitForSync(syncCtx); err != nil {
+			t.Fatalf("store %d failed to sync: %v", i, err)
+		}
+		if _, ok := s.introspectObject(ctx, klog.Background(), "default/foo"); !ok {
+			t.Fatalf("store %d did not receive default/foo", i)
+		}
+	}
+
+	// The informer outlives all but its last subscriber.
+	stores[0].stop()
+	stores[0].stop()
+	if got, want := testutil.ToFloat64(liveReflectors), 2.0; got != want {
+		t.Fatalf("got %f live reflectors after stopping a store, want %f", got, want)
+	}
+	stores[1].stop()
+	stores[2].stop()
+	if got, want := testutil.ToFloat64(liveReflectors), 0.0; got != want {
+		t.Fatalf("got %f live reflectors after stopping all stores, want %f", got, want)
+	}
+}
+
+func TestInformerPoolMetadataOnly(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	gvr := schema.GroupVersionResource{Group: "samplecontroller.k8s.io", Version: "v1alpha1", Resource: "foos"}
+	scheme := runtime.NewScheme()
+	if err := metav1.AddMetaToScheme(scheme); err != nil {
+		t.Fatalf("failed to add meta types to scheme: %v", err)
+	}
+	object := &metav1.PartialObjectMetadata{
+		TypeMeta:   metav1.TypeMeta{APIVersion: gvr.GroupVersion().String(), Kind: "Foo"},
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", Labels: map[string]string{"tier": "a"}},
+	}
+	metadataClientset := metadatafake.NewSimpleMetadataClient(scheme, object)
+	liveReflectors := prometheus.NewGauge(prometheus.GaugeOpts{Name: "live_reflectors"})
+	pool := newInformerPool(ctx, nil, metadataClientset, false, liveReflectors)
+
+	// Subscribe a store that only reads metadata.
+	plan, err := newStorePlan(&StoreType{
+		Group:   gvr.Group,
+		Version: gvr.Version,
+		Kind:    "Foo",
+		Families: []*FamilyType{{
+			Name: "foo_tier",
+			Metrics: []*MetricType{{
+				Resolver:    ResolverTypeCEL,
+				LabelKeys:   []string{"tier"},
+				LabelValues: []string{"o.metadata.labels.tier"},
+				Value:       "1",
+			}},
+		}},
+	}, resolver.Options{Logger: klog.Background()})
+	if err != nil {
+		t.Fatalf("failed to compile plan: %v", err)
+	}
+	if !plan.metadataOnly {
+		t.Fatal("got a plan that reads more than metadata, want a metadata-only one")
+	}
+	s := newStore(ctx, klog.Background(), plan)
+	s.identity = storeIdentity{gvkr: gvkr{GroupVersionResource: gvr}, metadataOnly: plan.metadataOnly}
+	if err = pool.subscribe(s); err != nil {
+		t.Fatalf("failed to subscribe store: %v", err)
+	}
+	defer s.stop()
+
+	syncCtx, syncCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer syncCancel()
+	if err = s.waitForSync(syncCtx); err != nil {
+		t.Fatalf("store failed to sync: %v", err)
+	}
+	out := &strings.Builder{}
+	if err = newMetricsWriter(s).writeAllTo(out); err != nil {
+		t.Fatalf("failed to write metrics: %v", err)
+	}
+	want := `kube_customresource_foo_tier{tier="a",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1`
+	if !strings.Contains(out.String(), want) {
+		t.Fatalf("got metrics:\n%s\nwant them to contain:\n%s", out.String(), want)
+	}
+}
+
+func TestInformerPoolRelistDropsVanishedObjects(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	gvr := schema.GroupVersionResource{Group: "samplecontroller.k8s.io", Version: "v1alpha1", Resource: "foos"}
+	dynamicClientset := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(
+		runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{gvr: "FooList"},
+		newTestObject("foo", 1),
+		newTestObject("bar", 2),
+	)
+
+	// Hand out watches that only deliver what the test sends on them, so that deletions are only seen on relists.
+	watches := make(chan *watch.FakeWatcher, 8)
+	dynamicClientset.PrependWatchReactor("foos", func(clienttesting.Action) (bool, watch.Interface, error) {
+		w := watch.NewFake()
+		watches <- w
+
+		return true, w, nil
+	})
+	pool := newInformerPool(ctx, dynamicClientset, nil, false, prometheus.NewGauge(prometheus.GaugeOpts{Name: "live_reflectors"}))
+	s := newTestStore(t, nil)
+	s.identity = storeIdentity{gvkr: gvkr{GroupVersionResource: gvr}}
+	s.identity.GroupVersionKind = gvr.GroupVersion().WithKind("Foo")
+	if err := pool.subscribe(s); err != nil {
+		t.Fatalf("failed to subscribe store: %v", err)
+	}
+	defer s.stop()
+
+	syncCtx, syncCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer syncCancel()
+	if err := s.waitForSync(syncCtx); err != nil {
+		t.Fatalf("store failed to sync: %v", err)
+	}
+	write := func() string {
+		t.Helper()
+
+		out := &strings.Builder{}
+		if err := newMetricsWriter(s).writeAllTo(out); err != nil {
+			t.Fatalf("failed to write metrics: %v", err)
+		}
+
+		return out.String()
+	}
+	want := `kube_customresource_foo_replicas{name="bar",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 2`
+	if got := write(); !strings.Contains(got, want) {
+		t.Fatalf("got metrics:\n%s\nwant them to contain:\n%s", got, want)
+	}
+
+	// Delete an object while the watch is disconnected, and expire the watch, so that the informer relists, and hands
+	// the vanished object to the store as a cache.DeletedFinalStateUnknown.
+	if err := dynamicClientset.Tracker().Delete(gvr, "default", "bar"); err != nil {
+		t.Fatalf("failed to delete object: %v", err)
+	}
+	select {
+	case w := <-watches:
+		w.Error(&metav1.Status{Status: metav1.StatusFailure, Code: http.StatusGone, Reason: metav1.StatusReasonExpired})
+	case <-syncCtx.Done():
+		t.Fatal("got no watch started")
+	}
+	for strings.Contains(write(), want) {
+		if syncCtx.Err() != nil {
+			t.Fatal("got series for an object that vanished during a relist")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, want := s.ListKeys(), []string{"default/foo"}; !slices.Equal(got, want) {
+		t.Fatalf("got keys %q, want %q", got, want)
+	}
+}
@@ -17,12 +17,16 @@ limitations under the License.
 package internal
 
 import (
+	"bytes"
 	"fmt"
 	"sort"
 	"strconv"
 	"strings"
 )
 
+// labelValueEscaper escapes label values for exposition.
+var labelValueEscaper = strings.NewReplacer("\\", `\\`, "\n", `\n`, "\"", `\"`)
+
 // MetricType represents a single time series.
 type MetricType struct {
 
@@ -37,10 +41,19 @@ type MetricType struct {
 
 	// Resolver is the resolver to use to evaluate the labelset expressions.
 	Resolver ResolverType `yaml:"resolver"`
+
+	// OnResolutionFailure is the policy to apply when a query cannot be resolved.
+	OnResolutionFailure ResolutionFailurePolicy `yaml:"onResolutionFailure,omitempty"`
+
+	// DefaultValue is the metric value to use under the ResolutionFailurePolicyDefaultValue policy. It must be numeric.
+	DefaultValue string `yaml:"defaultValue,omitempty"`
+
+	// DefaultLabelValue is the label value to use under the ResolutionFailurePolicyDefaultValue policy.
+	DefaultLabelValue string `yaml:"defaultLabelValue,omitempty"`
 }
 
-// writeMetricTo writes the given metric to the given strings.Builder.
-func writeMetricTo(writer *strings.Builder, g, v, k, resolvedValue string, resolvedLabelKeys, resolvedLabelValues []string) error {
+// writeMetricTo writes the given metric to the given buffer.
+func writeMetricTo(writer *bytes.Buffer, g, v, k, resolvedValue string, resolvedLabelKeys, resolvedLabelValues []string) error {
 	if len(resolvedLabelKeys) != len(resolvedLabelValues) {
 		return fmt.Errorf(
 			"expected labelKeys %q to be of same length (%d) as the resolved labelValues %q (%d)",
@@ -62,7 +75,7 @@ func writeMetricTo(writer *strings.Builder, g, v, k, resolvedValue string, resol
 			writer.WriteString(separator)
 			writer.WriteString(resolvedLabelKeys[i])
 			writer.WriteString("=\"")
-			n, err := strings.NewReplacer("\\", `\\`, "\n", `\n`, "\"", `\"`).WriteString(writer, resolvedLabelValues[i])
+			n, err := labelValueEscaper.WriteString(writer, resolvedLabelValues[i])
 			if err != nil {
 				return fmt.Errorf("error writing metric after %d bytes: %w", n, err)
 			}
@@ -21,23 +21,52 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/rexagod/crdmetrics/pkg/resolver"
 	"k8s.io/klog/v2"
 )
 
 // Options represents the command-line Options.
 type Options struct {
-	AutoGOMAXPROCS  *bool
-	RatioGOMEMLIMIT *float64
-	Kubeconfig      *string
-	MasterURL       *string
-	SelfHost        *string
-	SelfPort        *int
-	MainHost        *string
-	MainPort        *int
-	TryNoCache      *bool
-	Workers         *int
-	Version         *bool
+	AutoGOMAXPROCS        *bool
+	RatioGOMEMLIMIT       *float64
+	Kubeconfig            *string
+	MasterURL             *string
+	SelfHost              *string
+	SelfPort              *int
+	MainHost              *string
+	MainPort              *int
+	MainZstd              *bool
+	TryNoCache            *bool
+	Workers               *int
+	Version               *bool
+	CELCostLimit          *uint64
+	CELEvaluationTimeout  *time.Duration
+	StoreSyncTimeout      *time.Duration
+	StoreSnapshotDebounce *time.Duration
+	Shard                 *int
+	TotalShards           *int
+	AutoShard             *bool
+	Pod                   *string
+	PodNamespace          *string
+	RemoteWriteURL        *string
+	RemoteWriteInterval   *time.Duration
+	RemoteWriteBatchSize  *int
+	RemoteWriteMaxRetries *int
+	RemoteWriteMinBackoff *time.Duration
+	RemoteWriteMaxBackoff *time.Duration
+	OTLPEndpoint          *string
+	OTLPProtocol          *string
+	OTLPInterval          *time.Duration
+	OTLPInsecure          *bool
+	SelfTLSCertFile       *string
+	SelfTLSKeyFile        *string
+	SelfAuthPaths         *string
+	SelfIntrospection     *bool
+	MainTLSCertFile       *string
+	MainTLSKeyFile        *string
+	MainAuthPaths         *string
 
 	logger klog.Logger
 }
@@ -61,9 +90,36 @@ func (o *Options) Read() {
 	o.SelfPort = flag.Int("self-port", 9998, "Port to expose self (telemetry) metrics on.")
 	o.MainHost = flag.String("main-host", "::", "Host to expose main metrics on.")
 	o.MainPort = flag.Int("main-port", 9999, "Port to expose main metrics on.")
+	o.MainZstd = flag.Bool("main-zstd", false, "Compress main metrics with zstd, in addition to gzip, for clients that accept it. zstd is preferred over gzip if the client accepts both equally.")
 	o.TryNoCache = flag.Bool("try-no-cache", false, "Force the API server to [GET/LIST] the most recent versions.")
 	o.Workers = flag.Int("workers", 2, "Number of workers processing the queue.")
 	o.Version = flag.Bool("version", false, "Print version information and quit")
+	o.CELCostLimit = flag.Uint64("cel-cost-limit", resolver.DefaultCostLimit, "Maximum runtime cost of a single CEL evaluation. Expressions whose estimated worst-case cost exceeds this are rejected, and evaluations that exceed it, over objects larger than estimated, fail. Can be overridden per resource.")
+	o.CELEvaluationTimeout = flag.Duration("cel-evaluation-timeout", 0, "Maximum wall-clock time of a single CEL evaluation, 0 to disable. Can be overridden per resource.")
+	o.StoreSyncTimeout = flag.Duration("store-sync-timeout", time.Minute, "Maximum time for the stores built from an updated configuration to sync, before which the previous stores keep serving. The update is reported as failed if exceeded.")
+	o.StoreSnapshotDebounce = flag.Duration("store-snapshot-debounce", 0, "Interval that stores coalesce their mutations within, before publishing a new snapshot for scrapes to read. Snapshots are published by the first scrape after a mutation if set to 0, which keeps scrapes up-to-date while only rebuilding the changed families once per scrape.")
+	o.Shard = flag.Int("shard", 0, "The shard (0-indexed) of objects this replica renders, by a hash of their UID. Ignored under automatic sharding.")
+	o.TotalShards = flag.Int("total-shards", 1, "The total number of shards. Sharding is disabled if set to 1. Ignored under automatic sharding.")
+	o.AutoShard = flag.Bool("auto-shard", false, "Derive the shard from the ordinal of the StatefulSet pod this replica runs as, and the total number of shards from the StatefulSet's replicas. Requires the pod name and namespace.")
+	o.Pod = flag.String("pod", os.Getenv("POD_NAME"), "Name of the pod this replica runs as. Only required for automatic sharding.")
+	o.PodNamespace = flag.String("pod-namespace", os.Getenv("POD_NAMESPACE"), "Namespace of the pod this replica runs as. Only required for automatic sharding.")
+	o.RemoteWriteURL = flag.String("remote-write-url", "", "URL of a Prometheus remote-write endpoint to periodically push the metrics of all stores to. Pushing is disabled if empty.")
+	o.RemoteWriteInterval = flag.Duration("remote-write-interval", 30*time.Second, "Interval to push the metrics of all stores to the remote-write endpoint at. Each push times out after the interval.")
+	o.RemoteWriteBatchSize = flag.Int("remote-write-batch-size", 2000, "Maximum number of samples to send in a single remote-write request.")
+	o.RemoteWriteMaxRetries = flag.Int("remote-write-max-retries", 3, "Maximum number of times to retry a remote-write request that failed with a network error, a 429, or a 5xx response, before its samples are dropped.")
+	o.RemoteWriteMinBackoff = flag.Duration("remote-write-min-backoff", 30*time.Millisecond, "Initial backoff before retrying a remote-write request, doubled with each retry.")
+	o.RemoteWriteMaxBackoff = flag.Duration("remote-write-max-backoff", 5*time.Second, "Maximum backoff before retrying a remote-write request.")
+	o.OTLPEndpoint = flag.String("otlp-endpoint", "", "OTLP endpoint to periodically export the series of all stores to, as host:port for gRPC, or as a URL for HTTP (for e.g., http://collector:4318/v1/metrics). Exporting is disabled if empty.")
+	o.OTLPProtocol = flag.String("otlp-protocol", "grpc", "Transport to export over OTLP with, either grpc or http/protobuf.")
+	o.OTLPInterval = flag.Duration("otlp-interval", time.Minute, "Interval to export the series of all stores to the OTLP endpoint at. Each export times out after the interval.")
+	o.OTLPInsecure = flag.Bool("otlp-insecure", false, "Export over plaintext gRPC, instead of TLS. Ignored for HTTP, where the URL's scheme decides.")
+	o.SelfTLSCertFile = flag.String("self-tls-cert-file", "", "Path to a PEM-encoded certificate to serve self (telemetry) metrics over TLS with. Reloaded when changed. Requires the key file.")
+	o.SelfTLSKeyFile = flag.String("self-tls-key-file", "", "Path to the PEM-encoded private key of the self (telemetry) server's certificate.")
+	o.SelfAuthPaths = flag.String("self-auth-paths", "", "Comma-separated paths on the self (telemetry) server that require a bearer token, authenticated through a TokenReview, and authorized through a SubjectAccessReview for the path and the request's verb. Each path covers all paths under it (for e.g., /debug covers /debug/pprof/heap). Consider setting a TLS certificate, as bearer tokens are otherwise sent in plaintext.")
+	o.SelfIntrospection = flag.Bool("self-introspection", false, "Serve /debug/stores and /debug/series on the self (telemetry) server. These expose the configuration of every resource's stores, and the series of any object, so consider covering /debug with --self-auth-paths.")
+	o.MainTLSCertFile = flag.String("main-tls-cert-file", "", "Path to a PEM-encoded certificate to serve main metrics over TLS with. Reloaded when changed. Requires the key file.")
+	o.MainTLSKeyFile = flag.String("main-tls-key-file", "", "Path to the PEM-encoded private key of the main server's certificate.")
+	o.MainAuthPaths = flag.String("main-auth-paths", "", "Comma-separated paths on the main server that require a bearer token, authenticated through a TokenReview, and authorized through a SubjectAccessReview for the path and the request's verb. Each path covers all paths under it (for e.g., /metrics covers /metrics/resources/{name}). Consider setting a TLS certificate, as bearer tokens are otherwise sent in plaintext.")
 	flag.Parse()
 
 	// Respect overrides, this also helps in testing without setting the same defaults in a bunch of places.
@@ -0,0 +1,405 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rexagod/crdmetrics/internal/version"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/proto"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const (
+
+	// otlpProtocolGRPC is the OTLP/gRPC transport.
+	otlpProtocolGRPC = "grpc"
+
+	// otlpProtocolHTTP is the OTLP/HTTP transport, with binary protobuf payloads.
+	otlpProtocolHTTP = "http/protobuf"
+
+	// otlpMaxResourcesPerRequest is the maximum number of resources, i.e., objects, exported in a single request.
+	otlpMaxResourcesPerRequest = 1000
+)
+
+// Resource attributes identify the object that the data points of each resource are generated from.
+const (
+	otlpAttributeServiceName = "service.name"
+	otlpAttributeGroup       = "k8s.group"
+	otlpAttributeVersion     = "k8s.version"
+	otlpAttributeKind        = "k8s.kind"
+	otlpAttributeNamespace   = "k8s.namespace.name"
+	otlpAttributeName        = "k8s.object.name"
+	otlpAttributeUID         = "k8s.object.uid"
+)
+
+// otlpClient defines behaviours for sending OTLP export requests over a transport.
+type otlpClient interface {
+
+	// export sends the given request.
+	export(ctx context.Context, request *colmetricspb.ExportMetricsServiceRequest) error
+
+	// close releases the client's resources.
+	close() error
+}
+
+// otlpGRPCClient implements the otlpClient interface over OTLP/gRPC.
+type otlpGRPCClient struct {
+
+	// conn is the connection to the endpoint.
+	conn *grpc.ClientConn
+
+	// client is the metrics service client.
+	client colmetricspb.MetricsServiceClient
+}
+
+// export sends the given request.
+func (c *otlpGRPCClient) export(ctx context.Context, request *colmetricspb.ExportMetricsServiceRequest) error {
+	response, err := c.client.Export(ctx, request)
+	if err != nil {
+		return fmt.Errorf("error sending OTLP export request: %w", err)
+	}
+
+	return partialSuccessError(response.GetPartialSuccess())
+}
+
+// close closes the connection to the endpoint.
+func (c *otlpGRPCClient) close() error {
+	if err := c.conn.Close(); err != nil {
+		return fmt.Errorf("error closing OTLP connection: %w", err)
+	}
+
+	return nil
+}
+
+// otlpHTTPClient implements the otlpClient interface over OTLP/HTTP.
+type otlpHTTPClient struct {
+
+	// endpoint is the URL to send requests to.
+	endpoint string
+
+	// client is the HTTP client that requests are sent with.
+	client *http.Client
+}
+
+// export sends the given request.
+func (c *otlpHTTPClient) export(ctx context.Context, request *colmetricspb.ExportMetricsServiceRequest) error {
+	raw, err := proto.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("error encoding OTLP export request: %w", err)
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(raw))
+	if err != nil {
+		return fmt.Errorf("error creating OTLP export request: %w", err)
+	}
+	httpRequest.Header.Set("Content-Type", "application/x-protobuf")
+	httpRequest.Header.Set("User-Agent", version.ControllerName)
+	httpResponse, err := c.client.Do(httpRequest)
+	if err != nil {
+		return fmt.Errorf("error sending OTLP export request: %w", err)
+	}
+	defer httpResponse.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(httpResponse.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("error reading OTLP export response: %w", err)
+	}
+	if httpResponse.StatusCode/100 != 2 {
+		return fmt.Errorf("OTLP endpoint returned status %s", httpResponse.Status)
+	}
+	response := &colmetricspb.ExportMetricsServiceResponse{}
+	if err = proto.Unmarshal(body, response); err != nil {
+		return fmt.Errorf("error decoding OTLP export response: %w", err)
+	}
+
+	return partialSuccessError(response.GetPartialSuccess())
+}
+
+// close is a no-op, since requests do not share any state.
+func (c *otlpHTTPClient) close() error {
+	return nil
+}
+
+// partialSuccessError returns an error if the given partial success reports any rejected data points.
+func partialSuccessError(partialSuccess *colmetricspb.ExportMetricsPartialSuccess) error {
+	if partialSuccess.GetRejectedDataPoints() > 0 {
+		return fmt.Errorf("OTLP endpoint rejected %d data points: %s",
+			partialSuccess.GetRejectedDataPoints(), partialSuccess.GetErrorMessage())
+	}
+
+	return nil
+}
+
+// otlpExporter periodically exports the series of all stores, as of the registry's current snapshot, to an OTLP
+// endpoint. Series are exported as last rendered by the stores, with each object as a resource of its own, so that
+// labels are exported as attributes as is. Counter families are exported as cumulative, monotonic sums, that start at
+// the objects' creation, and all other families as gauges.
+type otlpExporter struct {
+
+	// endpoint is the OTLP endpoint.
+	endpoint string
+
+	// client sends export requests to the endpoint.
+	client otlpClient
+
+	// registry is the store registry whose stores are exported.
+	registry *storeRegistry
+
+	// interval is the interval that exports are made at.
+	interval time.Duration
+
+	// startTime is the start of sums for objects without a creation timestamp.
+	startTime time.Time
+
+	// telemetry holds the self metrics that exports report to.
+	telemetry *telemetry
+}
+
+// newOTLPExporter returns a new otlpExporter for the given options.
+func newOTLPExporter(registry *storeRegistry, telemetry *telemetry, options *Options) (*otlpExporter, error) {
+	if *options.OTLPInterval <= 0 {
+		return nil, errors.New("expected a positive OTLP interval")
+	}
+	endpoint := *options.OTLPEndpoint
+	var client otlpClient
+	switch *options.OTLPProtocol {
+	case otlpProtocolGRPC:
+		transportCredentials := credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+		if *options.OTLPInsecure {
+			transportCredentials = insecure.NewCredentials()
+		}
+		conn, err := grpc.NewClient(endpoint, grpc.WithTransportCredentials(transportCredentials))
+		if err != nil {
+			return nil, fmt.Errorf("invalid OTLP endpoint: %w", err)
+		}
+		client = &otlpGRPCClient{conn: conn, client: colmetricspb.NewMetricsServiceClient(conn)}
+	case otlpProtocolHTTP:
+		parsed, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OTLP endpoint: %w", err)
+		}
+		if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return nil, fmt.Errorf("invalid OTLP endpoint %q: expected an http or https scheme", endpoint)
+		}
+		client = &otlpHTTPClient{endpoint: parsed.String(), client: &http.Client{Timeout: *options.OTLPInterval}}
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol %q, expected %q or %q", *options.OTLPProtocol, otlpProtocolGRPC, otlpProtocolHTTP)
+	}
+
+	return &otlpExporter{
+		endpoint:  endpoint,
+		client:    client,
+		registry:  registry,
+		interval:  *options.OTLPInterval,
+		startTime: time.Now(),
+		telemetry: telemetry,
+	}, nil
+}
+
+// run exports at the configured interval, until the given context is done.
+func (e *otlpExporter) run(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+	defer func() {
+		if err := e.client.close(); err != nil {
+			logger.Error(err, "error stopping OTLP exporter", "endpoint", e.endpoint)
+		}
+	}()
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		ctx, cancel := context.WithTimeout(ctx, e.interval)
+		defer cancel()
+
+		if err := e.export(ctx); err != nil {
+			logger.Error(err, "error exporting metrics", "endpoint", e.endpoint)
+		}
+	}, e.interval)
+}
+
+// export sends the current data points of all stores, in batches of resources. All batches are attempted, even if some
+// fail.
+func (e *otlpExporter) export(ctx context.Context) error {
+	snapshot := e.registry.snapshot()
+	var stores []*StoreType
+	for _, key := range snapshot.keys {
+		stores = append(stores, snapshot.stores[key]...)
+	}
+
+	// Families that conflict with others are not exported, as with scrapes.
+	exported := map[*StoreType]map[string]bool{}
+	for _, group := range newMetricsWriter(stores...).groups() {
+		for i, s := range group.stores {
+			if exported[s] == nil {
+				exported[s] = map[string]bool{}
+			}
+			exported[s][group.families[i].name] = true
+		}
+	}
+
+	now := time.Now()
+	var resourceMetrics []*metricspb.ResourceMetrics
+	for _, s := range stores {
+		resourceMetrics = append(resourceMetrics, e.collect(s, exported[s], now)...)
+	}
+
+	var errs []error
+	for start := 0; start < len(resourceMetrics); start += otlpMaxResourcesPerRequest {
+		batch := resourceMetrics[start:min(start+otlpMaxResourcesPerRequest, len(resourceMetrics))]
+		dataPoints := countDataPoints(batch)
+		if err := e.client.export(ctx, &colmetricspb.ExportMetricsServiceRequest{ResourceMetrics: batch}); err != nil {
+			e.telemetry.otlpDataPointsFailedTotal.Add(float64(dataPoints))
+			errs = append(errs, err)
+
+			continue
+		}
+		e.telemetry.otlpDataPointsSentTotal.Add(float64(dataPoints))
+	}
+
+	return errors.Join(errs...)
+}
+
+// collect returns the data points of the given families of the given store, as rendered for each of its objects,
+// timestamped with the given time, as a resource per object. Objects that failed to render are skipped.
+func (e *otlpExporter) collect(s *StoreType, families map[string]bool, now time.Time) []*metricspb.ResourceMetrics {
+	plan, objects := s.renderedObjects()
+	resourceMetrics := make([]*metricspb.ResourceMetrics, 0, len(objects))
+	for _, o := range objects {
+		u := o.object
+		metrics := collectObjectMetrics(plan, families, u, o.families, now, e.startTime)
+		if len(metrics) == 0 {
+			continue
+		}
+		resourceMetrics = append(resourceMetrics, &metricspb.ResourceMetrics{
+			Resource: &resourcepb.Resource{Attributes: otlpAttributes(
+				otlpAttributeServiceName, version.ControllerName,
+				otlpAttributeGroup, plan.gvk.Group,
+				otlpAttributeVersion, plan.gvk.Version,
+				otlpAttributeKind, plan.gvk.Kind,
+				otlpAttributeNamespace, u.GetNamespace(),
+				otlpAttributeName, u.GetName(),
+				otlpAttributeUID, string(u.GetUID()),
+			)},
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Scope:   &commonpb.InstrumentationScope{Name: version.ControllerName},
+				Metrics: metrics,
+			}},
+		})
+	}
+
+	return resourceMetrics
+}
+
+// collectObjectMetrics returns a metric for each of the given families of the given plan with any data points, from the
+// given rendered families of the given object.
+func collectObjectMetrics(
+	plan *storePlan,
+	families map[string]bool,
+	u *unstructured.Unstructured,
+	rendered []renderedFamily,
+	now, startTime time.Time,
+) []*metricspb.Metric {
+	if creationTimestamp := u.GetCreationTimestamp(); !creationTimestamp.IsZero() {
+		startTime = creationTimestamp.Time
+	}
+	var metrics []*metricspb.Metric
+	for i, f := range plan.families {
+		if !families[f.name] || i >= len(rendered) {
+			continue
+		}
+		dataPoints := make([]*metricspb.NumberDataPoint, 0, len(rendered[i].metrics))
+		for _, metric := range rendered[i].metrics {
+			// The GVK labels that follow the series' labels identify the resource instead.
+			labels := metric.GetLabel()
+			labels = labels[:len(labels)-gvkLabels]
+			attributes := make([]string, 0, 2*len(labels))
+			for _, label := range labels {
+				attributes = append(attributes, label.GetName(), label.GetValue())
+			}
+			dataPoints = append(dataPoints, &metricspb.NumberDataPoint{
+				Attributes:        otlpAttributes(attributes...),
+				StartTimeUnixNano: uint64(startTime.UnixNano()),
+				TimeUnixNano:      uint64(now.UnixNano()),
+				Value:             &metricspb.NumberDataPoint_AsDouble{AsDouble: metric.GetGauge().GetValue()},
+			})
+		}
+		if len(dataPoints) == 0 {
+			continue
+		}
+		metric := &metricspb.Metric{
+			Name:        kubeCustomResourcePrefix + f.name,
+			Description: f.help,
+			Unit:        f.unit,
+		}
+		if f.kind == FamilyKindCounter {
+			metric.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				DataPoints:             dataPoints,
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				IsMonotonic:            true,
+			}}
+		} else {
+			for _, dataPoint := range dataPoints {
+				dataPoint.StartTimeUnixNano = 0
+			}
+			metric.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: dataPoints}}
+		}
+		metrics = append(metrics, metric)
+	}
+
+	return metrics
+}
+
+// otlpAttributes returns the given key-value pairs as string attributes.
+func otlpAttributes(keyValues ...string) []*commonpb.KeyValue {
+	attributes := make([]*commonpb.KeyValue, 0, len(keyValues)/2)
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		attributes = append(attributes, &commonpb.KeyValue{
+			Key:   keyValues[i],
+			Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: keyValues[i+1]}},
+		})
+	}
+
+	return attributes
+}
+
+// countDataPoints returns the number of data points in the given resources.
+func countDataPoints(resourceMetrics []*metricspb.ResourceMetrics) int {
+	var n int
+	for _, r := range resourceMetrics {
+		for _, scopeMetrics := range r.GetScopeMetrics() {
+			for _, metric := range scopeMetrics.GetMetrics() {
+				n += len(metric.GetGauge().GetDataPoints()) + len(metric.GetSum().GetDataPoints())
+			}
+		}
+	}
+
+	return n
+}
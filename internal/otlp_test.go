@@ -0,0 +1,229 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rexagod/crdmetrics/pkg/resolver"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/klog/v2"
+)
+
+// otlpReceiver is an in-process OTLP endpoint, over both transports, that records the data points it received, as
+// "<resource name> <metric name> <type> <value>".
+type otlpReceiver struct {
+	colmetricspb.UnimplementedMetricsServiceServer
+
+	mutex      sync.Mutex
+	dataPoints []string
+}
+
+// Export records the data points of the given request.
+func (r *otlpReceiver) Export(
+	_ context.Context,
+	request *colmetricspb.ExportMetricsServiceRequest,
+) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, resourceMetrics := range request.GetResourceMetrics() {
+		var name string
+		for _, attribute := range resourceMetrics.GetResource().GetAttributes() {
+			if attribute.GetKey() == otlpAttributeName {
+				name = attribute.GetValue().GetStringValue()
+			}
+		}
+		for _, scopeMetrics := range resourceMetrics.GetScopeMetrics() {
+			for _, metric := range scopeMetrics.GetMetrics() {
+				switch data := metric.GetData().(type) {
+				case *metricspb.Metric_Gauge:
+					for _, dataPoint := range data.Gauge.GetDataPoints() {
+						r.dataPoints = append(r.dataPoints, fmt.Sprintf("%s %s gauge %v", name, metric.GetName(), dataPoint.GetAsDouble()))
+					}
+				case *metricspb.Metric_Sum:
+					for _, dataPoint := range data.Sum.GetDataPoints() {
+						r.dataPoints = append(r.dataPoints, fmt.Sprintf("%s %s sum %v %d", name, metric.GetName(), dataPoint.GetAsDouble(),
+							time.Unix(0, int64(dataPoint.GetStartTimeUnixNano())).Unix()))
+					}
+				}
+			}
+		}
+	}
+
+	return &colmetricspb.ExportMetricsServiceResponse{}, nil
+}
+
+// ServeHTTP decodes OTLP/HTTP requests, and records them.
+func (r *otlpReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	raw, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	request := &colmetricspb.ExportMetricsServiceRequest{}
+	if err = proto.Unmarshal(raw, request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	response, _ := r.Export(req.Context(), request)
+	raw, _ = proto.Marshal(response)
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(raw)
+}
+
+func TestOTLPExporterExport(t *testing.T) {
+	t.Parallel()
+
+	plan, err := newStorePlan(&StoreType{
+		Group:   "samplecontroller.k8s.io",
+		Version: "v1alpha1",
+		Kind:    "Foo",
+		Families: []*FamilyType{
+			{
+				Name: "foo_replicas",
+				Help: "Replicas",
+				Metrics: []*MetricType{{
+					LabelKeys:   []string{"name"},
+					LabelValues: []string{"metadata.name"},
+					Value:       "spec.replicas",
+				}},
+			},
+			{
+				Name: "foo_restarts",
+				Help: "Restarts",
+				Kind: FamilyKindCounter,
+				Metrics: []*MetricType{{
+					LabelKeys:   []string{"name"},
+					LabelValues: []string{"metadata.name"},
+					Value:       "spec.replicas",
+				}},
+			},
+		},
+	}, resolver.Options{Logger: klog.Background()})
+	if err != nil {
+		t.Fatalf("failed to compile plan: %v", err)
+	}
+	s := newStore(context.Background(), klog.Background(), plan)
+	object := newTestObject("a", 2)
+	object.SetCreationTimestamp(metav1.Unix(1700000000, 0))
+	addTestObject(t, s, object)
+
+	// Exports read the series as rendered, rather than evaluating the cached objects anew.
+	changed := object.DeepCopy()
+	if err = unstructured.SetNestedField(changed.Object, int64(5), "spec", "replicas"); err != nil {
+		t.Fatalf("failed to change object: %v", err)
+	}
+	if err = s.objects.Update(changed); err != nil {
+		t.Fatalf("failed to cache object: %v", err)
+	}
+	registry := newStoreRegistry()
+	registry.swap("foo", nil, s)
+
+	// Conflicting families are not exported.
+	registry.swap("qux", nil, newTestStore(t, []*FamilyType{newTestFamily("foo_replicas", "Conflicting replicas")}, newTestObject("b", 1)))
+
+	receiver := &otlpReceiver{}
+	httpServer := httptest.NewServer(receiver)
+	t.Cleanup(httpServer.Close)
+	grpcServer := grpc.NewServer()
+	colmetricspb.RegisterMetricsServiceServer(grpcServer, receiver)
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() { _ = grpcServer.Serve(listener) }()
+	t.Cleanup(grpcServer.Stop)
+
+	for _, tc := range []struct {
+		protocol string
+		endpoint string
+	}{
+		{protocol: otlpProtocolHTTP, endpoint: httpServer.URL + "/v1/metrics"},
+		{protocol: otlpProtocolGRPC, endpoint: listener.Addr().String()},
+	} {
+		interval, insecure := time.Minute, true
+		e, err := newOTLPExporter(registry, newTelemetry(), &Options{
+			OTLPEndpoint: &tc.endpoint,
+			OTLPProtocol: &tc.protocol,
+			OTLPInterval: &interval,
+			OTLPInsecure: &insecure,
+		})
+		if err != nil {
+			t.Fatalf("%s: failed to create exporter: %v", tc.protocol, err)
+		}
+		receiver.dataPoints = nil
+		if err = e.export(context.Background()); err != nil {
+			t.Fatalf("%s: failed to export: %v", tc.protocol, err)
+		}
+		want := []string{
+			"a kube_customresource_foo_replicas gauge 2",
+			"a kube_customresource_foo_restarts sum 2 1700000000",
+		}
+		if !slices.Equal(receiver.dataPoints, want) {
+			t.Errorf("%s: got data points %q, want %q", tc.protocol, receiver.dataPoints, want)
+		}
+		if got := testutil.ToFloat64(e.telemetry.otlpDataPointsSentTotal); got != 2 {
+			t.Errorf("%s: got %v data points sent, want 2", tc.protocol, got)
+		}
+		if err = e.client.close(); err != nil {
+			t.Errorf("%s: failed to close client: %v", tc.protocol, err)
+		}
+	}
+}
+
+func TestNewOTLPExporterValidatesOptions(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		protocol, endpoint string
+		wantErr            bool
+	}{
+		{protocol: otlpProtocolGRPC, endpoint: "localhost:4317"},
+		{protocol: otlpProtocolHTTP, endpoint: "http://localhost:4318/v1/metrics"},
+		{protocol: otlpProtocolHTTP, endpoint: "localhost:4318", wantErr: true},
+		{protocol: "http/json", endpoint: "http://localhost:4318/v1/metrics", wantErr: true},
+	} {
+		interval, insecure := time.Minute, false
+		_, err := newOTLPExporter(newStoreRegistry(), newTelemetry(), &Options{
+			OTLPEndpoint: &tc.endpoint,
+			OTLPProtocol: &tc.protocol,
+			OTLPInterval: &interval,
+			OTLPInsecure: &insecure,
+		})
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("%s %s: got error %v, want error %t", tc.protocol, tc.endpoint, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,642 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rexagod/crdmetrics/pkg/resolver"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog/v2"
+)
+
+// labelKeySanitizer matches all characters that are not allowed in label keys.
+var labelKeySanitizer = regexp.MustCompile(`\W`)
+
+// sanitizeLabelKey returns the given label key in its exposition-safe representation.
+func sanitizeLabelKey(labelKey string) string {
+	return strings.ToLower(labelKeySanitizer.ReplaceAllString(labelKey, "_"))
+}
+
+// storePlan is the immutable rendering plan for a store. It is compiled once from the store's configuration, with all
+// inheritable attributes (resolvers, labelsets, and resolution failure policies) resolved, and is only executed
+// afterwards. It must not be modified once compiled, since it is shared across renders.
+type storePlan struct {
+
+	// gvk is the GroupVersionKind of the objects the plan renders.
+	gvk schema.GroupVersionKind
+
+	// families are the plans for each of the store's families, in the configured order.
+	families []*familyPlan
+
+	// dependencies are the paths of the objects that the plan's queries read. They are only meaningful if
+	// dependenciesKnown is set, otherwise the plan must be assumed to read the whole object.
+	dependencies [][]string
+
+	// dependenciesKnown is set if the paths that all of the plan's queries read could be determined.
+	dependenciesKnown bool
+
+	// metadataOnly is set if none of the plan's queries read anything besides the objects' metadata.
+	metadataOnly bool
+
+	// fingerprint identifies the configuration, along with the resolver options, the plan was compiled from. Plans with
+	// equal fingerprints render identically.
+	fingerprint string
+}
+
+// familyPlan is the immutable rendering plan for a metric family.
+type familyPlan struct {
+
+	// name is the name of the family, without the exposition prefix.
+	name string
+
+	// kind is the OpenMetrics type of the family.
+	kind FamilyKind
+
+	// help is the help text of the family.
+	help string
+
+	// unit is the OpenMetrics unit of the family, if any.
+	unit string
+
+	// sampleName is the name of the family's series, with the exposition prefix and the kind's suffix.
+	sampleName string
+
+	// header is the pre-built help and type text for the family, terminated by a newline.
+	header []byte
+
+	// openMetricsHeader is the pre-built help, type, and unit text for the family under OpenMetrics, terminated by a
+	// newline.
+	openMetricsHeader []byte
+
+	// protobufHeader is the pre-encoded name, help, and type fields for the family under the protobuf format.
+	protobufHeader []byte
+
+	// created is set if the family's series are accompanied by created timestamps under OpenMetrics.
+	created bool
+
+	// metrics are the plans for each of the family's metrics.
+	metrics []*metricPlan
+}
+
+// metricPlan is the immutable rendering plan for a single time series.
+type metricPlan struct {
+
+	// family is the name of the family the metric belongs to.
+	family string
+
+	// resolver is the resolver instance used to evaluate the queries.
+	resolver resolver.Resolver
+
+	// labelKeys are the sanitized, fully inherited label keys.
+	labelKeys []string
+
+	// labelValues are the fully inherited label value queries, corresponding to labelKeys.
+	labelValues []string
+
+	// value is the metric value query.
+	value string
+
+	// constantValue is the value of all series, in place of value, if set.
+	constantValue string
+
+	// onResolutionFailure is the policy to apply when a query cannot be resolved.
+	onResolutionFailure ResolutionFailurePolicy
+
+	// defaultValue is the metric value to use under the ResolutionFailurePolicyDefaultValue policy.
+	defaultValue string
+
+	// defaultLabelValue is the label value to use under the ResolutionFailurePolicyDefaultValue policy.
+	defaultLabelValue string
+}
+
+// newStorePlan compiles the given store configuration into a rendering plan. Queries are compiled ahead of resolution
+// for resolvers that support it, and the configuration is rejected if any of them are.
+func newStorePlan(s *StoreType, resolverOptions resolver.Options) (*storePlan, error) {
+	plan := &storePlan{
+		gvk:               schema.GroupVersionKind{Group: s.Group, Version: s.Version, Kind: s.Kind},
+		families:          make([]*familyPlan, len(s.Families)),
+		dependenciesKnown: true,
+	}
+
+	// Share resolver instances across the store, so compiled queries are shared as well.
+	resolvers := map[ResolverType]resolver.Resolver{}
+	resolverFor := func(resolverType ResolverType) (resolver.Resolver, error) {
+		if r, ok := resolvers[resolverType]; ok {
+			return r, nil
+		}
+		r, err := resolver.New(string(resolverType), resolverOptions)
+		if err != nil {
+			return nil, err //nolint:wrapcheck // Already wrapped.
+		}
+		resolvers[resolverType] = r
+
+		return r, nil
+	}
+
+	for i, f := range s.Families {
+		kind := firstNonEmpty(f.Kind, FamilyKindGauge)
+		fp := &familyPlan{
+			name:              f.Name,
+			kind:              kind,
+			help:              f.Help,
+			unit:              f.Unit,
+			sampleName:        kubeCustomResourcePrefix + f.Name + kind.suffix(),
+			header:            buildHeaders(f.Name+kind.suffix(), f.Help),
+			openMetricsHeader: buildOpenMetricsHeaders(f.Name, f.Help, kind, f.Unit),
+			created:           f.Created && kind == FamilyKindCounter,
+			metrics:           make([]*metricPlan, len(f.Metrics)),
+		}
+		protobufHeader, err := buildProtobufHeaders(f.Name+kind.suffix(), f.Help)
+		if err != nil {
+			return nil, fmt.Errorf("invalid configuration for family %q: %w", f.Name, err)
+		}
+		fp.protobufHeader = protobufHeader
+		if fp.created {
+			plan.dependencies = append(plan.dependencies, []string{"metadata", "creationTimestamp"})
+		}
+		for j, m := range f.Metrics {
+			// Inherit the resolver, defaulting to the unstructured one.
+			resolverType := firstNonEmpty(m.Resolver, f.Resolver, s.Resolver, ResolverTypeUnstructured)
+			resolverInstance, err := resolverFor(resolverType)
+			if err != nil {
+				return nil, fmt.Errorf("invalid configuration for metric %d of family %q: %w", j, f.Name, err)
+			}
+
+			// Inherit the label keys and values.
+			labelKeys := concat(m.LabelKeys, f.LabelKeys, s.LabelKeys)
+			labelValues := concat(m.LabelValues, f.LabelValues, s.LabelValues)
+			if len(labelKeys) != len(labelValues) {
+				return nil, fmt.Errorf(
+					"invalid configuration for metric %d of family %q: expected labelKeys %q to be of same length (%d) as labelValues %q (%d)",
+					j, f.Name, labelKeys, len(labelKeys), labelValues, len(labelValues),
+				)
+			}
+			for k := range labelKeys {
+				labelKeys[k] = sanitizeLabelKey(labelKeys[k])
+			}
+
+			// Statesets denote the state with a label named after the family.
+			if kind == FamilyKindStateSet {
+				k := slices.Index(labelKeys, f.Name)
+				if k == -1 {
+					return nil, fmt.Errorf("invalid configuration for metric %d of stateset family %q: expected a label key named %q", j, f.Name, f.Name)
+				}
+				labelKeys[k] = kubeCustomResourcePrefix + f.Name
+			}
+
+			// Info series always have a value of 1, so their value query is not used.
+			queries := append([]string{m.Value}, labelValues...)
+			var constantValue string
+			if kind == FamilyKindInfo {
+				queries, constantValue = labelValues, "1"
+			}
+
+			// Compile the queries, if supported.
+			if compiler, ok := resolverInstance.(resolver.Compiler); ok {
+				for _, query := range queries {
+					if err = compiler.Compile(query); err != nil {
+						return nil, fmt.Errorf("invalid configuration for metric %d of family %q: %w", j, f.Name, err)
+					}
+				}
+			}
+
+			// Record the paths the queries read.
+			if plan.dependenciesKnown {
+				paths, ok := queryPaths(resolverInstance, queries...)
+				plan.dependencies = append(plan.dependencies, paths...)
+				plan.dependenciesKnown = ok
+			}
+
+			// Inherit the resolution failure policy.
+			fp.metrics[j] = &metricPlan{
+				family:              f.Name,
+				resolver:            resolverInstance,
+				labelKeys:           labelKeys,
+				labelValues:         labelValues,
+				value:               m.Value,
+				constantValue:       constantValue,
+				onResolutionFailure: firstNonEmpty(m.OnResolutionFailure, f.OnResolutionFailure, s.OnResolutionFailure),
+				defaultValue:        firstNonEmpty(m.DefaultValue, f.DefaultValue, s.DefaultValue),
+				defaultLabelValue:   firstNonEmpty(m.DefaultLabelValue, f.DefaultLabelValue, s.DefaultLabelValue),
+			}
+		}
+		plan.families[i] = fp
+	}
+
+	// Watch only the metadata if no query reads anything else.
+	plan.metadataOnly = plan.dependenciesKnown
+	for _, path := range plan.dependencies {
+		if path[0] != "metadata" {
+			plan.metadataOnly = false
+
+			break
+		}
+	}
+	if !plan.dependenciesKnown {
+		plan.dependencies = nil
+	}
+
+	return plan, nil
+}
+
+// queryPaths returns the paths that the given queries, as resolved by the given resolver, read. ok is false if these
+// cannot be determined.
+func queryPaths(r resolver.Resolver, queries ...string) (paths [][]string, ok bool) {
+	analyzer, ok := r.(resolver.PathAnalyzer)
+	if !ok {
+		return nil, false
+	}
+	for _, query := range queries {
+		queryPaths, ok := analyzer.Paths(query)
+		if !ok {
+			return nil, false
+		}
+		for _, path := range queryPaths {
+			if len(path) == 0 {
+				return nil, false
+			}
+			paths = append(paths, path)
+		}
+	}
+
+	return paths, true
+}
+
+// dependenciesChanged reports whether any of the paths that the plan reads differ between the given objects.
+func (p *storePlan) dependenciesChanged(oldObject, newObject *unstructured.Unstructured) bool {
+	if !p.dependenciesKnown {
+		return true
+	}
+	for _, path := range p.dependencies {
+		oldValue, oldFound, oldErr := unstructured.NestedFieldNoCopy(oldObject.Object, path...)
+		newValue, newFound, newErr := unstructured.NestedFieldNoCopy(newObject.Object, path...)
+		if oldErr != nil || newErr != nil || oldFound != newFound || !reflect.DeepEqual(oldValue, newValue) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// renderedFamily is the raw representation of a family's series for an object.
+type renderedFamily struct {
+
+	// series are the family's series, in exposition format.
+	series []byte
+
+	// openMetricsSeries are the family's series under OpenMetrics, if these differ from series, i.e., if the family's
+	// series are accompanied by created timestamps.
+	openMetricsSeries []byte
+
+	// metrics are the family's series as protobuf metrics, with the same labelsets and values as series.
+	metrics []*dto.Metric
+
+	// seriesEnds are the offsets in series that each of the metrics' series ends at.
+	seriesEnds []int
+
+	// openMetricsSeriesEnds are the offsets in openMetricsSeries that each of the metrics' series, along with its
+	// created timestamp, ends at.
+	openMetricsSeriesEnds []int
+
+	// protobuf lazily encodes metrics under the protobuf format. It is only set for the series of all objects, and not
+	// for individual ones.
+	protobuf *protobufSeries
+}
+
+// render executes the plan against the given object, and returns the raw representation of each family. An error
+// wrapping errObjectFailed is returned if the object should not generate any series at all.
+func (p *storePlan) render(ctx context.Context, logger klog.Logger, u *unstructured.Unstructured) ([]renderedFamily, error) {
+	familyMetrics := make([]renderedFamily, len(p.families))
+	for i, f := range p.families {
+		var err error
+		familyMetrics[i], err = f.render(ctx, logger, p.gvk, u)
+		if err != nil {
+			return nil, err
+		}
+		logger.V(4).Info("Render", "family", f.name, "metrics", string(familyMetrics[i].series))
+	}
+
+	return familyMetrics, nil
+}
+
+// render executes the family plan against the given object, and returns its raw representation.
+func (f *familyPlan) render(
+	ctx context.Context,
+	logger klog.Logger,
+	gvk schema.GroupVersionKind,
+	u *unstructured.Unstructured,
+) (renderedFamily, error) {
+	logger = logger.WithValues("family", f.name)
+
+	// Created timestamps are the objects' creation timestamps, in seconds.
+	var created string
+	if creationTimestamp := u.GetCreationTimestamp(); f.created && !creationTimestamp.IsZero() {
+		created = strconv.FormatInt(creationTimestamp.Unix(), 10)
+	}
+
+	familyRawBuilder := bytes.Buffer{}
+	openMetricsFamilyRawBuilder := bytes.Buffer{}
+	metricRawBuilder := bytes.Buffer{}
+	var metrics []*dto.Metric
+	var seriesEnds, openMetricsSeriesEnds []int
+	for _, m := range f.metrics {
+		resolvedLabelKeys, resolvedLabelValues, resolvedValue, skip, err := f.resolve(ctx, logger, m, u)
+		if err != nil {
+			return renderedFamily{}, err
+		}
+		if skip {
+			continue
+		}
+
+		// Write the metric.
+		metricRawBuilder.Reset()
+		metricRawBuilder.WriteString(f.sampleName)
+		err = writeMetricTo(
+			&metricRawBuilder,
+			gvk.Group, gvk.Version, gvk.Kind,
+			resolvedValue,
+			resolvedLabelKeys, resolvedLabelValues,
+		)
+		if err != nil {
+			logger.V(1).Error(fmt.Errorf("error writing metric: %w", err), "skipping")
+
+			continue
+		}
+
+		familyRawBuilder.Write(metricRawBuilder.Bytes())
+		seriesEnds = append(seriesEnds, familyRawBuilder.Len())
+
+		// Keep the metric for the protobuf format as well. Its labels were sorted, and its value validated, by
+		// writeMetricTo.
+		value, _ := strconv.ParseFloat(resolvedValue, 64)
+		metrics = append(metrics, newProtobufMetric(gvk, value, resolvedLabelKeys, resolvedLabelValues))
+
+		// Follow the metric with its created timestamp, with the same labelset, under OpenMetrics.
+		if f.created {
+			metric := metricRawBuilder.Bytes()
+			openMetricsFamilyRawBuilder.Write(metric)
+			if created != "" {
+				labelset := metric[len(f.sampleName):bytes.LastIndexByte(metric, ' ')]
+				openMetricsFamilyRawBuilder.WriteString(kubeCustomResourcePrefix + f.name + "_created")
+				openMetricsFamilyRawBuilder.Write(labelset)
+				openMetricsFamilyRawBuilder.WriteByte(' ')
+				openMetricsFamilyRawBuilder.WriteString(created)
+				openMetricsFamilyRawBuilder.WriteByte('\n')
+			}
+			openMetricsSeriesEnds = append(openMetricsSeriesEnds, openMetricsFamilyRawBuilder.Len())
+		}
+	}
+
+	rendered := renderedFamily{series: familyRawBuilder.Bytes(), metrics: metrics, seriesEnds: seriesEnds}
+	if f.created {
+		rendered.openMetricsSeries = openMetricsFamilyRawBuilder.Bytes()
+		rendered.openMetricsSeriesEnds = openMetricsSeriesEnds
+	}
+
+	return rendered, nil
+}
+
+// resolve executes the given metric plan of the family against the given object, as with metricPlan.resolve, and maps
+// the resolved value as per the family's kind. Series that cannot be written are skipped.
+func (f *familyPlan) resolve(
+	ctx context.Context,
+	logger klog.Logger,
+	m *metricPlan,
+	u *unstructured.Unstructured,
+) (resolvedLabelKeys, resolvedLabelValues []string, resolvedValue string, skip bool, err error) {
+	resolvedLabelKeys, resolvedLabelValues, resolvedValue, skip, err = m.resolve(ctx, u)
+	if err != nil {
+		return nil, nil, "", false, err
+	}
+	if skip {
+		logger.V(1).Info("skipping series", "reason", "unresolved query")
+
+		return nil, nil, "", true, nil
+	}
+
+	// Statesets are either set, or not.
+	if f.kind == FamilyKindStateSet {
+		resolvedValue, err = stateSetValue(resolvedValue)
+		if err != nil {
+			logger.V(1).Error(fmt.Errorf("error writing metric: %w", err), "skipping")
+
+			return nil, nil, "", true, nil
+		}
+	}
+
+	return resolvedLabelKeys, resolvedLabelValues, resolvedValue, false, nil
+}
+
+// stateSetValue returns the value of a stateset series, i.e., 1 if the given value is non-zero, or 0 otherwise.
+func stateSetValue(value string) (string, error) {
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return "", fmt.Errorf("error parsing stateset value %q as float64: %w", value, err)
+	}
+	if parsed != 0 {
+		return "1", nil
+	}
+
+	return "0", nil
+}
+
+// resolve executes the metric plan against the given object, and returns the resolved labelset and value, or whether
+// the series should be skipped. Resolutions are recorded by the context's recorder, if any.
+func (m *metricPlan) resolve(ctx context.Context, u *unstructured.Unstructured) (
+	resolvedLabelKeys []string, resolvedLabelValues []string, resolvedValue string, skip bool, err error,
+) {
+	recorder := resolutionRecorderFrom(ctx)
+
+	// Resolve the labelset.
+	for i, query := range m.labelValues {
+		resolvedLabelset, err := m.resolver.Resolve(ctx, query, u.Object)
+		recorder.record(m, u, query, resolvedLabelset, err)
+		if err != nil {
+			resolvedLabelset, skip, err = m.onFailure(query, true, err)
+			if err != nil || skip {
+				return nil, nil, "", skip, err
+			}
+		}
+
+		// If the query is found in the resolved labelset, append the resolved value.
+		if resolvedLabelValue, ok := resolvedLabelset[query]; ok {
+			resolvedLabelValues = append(resolvedLabelValues, resolvedLabelValue)
+
+			// Label keys are not resolved if the returned labelset for the same label key exists.
+			resolvedLabelKeys = append(resolvedLabelKeys, m.labelKeys[i])
+
+			// If the query is not found in the resolved labelset, it is now redundant as a label value.
+		} else {
+			for k, v := range resolvedLabelset {
+				resolvedLabelValues = append(resolvedLabelValues, v)
+
+				// Label keys are resolved (with the original label keys being the new label key's prefix) if the
+				// returned labelset for the same label key does not exist.
+				resolvedLabelKeys = append(resolvedLabelKeys, m.labelKeys[i]+sanitizeLabelKey(k))
+			}
+		}
+	}
+
+	// Resolve the metric value.
+	if m.constantValue != "" {
+		return resolvedLabelKeys, resolvedLabelValues, m.constantValue, false, nil
+	}
+	resolvedValueset, err := m.resolver.Resolve(ctx, m.value, u.Object)
+	recorder.record(m, u, m.value, resolvedValueset, err)
+	if err != nil {
+		resolvedValueset, skip, err = m.onFailure(m.value, false, err)
+		if err != nil || skip {
+			return nil, nil, "", skip, err
+		}
+	}
+	resolvedValue, found := resolvedValueset[m.value]
+
+	// Values that resolve to something else than a single value, e.g., to a map, are failures as well.
+	if !found {
+		resolutionErr := fmt.Errorf("%w: %q resolved to no single value", resolver.ErrResolutionFailed, m.value)
+		resolvedValueset, skip, err = m.onFailure(m.value, false, resolutionErr)
+		if err != nil || skip {
+			return nil, nil, "", skip, err
+		}
+		resolvedValue = resolvedValueset[m.value]
+	}
+
+	return resolvedLabelKeys, resolvedLabelValues, resolvedValue, false, nil
+}
+
+// onFailure applies the metric's resolution failure policy to the given query that failed to resolve with
+// resolutionErr. It returns the labelset to use in place of the resolved one, or whether the series should be skipped.
+// An error wrapping errObjectFailed is returned if the object should not generate any series at all.
+func (m *metricPlan) onFailure(query string, isLabelValue bool, resolutionErr error) (map[string]string, bool, error) {
+	switch m.onResolutionFailure {
+	case ResolutionFailurePolicySkipSeries:
+		return nil, true, nil
+	case ResolutionFailurePolicyEmptyLabel:
+		// An empty string cannot be parsed as a metric value.
+		if !isLabelValue {
+			return nil, true, nil
+		}
+
+		return map[string]string{query: ""}, false, nil
+	case ResolutionFailurePolicyDefaultValue:
+		if isLabelValue {
+			return map[string]string{query: m.defaultLabelValue}, false, nil
+		}
+		if m.defaultValue == "" {
+			return nil, true, nil
+		}
+
+		return map[string]string{query: m.defaultValue}, false, nil
+	case ResolutionFailurePolicyFailObject:
+		return nil, false, fmt.Errorf("%w: %w", errObjectFailed, resolutionErr)
+	case ResolutionFailurePolicyNone, ResolutionFailurePolicyLiteral:
+		fallthrough
+	default:
+		return map[string]string{query: query}, false, nil
+	}
+}
+
+// buildHeaders generates the header for the given family.
+func buildHeaders(name, help string) []byte {
+	header := bytes.Buffer{}
+
+	// Write the help text.
+	header.WriteString("# HELP ")
+	header.WriteString(kubeCustomResourcePrefix)
+	header.WriteString(name)
+	header.WriteString(" ")
+	header.WriteString(help)
+	header.WriteString("\n")
+
+	// Write the type text.
+	header.WriteString("# TYPE ")
+	header.WriteString(kubeCustomResourcePrefix)
+	header.WriteString(name)
+	header.WriteString(" ")
+	header.WriteString(metricTypeGauge)
+	header.WriteString("\n")
+
+	return header.Bytes()
+}
+
+// buildOpenMetricsHeaders generates the header for the given family under OpenMetrics.
+func buildOpenMetricsHeaders(name, help string, kind FamilyKind, unit string) []byte {
+	header := bytes.Buffer{}
+
+	// Write the help text.
+	header.WriteString("# HELP ")
+	header.WriteString(kubeCustomResourcePrefix)
+	header.WriteString(name)
+	header.WriteString(" ")
+	header.WriteString(help)
+	header.WriteString("\n")
+
+	// Write the type text.
+	header.WriteString("# TYPE ")
+	header.WriteString(kubeCustomResourcePrefix)
+	header.WriteString(name)
+	header.WriteString(" ")
+	header.WriteString(string(kind))
+	header.WriteString("\n")
+
+	// Write the unit text.
+	if unit != "" {
+		header.WriteString("# UNIT ")
+		header.WriteString(kubeCustomResourcePrefix)
+		header.WriteString(name)
+		header.WriteString(" ")
+		header.WriteString(unit)
+		header.WriteString("\n")
+	}
+
+	return header.Bytes()
+}
+
+// firstNonEmpty returns the first non-empty value, in the order of inheritance.
+func firstNonEmpty[T ~string](values ...T) T {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// concat returns a new slice holding the given slices, in order.
+func concat(slices ...[]string) []string {
+	var n int
+	for _, s := range slices {
+		n += len(s)
+	}
+	out := make([]string, 0, n)
+	for _, s := range slices {
+		out = append(out, s...)
+	}
+
+	return out
+}
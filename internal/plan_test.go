@@ -0,0 +1,311 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/rexagod/crdmetrics/pkg/resolver"
+	"k8s.io/klog/v2"
+)
+
+func TestResolutionFailurePolicies(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name          string
+		policy        ResolutionFailurePolicy
+		defaultValue  string
+		defaultLabel  string
+		resolver      ResolverType
+		labelValue    string
+		value         string
+		wantSeries    string
+		wantObjectErr bool
+	}{
+		{
+			name:       "literal by default",
+			labelValue: "spec.missing",
+			value:      "spec.replicas",
+			wantSeries: `kube_customresource_foo{label="spec.missing",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1.000000` + "\n",
+		},
+		{
+			name:       "skip series on label",
+			policy:     ResolutionFailurePolicySkipSeries,
+			labelValue: "spec.missing",
+			value:      "spec.replicas",
+		},
+		{
+			name:       "skip series on value",
+			policy:     ResolutionFailurePolicySkipSeries,
+			labelValue: "metadata.name",
+			value:      "spec.missing",
+		},
+		{
+			name:       "empty label",
+			policy:     ResolutionFailurePolicyEmptyLabel,
+			labelValue: "spec.missing",
+			value:      "spec.replicas",
+			wantSeries: `kube_customresource_foo{label="",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1.000000` + "\n",
+		},
+		{
+			name:       "empty label skips on value",
+			policy:     ResolutionFailurePolicyEmptyLabel,
+			labelValue: "metadata.name",
+			value:      "spec.missing",
+		},
+		{
+			name:         "default label",
+			policy:       ResolutionFailurePolicyDefaultValue,
+			defaultValue: "7",
+			defaultLabel: "unknown",
+			labelValue:   "spec.missing",
+			value:        "spec.replicas",
+			wantSeries:   `kube_customresource_foo{label="unknown",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1.000000` + "\n",
+		},
+		{
+			name:         "default value",
+			policy:       ResolutionFailurePolicyDefaultValue,
+			defaultValue: "7",
+			labelValue:   "metadata.name",
+			value:        "spec.missing",
+			wantSeries:   `kube_customresource_foo{label="foo",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 7.000000` + "\n",
+		},
+		{
+			name:         "default value on value without a single value",
+			policy:       ResolutionFailurePolicyDefaultValue,
+			defaultValue: "7",
+			resolver:     ResolverTypeCEL,
+			labelValue:   "o.metadata.name",
+			value:        "o.spec",
+			wantSeries:   `kube_customresource_foo{label="foo",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 7.000000` + "\n",
+		},
+		{
+			name:       "default value skips without one",
+			policy:     ResolutionFailurePolicyDefaultValue,
+			labelValue: "metadata.name",
+			value:      "spec.missing",
+		},
+		{
+			name:          "fail object",
+			policy:        ResolutionFailurePolicyFailObject,
+			labelValue:    "metadata.name",
+			value:         "spec.missing",
+			wantObjectErr: true,
+		},
+		{
+			name:          "fail object on value without a single value",
+			policy:        ResolutionFailurePolicyFailObject,
+			resolver:      ResolverTypeCEL,
+			labelValue:    "o.metadata.name",
+			value:         "o.spec",
+			wantObjectErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			plan, err := newStorePlan(&StoreType{
+				Group:   "samplecontroller.k8s.io",
+				Version: "v1alpha1",
+				Kind:    "Foo",
+				Families: []*FamilyType{{
+					Name: "foo",
+					Help: "Foo",
+					Metrics: []*MetricType{{
+						LabelKeys:   []string{"label"},
+						LabelValues: []string{tc.labelValue},
+						Value:       tc.value,
+					}},
+					OnResolutionFailure: tc.policy,
+					DefaultValue:        tc.defaultValue,
+					DefaultLabelValue:   tc.defaultLabel,
+					Resolver:            tc.resolver,
+				}},
+			}, resolver.Options{Logger: klog.Background()})
+			if err != nil {
+				t.Fatalf("failed to compile plan: %v", err)
+			}
+			rendered, err := plan.render(context.Background(), klog.Background(), newTestObject("foo", 1))
+			if tc.wantObjectErr {
+				if !errors.Is(err, errObjectFailed) {
+					t.Fatalf("got error %v, want one wrapping %v", err, errObjectFailed)
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to render: %v", err)
+			}
+			if got := string(rendered[0].series); got != tc.wantSeries {
+				t.Fatalf("got series %q, want %q", got, tc.wantSeries)
+			}
+		})
+	}
+}
+
+func TestStorePlanInheritance(t *testing.T) {
+	t.Parallel()
+
+	plan, err := newStorePlan(&StoreType{
+		Group:               "samplecontroller.k8s.io",
+		Version:             "v1alpha1",
+		Kind:                "Foo",
+		Resolver:            ResolverTypeCEL,
+		LabelKeys:           []string{"namespace"},
+		LabelValues:         []string{"o.metadata.namespace"},
+		OnResolutionFailure: ResolutionFailurePolicySkipSeries,
+		DefaultValue:        "1",
+		DefaultLabelValue:   "unknown",
+		Families: []*FamilyType{
+			{
+				Name: "inherited",
+				Help: "Inherited",
+				Metrics: []*MetricType{{
+					LabelKeys:   []string{"app.kubernetes.io/name"},
+					LabelValues: []string{"o.metadata.name"},
+					Value:       "o.spec.replicas",
+				}},
+			},
+			{
+				Name:                "overridden",
+				Help:                "Overridden",
+				Kind:                FamilyKindStateSet,
+				Resolver:            ResolverTypeUnstructured,
+				LabelKeys:           []string{"overridden"},
+				LabelValues:         []string{"status.phase"},
+				OnResolutionFailure: ResolutionFailurePolicyEmptyLabel,
+				Metrics: []*MetricType{{
+					LabelKeys:           []string{"name"},
+					LabelValues:         []string{"metadata.name"},
+					Value:               "spec.replicas",
+					OnResolutionFailure: ResolutionFailurePolicyDefaultValue,
+					DefaultValue:        "2",
+				}},
+			},
+		},
+	}, resolver.Options{Logger: klog.Background()})
+	if err != nil {
+		t.Fatalf("failed to compile plan: %v", err)
+	}
+
+	type inherited struct {
+		Resolver            string
+		LabelKeys           []string
+		LabelValues         []string
+		OnResolutionFailure ResolutionFailurePolicy
+		DefaultValue        string
+		DefaultLabelValue   string
+	}
+	var got []inherited
+	for _, f := range plan.families {
+		for _, m := range f.metrics {
+			resolverType := ResolverTypeUnstructured
+			if _, ok := m.resolver.(*resolver.CELResolver); ok {
+				resolverType = ResolverTypeCEL
+			}
+			got = append(got, inherited{string(resolverType), m.labelKeys, m.labelValues, m.onResolutionFailure, m.defaultValue, m.defaultLabelValue})
+		}
+	}
+	want := []inherited{
+		{
+			Resolver:            string(ResolverTypeCEL),
+			LabelKeys:           []string{"app_kubernetes_io_name", "namespace"},
+			LabelValues:         []string{"o.metadata.name", "o.metadata.namespace"},
+			OnResolutionFailure: ResolutionFailurePolicySkipSeries,
+			DefaultValue:        "1",
+			DefaultLabelValue:   "unknown",
+		},
+		{
+			Resolver:            string(ResolverTypeUnstructured),
+			LabelKeys:           []string{"name", kubeCustomResourcePrefix + "overridden", "namespace"},
+			LabelValues:         []string{"metadata.name", "status.phase", "o.metadata.namespace"},
+			OnResolutionFailure: ResolutionFailurePolicyDefaultValue,
+			DefaultValue:        "2",
+			DefaultLabelValue:   "unknown",
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected inheritance (-want +got):\n%s", diff)
+	}
+
+	// The CEL queries' paths are known, so the plan depends on them alone.
+	if !plan.dependenciesKnown || plan.metadataOnly {
+		t.Fatalf("got dependenciesKnown %t and metadataOnly %t, want true and false", plan.dependenciesKnown, plan.metadataOnly)
+	}
+}
+
+func TestStorePlanCompileErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name            string
+		family          *FamilyType
+		resolverOptions resolver.Options
+	}{
+		{
+			name: "mismatched inherited labels",
+			family: &FamilyType{
+				LabelKeys: []string{"foo"},
+				Metrics: []*MetricType{{
+					LabelKeys:   []string{"bar"},
+					LabelValues: []string{"metadata.name"},
+					Value:       "spec.replicas",
+				}},
+			},
+		},
+		{
+			name: "stateset without a state label",
+			family: &FamilyType{
+				Kind: FamilyKindStateSet,
+				Metrics: []*MetricType{{
+					LabelKeys:   []string{"bar"},
+					LabelValues: []string{"metadata.name"},
+					Value:       "spec.replicas",
+				}},
+			},
+		},
+		{
+			name: "unknown resolver",
+			family: &FamilyType{
+				Resolver: "unknown",
+				Metrics:  []*MetricType{{Value: "spec.replicas"}},
+			},
+		},
+		{
+			name: "query exceeding the cost limit",
+			family: &FamilyType{
+				Resolver: ResolverTypeCEL,
+				Metrics:  []*MetricType{{Value: "o.spec.replicas + o.spec.replicas"}},
+			},
+			resolverOptions: resolver.Options{CEL: resolver.CELOptions{CostLimit: 1}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			tc.family.Name, tc.family.Help = "foo", "Foo"
+			tc.resolverOptions.Logger = klog.Background()
+			if _, err := newStorePlan(&StoreType{Families: []*FamilyType{tc.family}}, tc.resolverOptions); err == nil {
+				t.Fatal("got no error compiling the plan")
+			}
+		})
+	}
+}
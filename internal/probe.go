@@ -17,11 +17,10 @@ limitations under the License.
 package internal
 
 import (
-	"context"
 	"fmt"
 	"net/http"
+	"strings"
 
-	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
 )
 
@@ -34,8 +33,8 @@ type probe interface {
 	// getAsString returns the string representation of the probe.
 	getAsString() string
 
-	// Probe knows how to handle a health probe.
-	probe(ctx context.Context, logger klog.Logger, client kubernetes.Interface) http.Handler
+	// Probe knows how to handle a health probe, by running its checks against the controller's health.
+	probe(logger klog.Logger, health *controllerHealth) http.Handler
 }
 
 // healthz implements the probe interface.
@@ -66,9 +65,9 @@ func (h healthz) getAsString() string {
 	return h.asString
 }
 
-// Probe returns a healthz probe.
-func (h healthz) probe(ctx context.Context, logger klog.Logger, client kubernetes.Interface) http.Handler {
-	return genericProbe(ctx, h, logger, client)
+// Probe returns a healthz probe, that runs all checks.
+func (h healthz) probe(logger klog.Logger, health *controllerHealth) http.Handler {
+	return genericProbe(h, logger, health.checks())
 }
 
 // livez implements the probe interface.
@@ -99,9 +98,9 @@ func (l livez) getAsString() string {
 	return l.asString
 }
 
-// Probe returns a livez probe.
-func (l livez) probe(ctx context.Context, logger klog.Logger, client kubernetes.Interface) http.Handler {
-	return genericProbe(ctx, l, logger, client)
+// Probe returns a livez probe, that runs the liveness checks.
+func (l livez) probe(logger klog.Logger, health *controllerHealth) http.Handler {
+	return genericProbe(l, logger, health.livenessChecks())
 }
 
 // readyz implements the probe interface.
@@ -132,31 +131,53 @@ func (r readyz) getAsString() string {
 	return r.asString
 }
 
-// Probe returns a readyz probe.
-func (r readyz) probe(ctx context.Context, logger klog.Logger, client kubernetes.Interface) http.Handler {
-	return genericProbe(ctx, r, logger, client)
-}
-
-// genericProbe returns an http.Handler that delegates probes to the Kubernetes API.
-func genericProbe(ctx context.Context, p probe, logger klog.Logger, client kubernetes.Interface) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
-		got := client.CoreV1().RESTClient().Get().AbsPath(p.getAsString()).Do(ctx)
-		if got.Error() != nil {
-			w.WriteHeader(http.StatusServiceUnavailable)
-			n, err := w.Write([]byte(http.StatusText(http.StatusServiceUnavailable)))
-			if err != nil {
-				logger.Error(err, fmt.Sprintf("error writing response after %d bytes", n), "probeType", p.getAsString(), "source", p.getSource())
+// Probe returns a readyz probe, that runs the readiness checks.
+func (r readyz) probe(logger klog.Logger, health *controllerHealth) http.Handler {
+	return genericProbe(r, logger, health.readinessChecks())
+}
+
+// genericProbe returns an http.Handler that runs the given checks, in the style of the Kubernetes healthz package. A
+// passing probe responds with "ok", or with the status of each check if the `verbose` query parameter is set. A failing
+// probe always responds with the status of each check, with the reasons of failing checks withheld unless verbose.
+func genericProbe(p probe, logger klog.Logger, checks []healthCheck) http.Handler {
+	name := strings.TrimPrefix(p.getAsString(), "/")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, verbose := r.URL.Query()["verbose"]
+		var output strings.Builder
+		failed := false
+		for _, c := range checks {
+			if err := c.check(); err != nil {
+				failed = true
+				logger.V(1).Info("Health check failed", "probeType", p.getAsString(), "source", p.getSource(), "check", c.name, "err", err)
+				reason := "reason withheld"
+				if verbose {
+					reason = err.Error()
+				}
+				fmt.Fprintf(&output, "[-]%s failed: %s\n", c.name, reason)
+
+				continue
 			}
-
-			return
+			fmt.Fprintf(&output, "[+]%s ok\n", c.name)
 		}
 
-		w.WriteHeader(http.StatusOK)
-		n, err := w.Write([]byte(http.StatusText(http.StatusOK)))
+		status := http.StatusOK
+		switch {
+		case failed:
+			status = http.StatusServiceUnavailable
+			fmt.Fprintf(&output, "%s check failed\n", name)
+		case verbose:
+			fmt.Fprintf(&output, "%s check passed\n", name)
+		default:
+			output.Reset()
+			output.WriteString("ok")
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(status)
+		n, err := w.Write([]byte(output.String()))
 		if err != nil {
 			logger.Error(err, fmt.Sprintf("error writing response after %d bytes", n), "probeType", p.getAsString(), "source", p.getSource())
-
-			return
 		}
 	})
 }
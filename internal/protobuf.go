@@ -0,0 +1,97 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"fmt"
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog/v2"
+)
+
+// A delimited protobuf exposition is a sequence of length-prefixed MetricFamily messages. Since protobuf messages are
+// the concatenation of their encoded fields, and repeated fields may be encoded piecewise, a family's message is built
+// by concatenating its encoded header fields (name, help, and type), with the encoded metric fields of each store that
+// contributes to it, without re-encoding either.
+
+// buildProtobufHeaders generates the encoded header fields for the given family, in line with buildHeaders.
+func buildProtobufHeaders(name, help string) ([]byte, error) {
+	header, err := proto.Marshal(&dto.MetricFamily{
+		Name: proto.String(kubeCustomResourcePrefix + name),
+		Help: proto.String(help),
+		Type: dto.MetricType_GAUGE.Enum(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error encoding protobuf header: %w", err)
+	}
+
+	return header, nil
+}
+
+// gvkLabels is the number of GVK labels that follow the labels of each series.
+const gvkLabels = 3
+
+// newProtobufMetric returns the given series, as written by writeMetricTo, i.e., with its labels sorted and followed by
+// the GVK labels, as a protobuf metric.
+func newProtobufMetric(gvk schema.GroupVersionKind, value float64, resolvedLabelKeys, resolvedLabelValues []string) *dto.Metric {
+	labels := make([]*dto.LabelPair, 0, len(resolvedLabelKeys)+gvkLabels)
+	for i := range resolvedLabelKeys {
+		labels = append(labels, &dto.LabelPair{Name: proto.String(resolvedLabelKeys[i]), Value: proto.String(resolvedLabelValues[i])})
+	}
+	labels = append(labels,
+		&dto.LabelPair{Name: proto.String("group"), Value: proto.String(gvk.Group)},
+		&dto.LabelPair{Name: proto.String("version"), Value: proto.String(gvk.Version)},
+		&dto.LabelPair{Name: proto.String("kind"), Value: proto.String(gvk.Kind)},
+	)
+
+	return &dto.Metric{Label: labels, Gauge: &dto.Gauge{Value: proto.Float64(value)}}
+}
+
+// protobufSeries lazily encodes a family's series into metric fields, once per rendered block, i.e., only when a
+// protobuf scrape needs them, and only once for all scrapes until the block is rebuilt. This keeps the cost off the
+// text path.
+type protobufSeries struct {
+
+	// once guards the encoding.
+	once sync.Once
+
+	// metrics are the family's series, as rendered along with their exposition. They must not be modified.
+	metrics []*dto.Metric
+
+	// encoded are the encoded metric fields.
+	encoded []byte
+}
+
+// encode returns the family's series as encoded metric fields.
+func (p *protobufSeries) encode(logger klog.Logger) []byte {
+	p.once.Do(func() {
+		if len(p.metrics) == 0 {
+			return
+		}
+		var err error
+		p.encoded, err = proto.Marshal(&dto.MetricFamily{Metric: p.metrics})
+		if err != nil {
+			logger.Error(fmt.Errorf("error encoding protobuf series: %w", err), "skipping family under protobuf")
+			p.encoded = nil
+		}
+	})
+
+	return p.encoded
+}
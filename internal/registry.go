@@ -0,0 +1,153 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// storeRegistry records all stores associated with each managed resource, indexed by the resource's key. It is shared
+// between the controller's workers, that modify it, and the main server, that reads it on every scrape.
+//
+// Modifications are copy-on-write: writers serialize among themselves and publish a new snapshot, while readers load the
+// current snapshot without any locking. Snapshots must never be modified once published.
+type storeRegistry struct {
+
+	// writeMutex serializes writers.
+	writeMutex sync.Mutex
+
+	// current is the most recently published snapshot.
+	current atomic.Pointer[registrySnapshot]
+}
+
+// registrySnapshot is a read-only view of the registry.
+type registrySnapshot struct {
+
+	// stores are the stores associated with each resource key.
+	stores map[string][]*StoreType
+
+	// keys are the resource keys, in the order of compareObjectKeys. They are kept sorted as resources are added and
+	// dropped, so that readers can write out resources in a stable order without sorting them.
+	keys []string
+}
+
+// newStoreRegistry returns a new, empty storeRegistry.
+func newStoreRegistry() *storeRegistry {
+	r := &storeRegistry{}
+	r.current.Store(&registrySnapshot{stores: map[string][]*StoreType{}})
+
+	return r
+}
+
+// snapshot returns the current, read-only, view of the registry.
+func (r *storeRegistry) snapshot() *registrySnapshot {
+	return r.current.Load()
+}
+
+// get returns the stores associated with the given resource key.
+func (r *storeRegistry) get(key string) []*StoreType {
+	return r.snapshot().stores[key]
+}
+
+// keys returns the sorted keys of all resources with associated stores.
+func (r *storeRegistry) keys() []string {
+	return r.snapshot().keys
+}
+
+// swap associates the given stores with the given resource key in place of the given existing ones, only if those are
+// still the ones associated with it. It reports whether the stores were swapped.
+func (r *storeRegistry) swap(key string, existing []*StoreType, stores ...*StoreType) bool {
+	swapped := false
+	r.update(key, func(current []*StoreType, exists bool) ([]*StoreType, bool) {
+		if !slices.Equal(current, existing) {
+			return current, exists
+		}
+		swapped = true
+
+		return stores, true
+	})
+
+	return swapped
+}
+
+// drop disassociates all stores from the given resource key, and returns them. The caller is responsible for stopping
+// the returned stores.
+func (r *storeRegistry) drop(key string) []*StoreType {
+	var dropped []*StoreType
+	r.update(key, func(current []*StoreType, _ bool) ([]*StoreType, bool) {
+		dropped = current
+
+		return nil, false
+	})
+
+	return dropped
+}
+
+// update publishes a new snapshot, derived from a copy of the current one, with the stores associated with the given
+// resource key replaced by the ones returned by the given function. The key is dropped if keep is false.
+func (r *storeRegistry) update(key string, mutate func(current []*StoreType, exists bool) (next []*StoreType, keep bool)) {
+	r.writeMutex.Lock()
+	defer r.writeMutex.Unlock()
+
+	current := r.snapshot()
+	next := &registrySnapshot{
+		stores: make(map[string][]*StoreType, len(current.stores)),
+		keys:   current.keys,
+	}
+	for k, stores := range current.stores {
+		next.stores[k] = stores
+	}
+	currentStores, exists := current.stores[key]
+	nextStores, keep := mutate(currentStores, exists)
+	if keep {
+		next.stores[key] = nextStores
+	} else {
+		delete(next.stores, key)
+	}
+
+	// Keep the keys sorted, without modifying the ones shared with the current snapshot.
+	i, _ := slices.BinarySearchFunc(current.keys, key, compareObjectKeys)
+	switch {
+	case keep && !exists:
+		next.keys = slices.Insert(slices.Clip(current.keys), i, key)
+	case !keep && exists:
+		next.keys = slices.Delete(slices.Clone(current.keys), i, i+1)
+	}
+	r.current.Store(next)
+}
+
+// compareObjectKeys orders the given object keys by namespace, and then by name.
+func compareObjectKeys(a, b string) int {
+	aNamespace, aName := splitObjectKey(a)
+	bNamespace, bName := splitObjectKey(b)
+
+	return cmp.Or(strings.Compare(aNamespace, bNamespace), strings.Compare(aName, bName))
+}
+
+// splitObjectKey returns the namespace and name of the given object key. Cluster-scoped objects have no namespace.
+func splitObjectKey(key string) (namespace, name string) {
+	namespace, name, found := strings.Cut(key, "/")
+	if !found {
+		return "", key
+	}
+
+	return namespace, name
+}
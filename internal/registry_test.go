@@ -0,0 +1,225 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/rexagod/crdmetrics/pkg/resolver"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/klog/v2"
+)
+
+// newTestFamily returns a family with the given name and help text, of the replicas of each Foo object, by name.
+func newTestFamily(name, help string) *FamilyType {
+	return &FamilyType{
+		Name: name,
+		Help: help,
+		Metrics: []*MetricType{{
+			LabelKeys:   []string{"name"},
+			LabelValues: []string{"metadata.name"},
+			Value:       "spec.replicas",
+		}},
+	}
+}
+
+// newTestStore returns a store of Foo objects, that is not backed by a reflector, populated with the given objects. The
+// store has the given families, or a single family of the objects' replicas if none are given.
+func newTestStore(t *testing.T, families []*FamilyType, objects ...*unstructured.Unstructured) *StoreType {
+	t.Helper()
+
+	if len(families) == 0 {
+		families = []*FamilyType{newTestFamily("foo_replicas", "Number of replicas for each Foo instance")}
+	}
+	plan, err := newStorePlan(&StoreType{
+		Group:    "samplecontroller.k8s.io",
+		Version:  "v1alpha1",
+		Kind:     "Foo",
+		Families: families,
+	}, resolver.Options{Logger: klog.Background()})
+	if err != nil {
+		t.Fatalf("failed to compile plan: %v", err)
+	}
+	s := newStore(context.Background(), klog.Background(), plan)
+	for _, object := range objects {
+		addTestObject(t, s, object)
+	}
+
+	return s
+}
+
+// addTestObject adds the given object to the given store, which caches it, since it is not backed by an informer.
+func addTestObject(t *testing.T, s *StoreType, object *unstructured.Unstructured) {
+	t.Helper()
+
+	if err := s.Add(object); err != nil {
+		t.Fatalf("failed to add object: %v", err)
+	}
+}
+
+// newTestObject returns a Foo object with the given name and replicas.
+func newTestObject(name string, replicas int64) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "samplecontroller.k8s.io/v1alpha1",
+		"kind":       "Foo",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": "default",
+		},
+		"spec": map[string]interface{}{
+			"replicas": replicas,
+		},
+	}}
+}
+
+func TestStoreRegistry(t *testing.T) {
+	t.Parallel()
+
+	registry := newStoreRegistry()
+	s0, s1, s2, s3 := newTestStore(t, nil), newTestStore(t, nil), newTestStore(t, nil), newTestStore(t, nil)
+
+	if !registry.swap("ns/a", nil, s0) {
+		t.Fatal("failed to swap in stores for ns/a")
+	}
+	if registry.swap("ns/a", nil, s1, s2) {
+		t.Fatal("swapped out stores for ns/a that were not expected")
+	}
+	if !registry.swap("ns/a", []*StoreType{s0}, s1, s2) {
+		t.Fatal("failed to swap out stores for ns/a")
+	}
+	if !registry.swap("ns/b", nil, s3) {
+		t.Fatal("failed to swap in stores for ns/b")
+	}
+	before := registry.snapshot()
+
+	if got, want := registry.get("ns/a"), []*StoreType{s1, s2}; !slices.Equal(got, want) {
+		t.Fatalf("got stores %v for ns/a, want %v", got, want)
+	}
+	if got, want := registry.keys(), []string{"ns/a", "ns/b"}; !slices.Equal(got, want) {
+		t.Fatalf("got keys %v, want %v", got, want)
+	}
+
+	if got, want := registry.drop("ns/a"), []*StoreType{s1, s2}; !slices.Equal(got, want) {
+		t.Fatalf("got dropped stores %v for ns/a, want %v", got, want)
+	}
+	if got := registry.drop("ns/a"); got != nil {
+		t.Fatalf("got dropped stores %v for ns/a, want none", got)
+	}
+	if got, want := registry.keys(), []string{"ns/b"}; !slices.Equal(got, want) {
+		t.Fatalf("got keys %v, want %v", got, want)
+	}
+
+	// Previously published snapshots must remain unaffected.
+	if got, want := len(before.keys), 2; got != want {
+		t.Fatalf("got %d keys in the earlier snapshot, want %d", got, want)
+	}
+	if got, want := before.stores["ns/a"], []*StoreType{s1, s2}; !slices.Equal(got, want) {
+		t.Fatalf("got stores %v for ns/a in the earlier snapshot, want %v", got, want)
+	}
+}
+
+func TestStoreRegistryKeysOrder(t *testing.T) {
+	t.Parallel()
+
+	registry := newStoreRegistry()
+	for _, key := range []string{"b/foo", "a-b/foo", "cluster-scoped", "a/foo", "a/bar"} {
+		registry.swap(key, nil, newTestStore(t, nil))
+	}
+	registry.drop("a/foo")
+	if got, want := registry.keys(), []string{"cluster-scoped", "a/bar", "a-b/foo", "b/foo"}; !slices.Equal(got, want) {
+		t.Fatalf("got keys %v, want %v", got, want)
+	}
+}
+
+// TestStoreRegistryConcurrentAccess exercises the registry the way the controller does, i.e., with workers adding and
+// dropping stores, reflectors updating them, and scrapes writing them out, all at once. It is meant to be run under the
+// race detector.
+func TestStoreRegistryConcurrentAccess(t *testing.T) {
+	t.Parallel()
+
+	const (
+		workers    = 4
+		scrapers   = 4
+		iterations = 100
+	)
+
+	registry := newStoreRegistry()
+	var wg sync.WaitGroup
+
+	// Workers (re)build and drop stores, while reflectors populate them.
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := fmt.Sprintf("ns/resource-%d", i)
+			for j := range iterations {
+				s := newTestStore(t, nil)
+				if j%10 == 0 {
+					registry.drop(key)
+				}
+				registry.swap(key, registry.get(key), s)
+				if err := s.Add(newTestObject(fmt.Sprintf("foo-%d", j), int64(j))); err != nil {
+					t.Errorf("failed to add object: %v", err)
+
+					return
+				}
+				if err := s.update(newTestObject(fmt.Sprintf("foo-%d", j), int64(j)), newTestObject(fmt.Sprintf("foo-%d", j), int64(j+1))); err != nil {
+					t.Errorf("failed to update object: %v", err)
+
+					return
+				}
+				if j%2 == 0 {
+					if err := s.Delete(newTestObject(fmt.Sprintf("foo-%d", j), int64(j+1))); err != nil {
+						t.Errorf("failed to delete object: %v", err)
+
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	// Scrapes write out all stores in the current snapshot.
+	for range scrapers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range iterations {
+				for _, stores := range registry.snapshot().stores {
+					if err := newMetricsWriter(stores...).writeAllTo(io.Discard); err != nil {
+						t.Errorf("failed to write metrics: %v", err)
+
+						return
+					}
+					for _, s := range stores {
+						s.introspect()
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, want := len(registry.keys()), workers; got != want {
+		t.Fatalf("got %d keys, want %d", got, want)
+	}
+}
@@ -0,0 +1,225 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/rexagod/crdmetrics/internal/version"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// remoteWriteVersion is the version of the remote-write protocol that is pushed.
+const remoteWriteVersion = "0.1.0"
+
+// remoteWriter periodically pushes the metrics of all stores, as of the registry's current snapshot, to a Prometheus
+// remote-write endpoint. Samples are timestamped with the time of the push, and are sent in batches, each of which is
+// retried with an exponential backoff, and dropped once retries run out. Series that disappear between pushes are not
+// marked stale, and, as with scrapes, go stale on the receiving end after its lookback period.
+type remoteWriter struct {
+
+	// endpoint is the remote-write endpoint.
+	endpoint string
+
+	// client is the HTTP client that requests are sent with.
+	client *http.Client
+
+	// registry is the store registry whose stores are pushed.
+	registry *storeRegistry
+
+	// interval is the interval that pushes are made at.
+	interval time.Duration
+
+	// batchSize is the maximum number of samples per request.
+	batchSize int
+
+	// backoff is the backoff between retries of a request. Its steps are the number of attempts.
+	backoff wait.Backoff
+
+	// telemetry holds the self metrics that pushes report to.
+	telemetry *telemetry
+}
+
+// newRemoteWriter returns a new remoteWriter for the given options.
+func newRemoteWriter(registry *storeRegistry, telemetry *telemetry, options *Options) (*remoteWriter, error) {
+	endpoint, err := url.Parse(*options.RemoteWriteURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote-write URL: %w", err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("invalid remote-write URL %q: expected an http or https scheme", *options.RemoteWriteURL)
+	}
+	if *options.RemoteWriteInterval <= 0 || *options.RemoteWriteBatchSize <= 0 || *options.RemoteWriteMaxRetries < 0 {
+		return nil, errors.New("expected a positive remote-write interval and batch size, and non-negative retries")
+	}
+
+	return &remoteWriter{
+		endpoint:  endpoint.String(),
+		client:    &http.Client{Timeout: *options.RemoteWriteInterval},
+		registry:  registry,
+		interval:  *options.RemoteWriteInterval,
+		batchSize: *options.RemoteWriteBatchSize,
+		backoff: wait.Backoff{
+			Duration: *options.RemoteWriteMinBackoff,
+			Factor:   2,
+			Jitter:   0.1,
+			Steps:    *options.RemoteWriteMaxRetries + 1,
+			Cap:      *options.RemoteWriteMaxBackoff,
+		},
+		telemetry: telemetry,
+	}, nil
+}
+
+// run pushes at the configured interval, until the given context is done.
+func (w *remoteWriter) run(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		ctx, cancel := context.WithTimeout(ctx, w.interval)
+		defer cancel()
+
+		if err := w.push(ctx); err != nil {
+			logger.Error(err, "error pushing metrics", "endpoint", w.endpoint)
+		}
+	}, w.interval)
+}
+
+// push sends the current samples of all stores, in batches. All batches are attempted, even if some fail.
+func (w *remoteWriter) push(ctx context.Context) error {
+	snapshot := w.registry.snapshot()
+	var stores []*StoreType
+	for _, key := range snapshot.keys {
+		stores = append(stores, snapshot.stores[key]...)
+	}
+	series := collectTimeSeries(newMetricsWriter(stores...), time.Now().UnixMilli())
+
+	var errs []error
+	for start := 0; start < len(series); start += w.batchSize {
+		batch := series[start:min(start+w.batchSize, len(series))]
+		if err := w.send(ctx, batch); err != nil {
+			w.telemetry.remoteWriteSamplesFailedTotal.Add(float64(len(batch)))
+			errs = append(errs, err)
+
+			continue
+		}
+		w.telemetry.remoteWriteSamplesSentTotal.Add(float64(len(batch)))
+	}
+
+	return errors.Join(errs...)
+}
+
+// send sends the given batch, retrying it on network errors, and on 429 and 5xx responses, as per the backoff.
+func (w *remoteWriter) send(ctx context.Context, batch []prompb.TimeSeries) error {
+	raw, err := (&prompb.WriteRequest{Timeseries: batch}).Marshal()
+	if err != nil {
+		return fmt.Errorf("error encoding remote-write request: %w", err)
+	}
+	compressed := snappy.Encode(nil, raw)
+
+	var lastErr error
+	attempts := 0
+	err = wait.ExponentialBackoffWithContext(ctx, w.backoff, func(ctx context.Context) (bool, error) {
+		if attempts > 0 {
+			w.telemetry.remoteWriteRetriesTotal.Inc()
+		}
+		attempts++
+		retryable, err := w.attempt(ctx, compressed)
+		if err == nil {
+			return true, nil
+		}
+		if !retryable {
+			return false, err
+		}
+		lastErr = err
+
+		return false, nil
+	})
+	if wait.Interrupted(err) && lastErr != nil {
+		return fmt.Errorf("error sending remote-write request after %d attempts: %w", attempts, lastErr)
+	}
+	if err != nil {
+		return fmt.Errorf("error sending remote-write request: %w", err)
+	}
+
+	return nil
+}
+
+// attempt makes a single request with the given compressed payload, and returns whether it may be retried if it failed.
+func (w *remoteWriter) attempt(ctx context.Context, compressed []byte) (bool, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, w.endpoint, bytes.NewReader(compressed))
+	if err != nil {
+		return false, fmt.Errorf("error creating remote-write request: %w", err)
+	}
+	request.Header.Set("Content-Encoding", "snappy")
+	request.Header.Set("Content-Type", "application/x-protobuf")
+	request.Header.Set("User-Agent", version.ControllerName)
+	request.Header.Set("X-Prometheus-Remote-Write-Version", remoteWriteVersion)
+	response, err := w.client.Do(request)
+	if err != nil {
+		return true, fmt.Errorf("error sending remote-write request: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode/100 == 2 {
+		return false, nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+	err = fmt.Errorf("remote-write endpoint returned status %s: %s", response.Status, bytes.TrimSpace(body))
+
+	return response.StatusCode == http.StatusTooManyRequests || response.StatusCode/100 == 5, err
+}
+
+// collectTimeSeries returns the samples of the families that the given writer writes out, with the given timestamp.
+// Samples are built from the series as resolved, rather than from their exposition.
+func collectTimeSeries(m *metricsWriter, timestamp int64) []prompb.TimeSeries {
+	var series []prompb.TimeSeries
+	builder := labels.NewScratchBuilder(0)
+	for _, group := range m.groups() {
+		for _, f := range group.families {
+			metrics, _ := filterMetrics(f, group.selectors)
+			for _, metric := range metrics {
+				builder.Reset()
+				builder.Add(labels.MetricName, f.sampleName)
+				for _, label := range metric.GetLabel() {
+					builder.Add(label.GetName(), label.GetValue())
+				}
+				builder.Sort()
+				lset := builder.Labels()
+				ts := prompb.TimeSeries{
+					Labels:  make([]prompb.Label, 0, lset.Len()),
+					Samples: []prompb.Sample{{Value: metric.GetGauge().GetValue(), Timestamp: timestamp}},
+				}
+				lset.Range(func(l labels.Label) {
+					ts.Labels = append(ts.Labels, prompb.Label{Name: l.Name, Value: l.Value})
+				})
+				series = append(series, ts)
+			}
+		}
+	}
+
+	return series
+}
@@ -0,0 +1,233 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/prompb"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// remoteWriteReceiver is an in-process remote-write endpoint, that responds with the given statuses in order, and then
+// with 204s, and records the names of the objects in the samples it accepted.
+type remoteWriteReceiver struct {
+	mutex    sync.Mutex
+	statuses []int
+	requests int
+	names    []string
+}
+
+// ServeHTTP decodes and records remote-write requests.
+func (r *remoteWriteReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.requests++
+	if len(r.statuses) > 0 {
+		status := r.statuses[0]
+		r.statuses = r.statuses[1:]
+		if status != http.StatusNoContent {
+			http.Error(w, http.StatusText(status), status)
+
+			return
+		}
+	}
+	if req.Header.Get("Content-Encoding") != "snappy" || req.Header.Get("X-Prometheus-Remote-Write-Version") != remoteWriteVersion {
+		http.Error(w, "unexpected headers", http.StatusBadRequest)
+
+		return
+	}
+	compressed, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	raw, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	writeRequest := &prompb.WriteRequest{}
+	if err = writeRequest.Unmarshal(raw); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	for _, ts := range writeRequest.GetTimeseries() {
+		for _, l := range ts.GetLabels() {
+			if l.GetName() == "name" {
+				r.names = append(r.names, l.GetValue())
+			}
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func TestRemoteWriterPush(t *testing.T) {
+	t.Parallel()
+
+	registry := newStoreRegistry()
+	registry.swap("foo", nil, newTestStore(t, []*FamilyType{newTestFamily("foo_replicas", "Replicas")}, newTestObject("a", 1)))
+	registry.swap("bar", nil, newTestStore(t, []*FamilyType{newTestFamily("bar_replicas", "Replicas")}, newTestObject("b", 1)))
+
+	for _, tc := range []struct {
+		name        string
+		statuses    []int
+		maxRetries  int
+		wantNames   []string
+		wantSent    float64
+		wantFailed  float64
+		wantRetries float64
+	}{
+		{
+			name:      "accepted",
+			wantNames: []string{"b", "a"},
+			wantSent:  2,
+		},
+		{
+			name:        "retried",
+			statuses:    []int{http.StatusServiceUnavailable, http.StatusTooManyRequests},
+			maxRetries:  2,
+			wantNames:   []string{"b", "a"},
+			wantSent:    2,
+			wantRetries: 2,
+		},
+		{
+			name:        "out of retries",
+			statuses:    []int{http.StatusInternalServerError, http.StatusInternalServerError},
+			maxRetries:  1,
+			wantNames:   []string{"a"},
+			wantSent:    1,
+			wantFailed:  1,
+			wantRetries: 1,
+		},
+		{
+			name:       "not retryable",
+			statuses:   []int{http.StatusBadRequest},
+			maxRetries: 2,
+			wantNames:  []string{"a"},
+			wantSent:   1,
+			wantFailed: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			receiver := &remoteWriteReceiver{statuses: tc.statuses}
+			server := httptest.NewServer(receiver)
+			t.Cleanup(server.Close)
+
+			// Send each sample in its own batch.
+			endpoint, interval, batchSize := server.URL, time.Minute, 1
+			minBackoff, maxBackoff := time.Millisecond, 10*time.Millisecond
+			w, err := newRemoteWriter(registry, newTelemetry(), &Options{
+				RemoteWriteURL:        &endpoint,
+				RemoteWriteInterval:   &interval,
+				RemoteWriteBatchSize:  &batchSize,
+				RemoteWriteMaxRetries: &tc.maxRetries,
+				RemoteWriteMinBackoff: &minBackoff,
+				RemoteWriteMaxBackoff: &maxBackoff,
+			})
+			if err != nil {
+				t.Fatalf("failed to create remote writer: %v", err)
+			}
+			err = w.push(context.Background())
+			if gotErr, wantErr := err != nil, tc.wantFailed > 0; gotErr != wantErr {
+				t.Fatalf("got error %v, want error %t", err, wantErr)
+			}
+			if !slices.Equal(receiver.names, tc.wantNames) {
+				t.Errorf("got samples for %q, want %q", receiver.names, tc.wantNames)
+			}
+			if got := testutil.ToFloat64(w.telemetry.remoteWriteSamplesSentTotal); got != tc.wantSent {
+				t.Errorf("got %v samples sent, want %v", got, tc.wantSent)
+			}
+			if got := testutil.ToFloat64(w.telemetry.remoteWriteSamplesFailedTotal); got != tc.wantFailed {
+				t.Errorf("got %v samples failed, want %v", got, tc.wantFailed)
+			}
+			if got := testutil.ToFloat64(w.telemetry.remoteWriteRetriesTotal); got != tc.wantRetries {
+				t.Errorf("got %v retries, want %v", got, tc.wantRetries)
+			}
+		})
+	}
+}
+
+func TestNewRemoteWriterValidatesOptions(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		endpoint string
+		wantErr  bool
+	}{
+		{endpoint: "http://localhost:9090/api/v1/write"},
+		{endpoint: "localhost:9090", wantErr: true},
+		{endpoint: "ftp://localhost/write", wantErr: true},
+	} {
+		interval, batchSize, maxRetries, backoff := time.Second, 1, 0, time.Second
+		_, err := newRemoteWriter(newStoreRegistry(), newTelemetry(), &Options{
+			RemoteWriteURL:        &tc.endpoint,
+			RemoteWriteInterval:   &interval,
+			RemoteWriteBatchSize:  &batchSize,
+			RemoteWriteMaxRetries: &maxRetries,
+			RemoteWriteMinBackoff: &backoff,
+			RemoteWriteMaxBackoff: &backoff,
+		})
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("%s: got error %v, want error %t", tc.endpoint, err, tc.wantErr)
+		}
+	}
+}
+
+func TestCollectTimeSeries(t *testing.T) {
+	t.Parallel()
+
+	// Values are pushed as resolved, rather than as written out in the text exposition.
+	object := newTestObject("a", 1)
+	if err := unstructured.SetNestedField(object.Object, 1e-9, "spec", "replicas"); err != nil {
+		t.Fatalf("failed to set replicas: %v", err)
+	}
+	s := newTestStore(t, nil, object)
+	series := collectTimeSeries(newMetricsWriter(s), 1700000000000)
+	if len(series) != 1 {
+		t.Fatalf("got %d series, want 1", len(series))
+	}
+	want := []prompb.Label{
+		{Name: "__name__", Value: "kube_customresource_foo_replicas"},
+		{Name: "group", Value: "samplecontroller.k8s.io"},
+		{Name: "kind", Value: "Foo"},
+		{Name: "name", Value: "a"},
+		{Name: "version", Value: "v1alpha1"},
+	}
+	if got := series[0].GetLabels(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got labels %v, want %v", got, want)
+	}
+	if got, want := series[0].GetSamples(), []prompb.Sample{{Value: 1e-9, Timestamp: 1700000000000}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got samples %v, want %v", got, want)
+	}
+}
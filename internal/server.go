@@ -24,22 +24,19 @@ import (
 	"net/http"
 	"net/http/pprof"
 	"os"
-	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/expfmt"
-	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
 )
 
 // server defines behaviours for a Prometheus-based exposition server.
 type server interface {
 
-	// Build sets up the server with the given gatherer.
-	build(ctx context.Context, client kubernetes.Interface, gatherer prometheus.Gatherer) *http.Server
+	// Build sets up the server with the given gatherer, and with probes that check the given controller health.
+	build(ctx context.Context, health *controllerHealth, gatherer prometheus.Gatherer) *http.Server
 }
 
 // selfServer implements the server interface, and exposes telemetry metrics.
@@ -48,6 +45,12 @@ type selfServer struct {
 
 	// addr is the http.Server address to listen on.
 	addr string
+
+	// registry records the currently active stores per resource, for introspection.
+	registry *storeRegistry
+
+	// introspection is set if the stores, and the series of their objects, are introspected on the debug paths.
+	introspection bool
 }
 
 // mainServer implements the server interface, and exposes resource metrics.
@@ -57,13 +60,16 @@ type mainServer struct {
 	// addr is the http.Server address to listen on.
 	addr string
 
-	// m is the map of currently active stores per resource.
-	m map[types.UID][]*StoreType
+	// registry records the currently active stores per resource.
+	registry *storeRegistry
 
 	// requestsDurationVec is a histogram denoting the request durations for the metrics endpoint. The metric itself is
 	// registered in the telemetry registry, and will be available along with all other main metrics, to not pollute the
 	// resource metrics.
 	requestsDurationVec *prometheus.ObserverVec
+
+	// encodings are the content codings responses may be compressed with, in the order of preference.
+	encodings []string
 }
 
 // Ensure that selfServer implements the server interface.
@@ -72,18 +78,23 @@ var _ server = &selfServer{}
 // Ensure that mainServer implements the server interface.
 var _ server = &mainServer{}
 
-// newSelfServer returns a new selfServer.
-func newSelfServer(addr string) *selfServer {
-	return &selfServer{promHTTPLogger{"self"}, addr}
+// newSelfServer returns a new selfServer, that serves the introspection paths if enabled.
+func newSelfServer(addr string, registry *storeRegistry, introspection bool) *selfServer {
+	return &selfServer{promHTTPLogger{"self"}, addr, registry, introspection}
 }
 
-// newMainServer returns a new mainServer.
-func newMainServer(addr string, m map[types.UID][]*StoreType, requestsDurationVec prometheus.ObserverVec) *mainServer {
-	return &mainServer{promHTTPLogger{"main"}, addr, m, &requestsDurationVec}
+// newMainServer returns a new mainServer, that compresses responses with zstd as well as gzip if enabled.
+func newMainServer(addr string, registry *storeRegistry, requestsDurationVec prometheus.ObserverVec, zstd bool) *mainServer {
+	encodings := []string{encodingGzip}
+	if zstd {
+		encodings = []string{encodingZstd, encodingGzip}
+	}
+
+	return &mainServer{promHTTPLogger{"main"}, addr, registry, &requestsDurationVec, encodings}
 }
 
 // Build sets up the selfServer with the given gatherer.
-func (s *selfServer) build(ctx context.Context, client kubernetes.Interface, gatherer prometheus.Gatherer) *http.Server {
+func (s *selfServer) build(ctx context.Context, health *controllerHealth, gatherer prometheus.Gatherer) *http.Server {
 	logger := klog.FromContext(ctx)
 	mux := http.NewServeMux()
 
@@ -94,6 +105,13 @@ func (s *selfServer) build(ctx context.Context, client kubernetes.Interface, gat
 	mux.Handle("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
 	mux.Handle("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
 
+	// Handle the introspection paths, if enabled. These expose the configuration of the stores, and the series of any
+	// object, so these are opt-in.
+	if s.introspection {
+		mux.Handle("/debug/stores", storesHandler(logger, s.registry))
+		mux.Handle("/debug/series", seriesHandler(logger, s.registry))
+	}
+
 	// Handle the metrics path.
 	registry, ok := gatherer.(*prometheus.Registry)
 	if !ok {
@@ -110,7 +128,7 @@ func (s *selfServer) build(ctx context.Context, client kubernetes.Interface, gat
 
 	// Handle the readyz path.
 	readyzProber := newReadyz(s.source)
-	mux.Handle(readyzProber.getAsString(), readyzProber.probe(ctx, logger, client))
+	mux.Handle(readyzProber.getAsString(), readyzProber.probe(logger, health))
 
 	return &http.Server{
 		ErrorLog:          log.New(os.Stdout, s.source, log.LstdFlags|log.Lshortfile),
@@ -121,39 +139,39 @@ func (s *selfServer) build(ctx context.Context, client kubernetes.Interface, gat
 }
 
 // Build sets up the mainServer with the given gatherer.
-func (s *mainServer) build(ctx context.Context, client kubernetes.Interface, _ prometheus.Gatherer) *http.Server {
+func (s *mainServer) build(ctx context.Context, health *controllerHealth, _ prometheus.Gatherer) *http.Server {
 	logger := klog.FromContext(ctx)
 	mux := http.NewServeMux()
 
-	// Handle the metrics path.
-	var readBinarySemaphore sync.RWMutex
+	// Handle the metrics paths. Resources are written out in the order of their keys, and stores in the configured order,
+	// with families of the same name merged across all of them.
 	metricsHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		readBinarySemaphore.RLock()
-		defer readBinarySemaphore.RUnlock()
-
-		// OpenMetrics is experimental at the moment.
-		negotiatedContentType := expfmt.Negotiate(r.Header)
-		if negotiatedContentType.FormatType() != expfmt.TypeTextPlain {
-			w.Header().Set("Content-Type", string(expfmt.NewFormat(expfmt.TypeTextPlain)))
+		snapshot := s.registry.snapshot()
+		var stores []*StoreType
+		for _, key := range snapshot.keys {
+			stores = append(stores, snapshot.stores[key]...)
 		}
+		s.serveMetrics(logger, w, r, stores)
+	})
+	mux.Handle("/metrics", promhttp.InstrumentHandlerDuration(*s.requestsDurationVec, metricsHandler))
+	resourceMetricsHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stores, ok := s.registry.snapshot().stores[r.PathValue("name")]
+		if !ok {
+			http.Error(w, fmt.Sprintf("resource %q not found", r.PathValue("name")), http.StatusNotFound)
 
-		// Write out the metrics from all the stores.
-		for _, stores := range s.m {
-			err := newMetricsWriter(stores...).writeAllTo(w)
-			if err != nil {
-				logger.Error(err, "error writing metrics", "source", s.source)
-			}
+			return
 		}
+		s.serveMetrics(logger, w, r, stores)
 	})
-	mux.Handle("/metrics", promhttp.InstrumentHandlerDuration(*s.requestsDurationVec, metricsHandler))
+	mux.Handle("/metrics/resources/{name}", promhttp.InstrumentHandlerDuration(*s.requestsDurationVec, resourceMetricsHandler))
 
 	// Handle the healthz path.
 	healthzProber := newHealthz(s.source)
-	mux.Handle(healthzProber.getAsString(), healthzProber.probe(ctx, logger, client))
+	mux.Handle(healthzProber.getAsString(), healthzProber.probe(logger, health))
 
 	// Handle the livez path.
 	livezProber := newLivez(s.source)
-	mux.Handle(livezProber.getAsString(), livezProber.probe(ctx, logger, client))
+	mux.Handle(livezProber.getAsString(), livezProber.probe(logger, health))
 
 	return &http.Server{
 		ErrorLog:          log.New(os.Stdout, s.source, log.LstdFlags|log.Lshortfile),
@@ -163,6 +181,42 @@ func (s *mainServer) build(ctx context.Context, client kubernetes.Interface, _ p
 	}
 }
 
+// serveMetrics writes out the metrics from the given stores, as of their latest snapshots, narrowed down by the request's
+// filters, in the format negotiated for the request, and compressed as negotiated.
+func (s *mainServer) serveMetrics(logger klog.Logger, w http.ResponseWriter, r *http.Request, stores []*StoreType) {
+	filter, err := newSeriesFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	// Serve OpenMetrics, or the delimited protobuf format, if asked to, and the Prometheus text format otherwise. The
+	// content type is always set, since it cannot be sniffed from compressed responses.
+	formatType := expfmt.NegotiateIncludingOpenMetrics(r.Header).FormatType()
+	if formatType != expfmt.TypeOpenMetrics && formatType != expfmt.TypeProtoDelim {
+		formatType = expfmt.TypeTextPlain
+	}
+	w.Header().Set("Content-Type", string(expfmt.NewFormat(formatType)))
+
+	cw, flush := compressedResponseWriter(w, r, s.encodings)
+	writer := newFilteredMetricsWriter(filter, stores...)
+	writeTo := writer.writeAllTo
+	switch formatType {
+	case expfmt.TypeOpenMetrics:
+		writeTo = writer.writeOpenMetricsTo
+	case expfmt.TypeProtoDelim:
+		writeTo = writer.writeProtobufTo
+	case expfmt.TypeUnknown, expfmt.TypeProtoCompact, expfmt.TypeProtoText, expfmt.TypeTextPlain:
+	}
+	if err = writeTo(cw); err != nil {
+		logger.Error(err, "error writing metrics", "source", s.source)
+	}
+	if err = flush(); err != nil {
+		logger.Error(err, "error writing metrics", "source", s.source)
+	}
+}
+
 // promHTTPLogger implements promhttp.Logger.
 type promHTTPLogger struct {
 
@@ -0,0 +1,323 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// newTestMainServer returns a test server serving the main server's handlers for the given registry.
+func newTestMainServer(t *testing.T, registry *storeRegistry) *httptest.Server {
+	t.Helper()
+
+	requestDurationVec := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "http_request_duration_seconds"}, []string{"method", "code"})
+	mainServer := newMainServer("", registry, requestDurationVec, true)
+	server := httptest.NewServer(mainServer.build(context.Background(), newTestControllerHealth(), nil).Handler)
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestMainServerCompression(t *testing.T) {
+	t.Parallel()
+
+	s := newTestStore(t, nil)
+	if err := s.Add(newTestObject("foo", 1)); err != nil {
+		t.Fatalf("failed to add object: %v", err)
+	}
+	registry := newStoreRegistry()
+	registry.swap("default/foo", nil, s)
+	server := newTestMainServer(t, registry)
+	want := `kube_customresource_foo_replicas{name="foo",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1`
+
+	for _, tc := range []struct {
+		acceptEncoding  string
+		wantEncoding    string
+		newDecompressor func(r io.Reader) (io.Reader, error)
+	}{
+		{
+			acceptEncoding: "",
+		},
+		{
+			acceptEncoding: "gzip",
+			wantEncoding:   encodingGzip,
+			newDecompressor: func(r io.Reader) (io.Reader, error) {
+				return gzip.NewReader(r)
+			},
+		},
+		{
+			acceptEncoding: "gzip;q=0.5, zstd",
+			wantEncoding:   encodingZstd,
+			newDecompressor: func(r io.Reader) (io.Reader, error) {
+				return zstd.NewReader(r)
+			},
+		},
+		{
+			acceptEncoding: "zstd;q=0, gzip",
+			wantEncoding:   encodingGzip,
+			newDecompressor: func(r io.Reader) (io.Reader, error) {
+				return gzip.NewReader(r)
+			},
+		},
+		{
+			acceptEncoding: "gzip;q=1, zstd;q=0.1",
+			wantEncoding:   encodingGzip,
+			newDecompressor: func(r io.Reader) (io.Reader, error) {
+				return gzip.NewReader(r)
+			},
+		},
+		{
+			acceptEncoding: "*",
+			wantEncoding:   encodingZstd,
+			newDecompressor: func(r io.Reader) (io.Reader, error) {
+				return zstd.NewReader(r)
+			},
+		},
+		{
+			acceptEncoding: "br",
+		},
+	} {
+		t.Run(tc.acceptEncoding, func(t *testing.T) {
+			t.Parallel()
+
+			request, err := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL+"/metrics", http.NoBody)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+
+			// Setting the header explicitly disables the transport's transparent decompression.
+			request.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatalf("failed to scrape: %v", err)
+			}
+			defer response.Body.Close()
+			if got := response.Header.Get("Content-Encoding"); got != tc.wantEncoding {
+				t.Fatalf("got content encoding %q, want %q", got, tc.wantEncoding)
+			}
+			if got := response.Header.Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+				t.Fatalf("got content type %q, want text/plain", got)
+			}
+			var body io.Reader = response.Body
+			if tc.newDecompressor != nil {
+				body, err = tc.newDecompressor(body)
+				if err != nil {
+					t.Fatalf("failed to create decompressor: %v", err)
+				}
+			}
+			got, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+			if !strings.Contains(string(got), want) {
+				t.Fatalf("got metrics:\n%s\nwant them to contain:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestNegotiateEncodings(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		acceptEncoding string
+		offered        []string
+		want           []string
+	}{
+		{
+			acceptEncoding: "zstd, gzip",
+			offered:        []string{encodingZstd, encodingGzip},
+			want:           []string{encodingZstd, encodingGzip},
+		},
+		{
+			acceptEncoding: "zstd, gzip",
+			offered:        []string{encodingGzip},
+			want:           []string{encodingGzip},
+		},
+		{
+			acceptEncoding: "gzip;q=1, zstd;q=0.1",
+			offered:        []string{encodingZstd, encodingGzip},
+			want:           []string{encodingGzip, encodingZstd},
+		},
+		{
+			acceptEncoding: "*;q=0.5, gzip",
+			offered:        []string{encodingZstd, encodingGzip},
+			want:           []string{encodingGzip, encodingZstd},
+		},
+		{
+			acceptEncoding: "*, zstd;q=0",
+			offered:        []string{encodingZstd, encodingGzip},
+			want:           []string{encodingGzip},
+		},
+		{
+			acceptEncoding: "gzip;q=invalid, identity",
+			offered:        []string{encodingZstd, encodingGzip},
+			want:           []string{},
+		},
+	} {
+		t.Run(tc.acceptEncoding, func(t *testing.T) {
+			t.Parallel()
+
+			if got := negotiateEncodings(tc.acceptEncoding, tc.offered); !slices.Equal(got, tc.want) {
+				t.Fatalf("got encodings %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMainServerFormats(t *testing.T) {
+	t.Parallel()
+
+	s := newTestStore(t, nil)
+	if err := s.Add(newTestObject("foo", 1)); err != nil {
+		t.Fatalf("failed to add object: %v", err)
+	}
+	registry := newStoreRegistry()
+	registry.swap("default/foo", nil, s)
+	server := newTestMainServer(t, registry)
+
+	for _, tc := range []struct {
+		accept          string
+		wantContentType string
+		wantEOF         bool
+		wantProtobuf    bool
+	}{
+		{
+			accept:          "",
+			wantContentType: "text/plain",
+		},
+		{
+			accept:          "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5",
+			wantContentType: "application/openmetrics-text",
+			wantEOF:         true,
+		},
+		{
+			accept:          "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3",
+			wantContentType: "application/vnd.google.protobuf",
+			wantProtobuf:    true,
+		},
+	} {
+		t.Run(tc.accept, func(t *testing.T) {
+			t.Parallel()
+
+			request, err := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL+"/metrics", http.NoBody)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			request.Header.Set("Accept", tc.accept)
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatalf("failed to scrape: %v", err)
+			}
+			defer response.Body.Close()
+			if got := response.Header.Get("Content-Type"); !strings.HasPrefix(got, tc.wantContentType) {
+				t.Fatalf("got content type %q, want %s", got, tc.wantContentType)
+			}
+			if tc.wantProtobuf {
+				family := &dto.MetricFamily{}
+				if err = expfmt.NewDecoder(response.Body, expfmt.NewFormat(expfmt.TypeProtoDelim)).Decode(family); err != nil {
+					t.Fatalf("failed to decode metrics: %v", err)
+				}
+				if got := len(family.GetMetric()); got != 1 {
+					t.Fatalf("got %d metrics, want 1", got)
+				}
+
+				return
+			}
+			got, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+			if gotEOF := strings.HasSuffix(string(got), "# EOF\n"); gotEOF != tc.wantEOF {
+				t.Fatalf("got metrics:\n%s\nwant EOF marker: %t", got, tc.wantEOF)
+			}
+		})
+	}
+}
+
+func TestMainServerResourceMetrics(t *testing.T) {
+	t.Parallel()
+
+	registry := newStoreRegistry()
+	registry.swap("foo", nil, newTestStore(t, []*FamilyType{newTestFamily("foo_replicas", "Replicas")}, newTestObject("a", 1)))
+	registry.swap("bar", nil, newTestStore(t, []*FamilyType{newTestFamily("bar_replicas", "Replicas")}, newTestObject("b", 1)))
+	server := newTestMainServer(t, registry)
+
+	for _, tc := range []struct {
+		path       string
+		wantStatus int
+		want       string
+		wantNot    string
+	}{
+		{
+			path:       "/metrics/resources/foo",
+			wantStatus: http.StatusOK,
+			want:       "kube_customresource_foo_replicas{",
+			wantNot:    "kube_customresource_bar_replicas",
+		},
+		{
+			path:       "/metrics?family=kube_customresource_bar_replicas",
+			wantStatus: http.StatusOK,
+			want:       "kube_customresource_bar_replicas{",
+			wantNot:    "kube_customresource_foo_replicas",
+		},
+		{
+			path:       "/metrics/resources/baz",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			path:       "/metrics?match[]=%7B",
+			wantStatus: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			t.Parallel()
+
+			request, err := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL+tc.path, http.NoBody)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatalf("failed to scrape: %v", err)
+			}
+			defer response.Body.Close()
+			if response.StatusCode != tc.wantStatus {
+				t.Fatalf("got status %d, want %d", response.StatusCode, tc.wantStatus)
+			}
+			got, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+			if !strings.Contains(string(got), tc.want) || (tc.wantNot != "" && strings.Contains(string(got), tc.wantNot)) {
+				t.Fatalf("got metrics:\n%s\nwant them to contain %q, and not %q", got, tc.want, tc.wantNot)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// sharding partitions objects across replicas, by a hash of their UID. Each replica only renders the objects in its
+// shard, so that all replicas together expose a disjoint set of series.
+type sharding struct {
+
+	// shard is the index of the shard this replica owns.
+	shard uint64
+
+	// totalShards is the total number of shards. Sharding is disabled if it is at most one.
+	totalShards uint64
+}
+
+// keeps reports whether the object with the given UID belongs to the replica's shard.
+func (s sharding) keeps(uid types.UID) bool {
+	if s.totalShards <= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(uid))
+
+	return h.Sum64()%s.totalShards == s.shard
+}
+
+// newSharding returns the sharding configured by the given options. In automatic mode, the shard is derived from the
+// ordinal of the StatefulSet pod the replica runs as, and the total number of shards from the StatefulSet's replicas.
+// NOTE: Shards are only resolved on startup, so all replicas need to be restarted once the StatefulSet is scaled, which
+// is the case when its pod management policy is not "Parallel" and all pods are rolled, or when done explicitly.
+func newSharding(ctx context.Context, kubeClientset kubernetes.Interface, options *Options) (sharding, error) {
+	if !*options.AutoShard {
+		if *options.TotalShards < 1 || *options.Shard < 0 || *options.Shard >= *options.TotalShards {
+			return sharding{}, fmt.Errorf("invalid sharding: expected 0 <= shard (%d) < total shards (%d)", *options.Shard, *options.TotalShards)
+		}
+
+		return sharding{shard: uint64(*options.Shard), totalShards: uint64(*options.TotalShards)}, nil
+	}
+
+	podName, podNamespace := *options.Pod, *options.PodNamespace
+	if podName == "" || podNamespace == "" {
+		return sharding{}, errors.New("automatic sharding requires the pod name and namespace to be set")
+	}
+
+	// Derive the shard from the pod's ordinal.
+	ordinalIndex := strings.LastIndex(podName, "-")
+	if ordinalIndex == -1 {
+		return sharding{}, fmt.Errorf("failed to derive the ordinal from pod name %q", podName)
+	}
+	ordinal, err := strconv.ParseUint(podName[ordinalIndex+1:], 10, 64)
+	if err != nil {
+		return sharding{}, fmt.Errorf("failed to derive the ordinal from pod name %q: %w", podName, err)
+	}
+
+	// Derive the total number of shards from the owning StatefulSet.
+	pod, err := kubeClientset.CoreV1().Pods(podNamespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		return sharding{}, fmt.Errorf("failed to get pod %s/%s: %w", podNamespace, podName, err)
+	}
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil || owner.Kind != "StatefulSet" {
+		return sharding{}, fmt.Errorf("pod %s/%s is not controlled by a StatefulSet", podNamespace, podName)
+	}
+	statefulSet, err := kubeClientset.AppsV1().StatefulSets(podNamespace).Get(ctx, owner.Name, metav1.GetOptions{})
+	if err != nil {
+		return sharding{}, fmt.Errorf("failed to get statefulset %s/%s: %w", podNamespace, owner.Name, err)
+	}
+	totalShards := uint64(1)
+	if statefulSet.Spec.Replicas != nil {
+		totalShards = uint64(*statefulSet.Spec.Replicas) //nolint:gosec // Replicas are never negative.
+	}
+	if ordinal >= totalShards {
+		return sharding{}, fmt.Errorf("pod ordinal (%d) exceeds the replicas (%d) of statefulset %s/%s", ordinal, totalShards, podNamespace, owner.Name)
+	}
+
+	return sharding{shard: ordinal, totalShards: totalShards}, nil
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestShardingPartitionsObjects(t *testing.T) {
+	t.Parallel()
+
+	const totalShards = 3
+	owners := map[types.UID]int{}
+	for shard := range uint64(totalShards) {
+		for i := range 100 {
+			uid := types.UID(fmt.Sprintf("uid-%d", i))
+			if !(sharding{shard: shard, totalShards: totalShards}).keeps(uid) {
+				continue
+			}
+			if _, ok := owners[uid]; ok {
+				t.Fatalf("object %s belongs to more than one shard", uid)
+			}
+			owners[uid] = int(shard) //nolint:gosec // Shards are bounded above.
+		}
+	}
+	if got, want := len(owners), 100; got != want {
+		t.Fatalf("got %d objects across all shards, want %d", got, want)
+	}
+
+	// Disabled sharding keeps all objects.
+	if !(sharding{}).keeps("uid-0") {
+		t.Fatal("got an object dropped with sharding disabled")
+	}
+}
+
+func TestShardingFiltersStore(t *testing.T) {
+	t.Parallel()
+
+	s := newTestStore(t, nil)
+	s.sharding = sharding{shard: 0, totalShards: 2}
+	var kept int
+	for i := range 10 {
+		object := newTestObject(fmt.Sprintf("foo-%d", i), 1)
+		object.SetUID(types.UID(fmt.Sprintf("uid-%d", i)))
+		if err := s.Add(object); err != nil {
+			t.Fatalf("failed to add object: %v", err)
+		}
+		if s.sharding.keeps(object.GetUID()) {
+			kept++
+		}
+	}
+	if got := len(s.keys); got != kept {
+		t.Fatalf("got %d objects in store, want %d", got, kept)
+	}
+}
+
+func TestNewShardingValidatesOptions(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		shard, totalShards int
+		wantErr            bool
+	}{
+		{shard: 0, totalShards: 1},
+		{shard: 2, totalShards: 3},
+		{shard: 3, totalShards: 3, wantErr: true},
+		{shard: -1, totalShards: 3, wantErr: true},
+		{shard: 0, totalShards: 0, wantErr: true},
+	} {
+		autoShard := false
+		options := &Options{Shard: &tc.shard, TotalShards: &tc.totalShards, AutoShard: &autoShard}
+		_, err := newSharding(context.Background(), nil, options)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("shard %d of %d: got error %v, want error %t", tc.shard, tc.totalShards, err, tc.wantErr)
+		}
+	}
+}
@@ -17,34 +17,102 @@ limitations under the License.
 package internal
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"k8s.io/apimachinery/pkg/api/meta"
+	dto "github.com/prometheus/client_model/go"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
 )
 
-// StoreType implements the k8s.io/client-go/tools/cache.StoreType interface. The cache.Reflector uses the cache.StoreType to
-// operate on the store.metrics map with the various metric families and their metrics based on the associated object's
-// events.
+// StoreType implements the k8s.io/client-go/tools/cache.Store interface. The shared informer the store subscribes to
+// operates on the store.metrics map with the various metric families and their metrics based on the associated object's
+// events, while the objects themselves are only held by the informer.
 type StoreType struct {
 
+	// ctx is the store's context, that resolutions are bound to. It is kept since the cache.Store methods do not accept
+	// one.
+	ctx context.Context //nolint:containedctx
+
+	// cancel cancels the store's context.
+	cancel context.CancelFunc
+
+	// hasSynced reports whether the store has received all objects present in its informer at the time of subscription.
+	hasSynced cache.InformerSynced
+
+	// detach unsubscribes the store from its informer.
+	detach func()
+
+	// stopOnce guards stopping the store.
+	stopOnce sync.Once
+
+	// identity identifies the watch backing the store.
+	identity storeIdentity
+
+	// telemetry holds the self metrics the store reports to.
+	telemetry storeTelemetry
+
+	// resolutionErrors records the store's most recent resolution errors, for introspection.
+	resolutionErrors *resolutionRecorder
+
+	// sharding decides the objects that the store renders. Objects outside its shard are ignored.
+	sharding sharding
+
 	// logger is the store's logger.
 	logger klog.Logger
 
-	// mutex is a binary semaphore that is used to prevent RW races w.r.t. the store's internal metric map.
+	// plan is the store's immutable rendering plan, compiled from its configuration. It may only be swapped out for
+	// another plan, under the store's write lock, see replan.
+	plan *storePlan
+
+	// mutex is a binary semaphore that is used to prevent RW races w.r.t. the store's internal object and metric maps.
 	mutex sync.RWMutex
 
-	// metrics is the store's internal metric map. It is indexed by the object's UID and contains a slice of
-	// metric families, which in turn contain a slice of metrics.
-	metrics map[types.UID][]string
+	// objects is the cache that objects are read from when they are rendered anew, see replan. It holds the objects of
+	// all shards.
+	objects cache.Store
+
+	// sharedObjects is set if objects is the cache of the informer the store subscribes to, which the store only reads
+	// from. Otherwise, the store maintains objects itself, as it does when driven directly by a reflector.
+	sharedObjects bool
+
+	// keys are the keys of all objects in the store's shard, in the order of compareObjectKeys. They are kept sorted as
+	// objects are added and deleted, so that blocks are built in a stable order without sorting them.
+	keys []string
 
-	// headers contain the type and help text for each metric family, corresponding to the store's internal
-	// metric map's keys.
-	headers []string
+	// metrics is the store's internal metric map. It is indexed by the object's key and contains the rendered series
+	// of each metric family.
+	metrics map[string][]renderedFamily
+
+	// blocks caches the series of all objects for each metric family. A nil block is stale, and is rebuilt on the next
+	// publish. Blocks are never modified once built, so that snapshots can share them.
+	blocks []*renderedFamily
+
+	// stale is set if any of the blocks are stale, i.e., if the published snapshot is outdated.
+	stale bool
+
+	// snapshot is the latest published, immutable view of the store's blocks, that scrapes read without locking.
+	snapshot atomic.Pointer[storeSnapshot]
+
+	// snapshotDebounce is the interval that snapshots are published after a mutation, coalescing all mutations within
+	// it. Snapshots are published by the first scrape after a mutation if it is zero, see loadSnapshot.
+	snapshotDebounce time.Duration
+
+	// outdated is set if the store is stale, and the next scrape should publish a new snapshot. It is only set if
+	// snapshotDebounce is zero, and mirrors stale so that scrapes can check it without locking.
+	outdated atomic.Bool
+
+	// publishScheduled is set if a debounced publish is pending.
+	publishScheduled bool
 
 	// ==================================================================================================
 	// Exported attributes that each store is associated with, used for unmarshalling the configuration.
@@ -79,116 +147,596 @@ type StoreType struct {
 
 	// LabelValues is a slice of label values.
 	LabelValues []string `yaml:"labelValues,omitempty"`
+
+	// OnResolutionFailure is the policy to apply when a query cannot be resolved.
+	OnResolutionFailure ResolutionFailurePolicy `yaml:"onResolutionFailure,omitempty"`
+
+	// DefaultValue is the metric value to use under the ResolutionFailurePolicyDefaultValue policy. It must be numeric.
+	DefaultValue string `yaml:"defaultValue,omitempty"`
+
+	// DefaultLabelValue is the label value to use under the ResolutionFailurePolicyDefaultValue policy.
+	DefaultLabelValue string `yaml:"defaultLabelValue,omitempty"`
 }
 
 // newStore returns a new store.
 func newStore(
+	ctx context.Context,
 	logger klog.Logger,
-	headers []string,
-	families []*FamilyType,
-	resolver ResolverType,
-	labelKeys []string, labelValues []string,
+	plan *storePlan,
 ) *StoreType {
-	return &StoreType{
-		logger:      logger,
-		metrics:     map[types.UID][]string{},
-		headers:     headers,
-		Families:    families,
-		Resolver:    resolver,
-		LabelKeys:   labelKeys,
-		LabelValues: labelValues,
+	ctx, cancel := context.WithCancel(ctx)
+
+	// Record the resolution errors of all renders.
+	resolutionErrors := newResolutionRecorder(maxResolutionErrors, true)
+	ctx = withResolutionRecorder(ctx, resolutionErrors)
+
+	s := &StoreType{
+		ctx:              ctx,
+		cancel:           cancel,
+		resolutionErrors: resolutionErrors,
+		logger:           logger,
+		plan:             plan,
+		objects:          cache.NewStore(cache.DeletionHandlingMetaNamespaceKeyFunc),
+		metrics:          map[string][]renderedFamily{},
+		blocks:           make([]*renderedFamily, len(plan.families)),
+		stale:            true,
 	}
+	s.publishNowLocked()
+
+	return s
+}
+
+// storeSnapshot is an immutable view of a store's metrics, as of its publishing.
+type storeSnapshot struct {
+
+	// families are the exposition of each metric family, in the configured order.
+	families []familySnapshot
+}
+
+// familySnapshot is an immutable view of a metric family's exposition.
+type familySnapshot struct {
+
+	// name is the name of the family, without the exposition prefix.
+	name string
+
+	// sampleName is the name of the family's series, with the exposition prefix and the kind's suffix.
+	sampleName string
+
+	// header is the help and type text for the family.
+	header []byte
+
+	// openMetricsHeader is the help, type, and unit text for the family under OpenMetrics.
+	openMetricsHeader []byte
+
+	// series are the series of all objects for the family.
+	series []byte
+
+	// openMetricsSeries are the series of all objects for the family under OpenMetrics.
+	openMetricsSeries []byte
+
+	// seriesEnds are the offsets in series that each series ends at, in the order of protobufSeries' metrics.
+	seriesEnds []int
+
+	// openMetricsSeriesEnds are the offsets in openMetricsSeries that each series ends at, in the order of
+	// protobufSeries' metrics.
+	openMetricsSeriesEnds []int
+
+	// protobufHeader is the encoded name, help, and type fields for the family under the protobuf format.
+	protobufHeader []byte
+
+	// protobufSeries lazily encodes series under the protobuf format.
+	protobufSeries *protobufSeries
+}
+
+// stop unsubscribes the store from its informer. If the store was the informer's last subscriber, the informer is
+// stopped as well, and stop blocks until it has returned, i.e., until its in-flight list or watch calls have been
+// drained. It is safe to call stop multiple times.
+func (s *StoreType) stop() {
+	s.stopOnce.Do(func() {
+		s.cancel()
+		if s.detach != nil {
+			s.detach()
+		}
+	})
+}
+
+// watchIdentity returns the identity of the watch the store configuration requires. The configuration must have been
+// compiled.
+func (s *StoreType) watchIdentity() storeIdentity {
+	return storeIdentity{
+		gvkr: gvkr{
+			GroupVersionKind:     schema.GroupVersionKind{Group: s.Group, Version: s.Version, Kind: s.Kind},
+			GroupVersionResource: schema.GroupVersionResource{Group: s.Group, Version: s.Version, Resource: s.ResourceName},
+		},
+		labelSelector: s.Selectors.Label,
+		fieldSelector: s.Selectors.Field,
+		metadataOnly:  s.plan != nil && s.plan.metadataOnly,
+	}
+}
+
+// replan swaps the store's rendering plan for the given one, and re-renders all objects with it from the informer's
+// cache, without relisting them.
+func (s *StoreType) replan(plan *storePlan) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.plan = plan
+	s.blocks = make([]*renderedFamily, len(plan.families))
+	s.stale = true
+	s.metrics = make(map[string][]renderedFamily, len(s.keys))
+	var errs []error
+	for _, key := range s.keys {
+		unstructuredObject, ok, err := s.objectLocked(key)
+		if err != nil {
+			errs = append(errs, err)
+
+			continue
+		}
+
+		// Objects no longer in the cache are dropped by their pending delete events.
+		if !ok {
+			continue
+		}
+		if err = s.renderLocked(key, unstructuredObject); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	s.logger.V(2).Info("Replan", "objects", len(s.keys))
+
+	// Publish right away, since the families themselves may have changed.
+	s.publishNowLocked()
+
+	return errors.Join(errs...)
+}
+
+// waitForSync blocks until the store has been populated by its informer, or until the given context is done, in which
+// case an error is returned.
+func (s *StoreType) waitForSync(ctx context.Context) error {
+	if s.hasSynced == nil {
+		return errors.New("store is not subscribed to an informer")
+	}
+	if !cache.WaitForCacheSync(ctx.Done(), s.hasSynced) {
+		return fmt.Errorf("store did not sync: %w", ctx.Err())
+	}
+
+	return nil
+}
+
+// toUnstructured converts the given object into an unstructured one, and returns it along with its key.
+func toUnstructured(objectI interface{}) (*unstructured.Unstructured, string, error) {
+	unstructuredObject, ok := objectI.(*unstructured.Unstructured)
+	if !ok {
+		unstructuredObjectMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(objectI)
+		if err != nil {
+			return nil, "", fmt.Errorf("error converting object interface to unstructured: %w", err)
+		}
+		unstructuredObject = &unstructured.Unstructured{Object: unstructuredObjectMap}
+	}
+	key, err := cache.MetaNamespaceKeyFunc(unstructuredObject)
+	if err != nil {
+		return nil, "", fmt.Errorf("error getting key for object: %w", err)
+	}
+
+	return unstructuredObject, key, nil
 }
 
 // Add adds the given object to the accumulator associated with its key.
 func (s *StoreType) Add(objectI interface{}) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	defer s.publishLocked()
 
-	// Convert into an unstructured object.
-	unstructuredObjectMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(objectI)
+	unstructuredObject, key, err := toUnstructured(objectI)
 	if err != nil {
-		return fmt.Errorf("error converting object interface to unstructured: %w", err)
+		return err
+	}
+	if err = s.cacheLocked(unstructuredObject); err != nil {
+		return err
+	}
+	if !s.sharding.keeps(unstructuredObject.GetUID()) {
+		return nil
+	}
+	if i, found := slices.BinarySearchFunc(s.keys, key, compareObjectKeys); !found {
+		s.keys = slices.Insert(s.keys, i, key)
 	}
-	unstructuredObject := &unstructured.Unstructured{Object: unstructuredObjectMap}
 
-	// Generate metrics from the object.
-	familyMetrics := make([]string, len(s.Families))
-	for i, f := range s.Families {
-		// Inherit the resolver.
-		if f.Resolver == ResolverTypeNone {
-			f.Resolver = s.Resolver
-		}
+	return s.renderLocked(key, unstructuredObject)
+}
+
+// cacheLocked adds or updates the given object in the store's cache, unless the cache is the informer's. The caller must
+// hold the store's write lock.
+func (s *StoreType) cacheLocked(unstructuredObject *unstructured.Unstructured) error {
+	if s.sharedObjects {
+		return nil
+	}
+	if err := s.objects.Update(unstructuredObject); err != nil {
+		return fmt.Errorf("error caching object: %w", err)
+	}
+
+	return nil
+}
 
-		// Inherit the label keys and values.
-		f.LabelKeys = append(f.LabelKeys, s.LabelKeys...)
-		f.LabelValues = append(f.LabelValues, s.LabelValues...)
+// objectLocked returns the object with the given key from the informer's cache, and whether it is held there. The
+// caller must hold the store's lock.
+func (s *StoreType) objectLocked(key string) (*unstructured.Unstructured, bool, error) {
+	objectI, ok, err := s.objects.GetByKey(key)
+	if err != nil {
+		return nil, false, fmt.Errorf("error getting object %s: %w", key, err)
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	unstructuredObject, _, err := toUnstructured(objectI)
+	if err != nil {
+		return nil, false, err
+	}
 
-		// Generate the metrics.
-		f.logger = s.logger
-		familyMetrics[i] = f.rawFrom(unstructuredObject)
-		s.logger.V(4).Info("Add", "family", f.Name, "metrics", familyMetrics[i])
+	return unstructuredObject, true, nil
+}
+
+// renderLocked generates and stores the metrics for the given object. The caller must hold the store's write lock.
+func (s *StoreType) renderLocked(key string, unstructuredObject *unstructured.Unstructured) error {
+	familyMetrics, err := s.plan.render(s.ctx, s.logger, unstructuredObject)
+	if err != nil {
+		// Drop any series previously generated for the object.
+		s.invalidateLocked(s.metrics[key], nil)
+		delete(s.metrics, key)
+
+		return fmt.Errorf("error generating metrics for %s: %w", klog.KObj(unstructuredObject), err)
 	}
 
 	// Store the generated metrics.
-	s.logger.V(2).Info("Add", "key", klog.KObj(unstructuredObject))
-	s.metrics[unstructuredObject.GetUID()] = familyMetrics
+	s.logger.V(2).Info("Add", "key", key)
+	s.invalidateLocked(s.metrics[key], familyMetrics)
+	s.metrics[key] = familyMetrics
 
 	return nil
 }
 
-// Update updates the given object in the accumulator associated with its key.
+// invalidateLocked marks the blocks of the families whose series differ between the given renders of an object as
+// stale. The caller must hold the store's write lock.
+func (s *StoreType) invalidateLocked(oldFamilyMetrics, newFamilyMetrics []renderedFamily) {
+	for i := range s.blocks {
+		var oldMetrics, newMetrics renderedFamily
+		if i < len(oldFamilyMetrics) {
+			oldMetrics = oldFamilyMetrics[i]
+		}
+		if i < len(newFamilyMetrics) {
+			newMetrics = newFamilyMetrics[i]
+		}
+		if !bytes.Equal(oldMetrics.series, newMetrics.series) || !bytes.Equal(oldMetrics.openMetricsSeries, newMetrics.openMetricsSeries) {
+			s.blocks[i] = nil
+			s.stale = true
+		}
+	}
+}
+
+// publishLocked publishes a new snapshot of the store if it is stale, either on the next scrape, or once the debounce
+// interval has elapsed. Publishing is never done right away, since rebuilding the changed families on every mutation
+// is quadratic in the number of objects when these are first listed. The caller must hold the store's write lock.
+func (s *StoreType) publishLocked() {
+	if !s.stale {
+		return
+	}
+	if s.snapshotDebounce <= 0 {
+		s.outdated.Store(true)
+
+		return
+	}
+	if s.publishScheduled {
+		return
+	}
+	s.publishScheduled = true
+	time.AfterFunc(s.snapshotDebounce, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		s.publishScheduled = false
+		if s.ctx.Err() != nil {
+			return
+		}
+		s.publishNowLocked()
+	})
+}
+
+// publishNowLocked rebuilds all stale blocks, and publishes them as the store's new snapshot. The caller must hold the
+// store's write lock.
+func (s *StoreType) publishNowLocked() {
+	for i := range s.blocks {
+		if s.blocks[i] == nil {
+			s.blocks[i] = s.buildBlockLocked(i)
+		}
+	}
+	families := make([]familySnapshot, len(s.blocks))
+	for i, f := range s.plan.families {
+		families[i] = familySnapshot{
+			name:                  f.name,
+			sampleName:            f.sampleName,
+			header:                f.header,
+			openMetricsHeader:     f.openMetricsHeader,
+			series:                s.blocks[i].series,
+			openMetricsSeries:     s.blocks[i].openMetricsSeries,
+			seriesEnds:            s.blocks[i].seriesEnds,
+			openMetricsSeriesEnds: s.blocks[i].openMetricsSeriesEnds,
+			protobufHeader:        f.protobufHeader,
+			protobufSeries:        s.blocks[i].protobuf,
+		}
+		if !f.created {
+			families[i].openMetricsSeries = families[i].series
+			families[i].openMetricsSeriesEnds = families[i].seriesEnds
+		}
+	}
+	s.snapshot.Store(&storeSnapshot{families: families})
+	s.stale = false
+	s.outdated.Store(false)
+}
+
+// loadSnapshot returns the store's latest snapshot, publishing a new one first if the store is outdated. Scrapes do not
+// wait on mutations for this, and read the latest published snapshot instead if the store is locked, leaving it to the
+// next scrape to publish.
+func (s *StoreType) loadSnapshot() *storeSnapshot {
+	if s.outdated.Load() && s.mutex.TryLock() {
+		if s.stale {
+			s.publishNowLocked()
+		}
+		s.mutex.Unlock()
+	}
+
+	return s.snapshot.Load()
+}
+
+// buildBlockLocked returns the series of all objects for the family at the given index. The caller must hold the
+// store's lock.
+func (s *StoreType) buildBlockLocked(i int) *renderedFamily {
+	var size, openMetricsSize, metricsSize int
+	for _, familyMetrics := range s.metrics {
+		size += len(familyMetrics[i].series)
+		openMetricsSize += len(familyMetrics[i].openMetricsSeries)
+		metricsSize += len(familyMetrics[i].metrics)
+	}
+	block := &renderedFamily{series: make([]byte, 0, size), seriesEnds: make([]int, 0, metricsSize)}
+	metrics := make([]*dto.Metric, 0, metricsSize)
+	if s.plan.families[i].created {
+		block.openMetricsSeries = make([]byte, 0, openMetricsSize)
+		block.openMetricsSeriesEnds = make([]int, 0, metricsSize)
+	}
+	for _, key := range s.keys {
+		if familyMetrics, ok := s.metrics[key]; ok {
+			// Offsets are shifted by the series of the preceding objects.
+			for _, end := range familyMetrics[i].seriesEnds {
+				block.seriesEnds = append(block.seriesEnds, len(block.series)+end)
+			}
+			block.series = append(block.series, familyMetrics[i].series...)
+			if block.openMetricsSeries != nil {
+				for _, end := range familyMetrics[i].openMetricsSeriesEnds {
+					block.openMetricsSeriesEnds = append(block.openMetricsSeriesEnds, len(block.openMetricsSeries)+end)
+				}
+				block.openMetricsSeries = append(block.openMetricsSeries, familyMetrics[i].openMetricsSeries...)
+			}
+			metrics = append(metrics, familyMetrics[i].metrics...)
+		}
+	}
+	block.protobuf = &protobufSeries{metrics: metrics}
+
+	return block
+}
+
+// renderedObject is an object, along with its rendered families.
+type renderedObject struct {
+
+	// object is the object, as held by the informer's cache.
+	object *unstructured.Unstructured
+
+	// families are the object's rendered families, in the order of the plan's families.
+	families []renderedFamily
+}
+
+// renderedObjects returns the store's plan, along with its rendered objects in the order of their keys, so that these
+// can be read without holding the store's lock. Objects that failed to render are left out. Neither objects nor their
+// renders are ever modified, only replaced.
+func (s *StoreType) renderedObjects() (*storePlan, []renderedObject) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	objects := make([]renderedObject, 0, len(s.keys))
+	for _, key := range s.keys {
+		familyMetrics, ok := s.metrics[key]
+		if !ok {
+			continue
+		}
+		if unstructuredObject, ok, err := s.objectLocked(key); err == nil && ok {
+			objects = append(objects, renderedObject{object: unstructuredObject, families: familyMetrics})
+		}
+	}
+
+	return s.plan, objects
+}
+
+// Update updates the given object in the accumulator associated with its key. The object is re-rendered unless its
+// previous version is cached, and the update changed none of the fields that the store's plan reads.
 func (s *StoreType) Update(objectI interface{}) error {
-	s.logger.V(2).Info("Update", "defer", "Add")
+	return s.update(nil, objectI)
+}
+
+// update updates the metrics of the given object, whose previous version is given as well, as shared informers do. The
+// previous version is read from the store's cache if not given. The object is only re-rendered if the update changed
+// any of the fields that the store's plan reads.
+func (s *StoreType) update(oldObjectI, objectI interface{}) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	defer s.publishLocked()
 
-	return s.Add(objectI)
+	unstructuredObject, key, err := toUnstructured(objectI)
+	if err != nil {
+		return err
+	}
+	var oldObject *unstructured.Unstructured
+	if oldObjectI != nil {
+		oldObject, _, err = toUnstructured(oldObjectI)
+	} else if !s.sharedObjects {
+		oldObject, _, err = s.objectLocked(key)
+	}
+	if err != nil {
+		return err
+	}
+	if err = s.cacheLocked(unstructuredObject); err != nil {
+		return err
+	}
+	if !s.sharding.keeps(unstructuredObject.GetUID()) {
+		return nil
+	}
+	i, found := slices.BinarySearchFunc(s.keys, key, compareObjectKeys)
+	if !found {
+		s.keys = slices.Insert(s.keys, i, key)
+	}
+	if found && oldObject != nil && !s.plan.dependenciesChanged(oldObject, unstructuredObject) {
+		s.logger.V(4).Info("Update", "key", key, "skipped", "no dependencies changed")
+		s.telemetry.observeUpdate(true)
+
+		return nil
+	}
+	s.telemetry.observeUpdate(false)
+
+	return s.renderLocked(key, unstructuredObject)
 }
 
 // Delete deletes the given object from the accumulator associated with its key.
 func (s *StoreType) Delete(objectI interface{}) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	defer s.publishLocked()
 
-	// Cast into a typed object.
-	object, err := meta.Accessor(objectI)
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(objectI)
 	if err != nil {
-		return fmt.Errorf("error casting object interface: %w", err)
+		return fmt.Errorf("error getting key for object: %w", err)
 	}
 
-	// Delete the object's metrics.
-	s.logger.V(2).Info("Delete", "key", klog.KObj(object))
-	s.logger.V(4).Info("Delete", "metrics", s.metrics[object.GetUID()])
-	delete(s.metrics, object.GetUID())
+	// Delete the object and its metrics.
+	s.logger.V(2).Info("Delete", "key", key)
+	s.logger.V(4).Info("Delete", "metrics", s.metrics[key])
+	if !s.sharedObjects {
+		if err = s.objects.Delete(objectI); err != nil {
+			return fmt.Errorf("error uncaching object %s: %w", key, err)
+		}
+	}
+	s.deleteLocked(key)
 
 	return nil
 }
 
-// List returns a list of all the currently non-empty accumulators.
+// deleteLocked drops the metrics of the object with the given key. The caller must hold the store's write lock.
+func (s *StoreType) deleteLocked(key string) {
+	if i, found := slices.BinarySearchFunc(s.keys, key, compareObjectKeys); found {
+		s.keys = slices.Delete(s.keys, i, i+1)
+	}
+	s.invalidateLocked(s.metrics[key], nil)
+	delete(s.metrics, key)
+}
+
+// List returns a list of all the objects in the store's shard.
 func (s *StoreType) List() []interface{} {
-	return nil
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	objects := make([]interface{}, 0, len(s.keys))
+	for _, key := range s.keys {
+		if unstructuredObject, ok, err := s.objectLocked(key); err == nil && ok {
+			objects = append(objects, unstructuredObject)
+		}
+	}
+
+	return objects
 }
 
-// ListKeys returns a list of all the keys of the currently non-empty accumulators.
+// ListKeys returns a list of all the keys of the objects in the store's shard.
 func (s *StoreType) ListKeys() []string {
-	return nil
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return slices.Clone(s.keys)
 }
 
-// Get returns the accumulator associated with the given object's key.
-func (s *StoreType) Get(_ interface{}) (interface{}, bool, error) {
-	return nil, false, nil
+// Get returns the object associated with the given object's key.
+func (s *StoreType) Get(objectI interface{}) (interface{}, bool, error) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(objectI)
+	if err != nil {
+		return nil, false, fmt.Errorf("error getting key for object: %w", err)
+	}
+
+	return s.GetByKey(key)
 }
 
-// GetByKey returns the accumulator associated with the given key.
-func (s *StoreType) GetByKey(_ string) (interface{}, bool, error) {
-	return nil, false, nil
+// GetByKey returns the object associated with the given key, if it is in the store's shard.
+func (s *StoreType) GetByKey(key string) (interface{}, bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if _, found := slices.BinarySearchFunc(s.keys, key, compareObjectKeys); !found {
+		return nil, false, nil
+	}
+	unstructuredObject, ok, err := s.objectLocked(key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	return unstructuredObject, true, nil
 }
 
 // Replace will delete the contents of the store, using instead the given list. store takes ownership of the list, you
 // should not reference it after calling this function.
-// NOTE: cache.Reflector starts off with Replace followed by Add rather than just Add, and as such this is skipped to
-// avoid building stores twice.
-func (s *StoreType) Replace(_ []interface{}, _ string) error {
-	return nil
+// NOTE: A cache.Reflector calls Replace with the complete list of objects on every (re)list, and only watches for
+// changes that happened after it, so all objects are built exactly once here. Objects absent from the list, i.e., the
+// ones deleted while the watch was disconnected, are dropped along with their metrics. Stores subscribed to a shared
+// informer receive the same through individual delete events instead. Objects that fail to render are logged rather than
+// returned, so only entries that are not objects are reported.
+func (s *StoreType) Replace(list []interface{}, resourceVersion string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	defer s.publishLocked()
+
+	var errs []error
+	objects := make([]interface{}, 0, len(list))
+	keys := make([]string, 0, len(list))
+	renders := make(map[string]*unstructured.Unstructured, len(list))
+	for _, objectI := range list {
+		unstructuredObject, key, err := toUnstructured(objectI)
+		if err != nil {
+			errs = append(errs, err)
+
+			continue
+		}
+		objects = append(objects, unstructuredObject)
+		if !s.sharding.keeps(unstructuredObject.GetUID()) {
+			continue
+		}
+		keys = append(keys, key)
+		renders[key] = unstructuredObject
+	}
+	if !s.sharedObjects {
+		if err := s.objects.Replace(objects, resourceVersion); err != nil {
+			return fmt.Errorf("error replacing cached objects: %w", err)
+		}
+	}
+
+	// Drop the objects that vanished, and render the listed ones. Unchanged series leave their blocks intact.
+	for _, key := range slices.Clone(s.keys) {
+		if _, ok := renders[key]; !ok {
+			s.deleteLocked(key)
+		}
+	}
+	slices.SortFunc(keys, compareObjectKeys)
+	s.keys = slices.Compact(keys)
+	for key, unstructuredObject := range renders {
+
+		// Objects that fail to render are kept, and re-rendered on their next event. Returning the error would make
+		// callers replace the whole list again, which fails the same way until the object changes.
+		if err := s.renderLocked(key, unstructuredObject); err != nil {
+			s.logger.V(1).Error(err, "error handling replaced object")
+		}
+	}
+	s.logger.V(2).Info("Replace", "objects", len(s.keys))
+
+	return errors.Join(errs...)
 }
 
 // Resync is meaningless in the terms appearing here but has meaning in some implementations that have non-trivial
@@ -0,0 +1,330 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rexagod/crdmetrics/pkg/resolver"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+func TestStoreUpdateSkipsUnchangedDependencies(t *testing.T) {
+	t.Parallel()
+
+	s := newTestStore(t, nil)
+	s.telemetry = storeTelemetry{
+		updatesSkipped:  prometheus.NewCounter(prometheus.CounterOpts{Name: "store_updates_skipped_total"}),
+		updatesRendered: prometheus.NewCounter(prometheus.CounterOpts{Name: "store_updates_rendered_total"}),
+	}
+	object := newTestObject("foo", 1)
+	if err := s.Add(object); err != nil {
+		t.Fatalf("failed to add object: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name         string
+		mutate       func(u *unstructured.Unstructured)
+		wantSkipped  float64
+		wantRendered float64
+		wantMetric   string
+	}{
+		{
+			name: "unread field changed",
+			mutate: func(u *unstructured.Unstructured) {
+				_ = unstructured.SetNestedField(u.Object, "2024-01-01T00:00:00Z", "status", "lastHeartbeat")
+				u.SetResourceVersion("2")
+			},
+			wantSkipped: 1,
+			wantMetric:  `kube_customresource_foo_replicas{name="foo",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1`,
+		},
+		{
+			name: "read field changed",
+			mutate: func(u *unstructured.Unstructured) {
+				_ = unstructured.SetNestedField(u.Object, int64(2), "spec", "replicas")
+				u.SetResourceVersion("3")
+			},
+			wantSkipped:  1,
+			wantRendered: 1,
+			wantMetric:   `kube_customresource_foo_replicas{name="foo",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 2`,
+		},
+	} {
+		// Cases build on each other, and are run sequentially.
+		oldObject := object
+		object = object.DeepCopy()
+		tc.mutate(object)
+		if err := s.update(oldObject, object); err != nil {
+			t.Fatalf("%s: failed to update object: %v", tc.name, err)
+		}
+		if got := testutil.ToFloat64(s.telemetry.updatesSkipped); got != tc.wantSkipped {
+			t.Errorf("%s: got %f skipped updates, want %f", tc.name, got, tc.wantSkipped)
+		}
+		if got := testutil.ToFloat64(s.telemetry.updatesRendered); got != tc.wantRendered {
+			t.Errorf("%s: got %f rendered updates, want %f", tc.name, got, tc.wantRendered)
+		}
+		out := &strings.Builder{}
+		if err := newMetricsWriter(s).writeAllTo(out); err != nil {
+			t.Fatalf("%s: failed to write metrics: %v", tc.name, err)
+		}
+		if !strings.Contains(out.String(), tc.wantMetric) {
+			t.Errorf("%s: got metrics:\n%s\nwant them to contain:\n%s", tc.name, out.String(), tc.wantMetric)
+		}
+	}
+}
+
+func TestStoreSnapshots(t *testing.T) {
+	t.Parallel()
+
+	s := newTestStore(t, nil)
+	write := func() string {
+		t.Helper()
+
+		out := &strings.Builder{}
+		if err := newMetricsWriter(s).writeAllTo(out); err != nil {
+			t.Fatalf("failed to write metrics: %v", err)
+		}
+
+		return out.String()
+	}
+	if err := s.Add(newTestObject("foo", 1)); err != nil {
+		t.Fatalf("failed to add object: %v", err)
+	}
+	before := s.loadSnapshot()
+
+	// Unchanged series do not publish a new snapshot.
+	if err := s.Add(newTestObject("foo", 1)); err != nil {
+		t.Fatalf("failed to add object: %v", err)
+	}
+	if s.loadSnapshot() != before {
+		t.Fatal("got a new snapshot after re-adding an unchanged object")
+	}
+
+	// Changed series do, but only once scraped, so that consecutive mutations are published at once.
+	if err := s.Add(newTestObject("foo", 2)); err != nil {
+		t.Fatalf("failed to add object: %v", err)
+	}
+	if s.snapshot.Load() != before {
+		t.Fatal("got a new snapshot published before a scrape")
+	}
+	if s.loadSnapshot() == before {
+		t.Fatal("got a stale snapshot after changing an object's series")
+	}
+	want := `kube_customresource_foo_replicas{name="foo",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 2`
+	if got := write(); !strings.Contains(got, want) {
+		t.Fatalf("got metrics:\n%s\nwant them to contain:\n%s", got, want)
+	}
+
+	// Deleted objects do as well.
+	if err := s.Delete(newTestObject("foo", 2)); err != nil {
+		t.Fatalf("failed to delete object: %v", err)
+	}
+	if got := write(); strings.Contains(got, want) {
+		t.Fatalf("got metrics for a deleted object:\n%s", got)
+	}
+
+	// Scrapes do not contend with mutations, even if the store is outdated.
+	if err := s.Add(newTestObject("bar", 1)); err != nil {
+		t.Fatalf("failed to add object: %v", err)
+	}
+	s.mutex.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		write()
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Error("got a scrape blocked on the store's lock")
+	}
+	s.mutex.Unlock()
+}
+
+func TestStoreSnapshotsDebounce(t *testing.T) {
+	t.Parallel()
+
+	s := newTestStore(t, nil)
+	s.snapshotDebounce = 50 * time.Millisecond
+	before := s.snapshot.Load()
+	for i := range 10 {
+		if err := s.Add(newTestObject(fmt.Sprintf("foo-%d", i), 1)); err != nil {
+			t.Fatalf("failed to add object: %v", err)
+		}
+	}
+	if s.snapshot.Load() != before {
+		t.Fatal("got a snapshot published before the debounce interval elapsed")
+	}
+
+	// All mutations within the interval are published at once.
+	deadline := time.Now().Add(10 * time.Second)
+	for s.snapshot.Load() == before {
+		if time.Now().After(deadline) {
+			t.Fatal("got no snapshot published after the debounce interval elapsed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	out := &strings.Builder{}
+	if err := newMetricsWriter(s).writeAllTo(out); err != nil {
+		t.Fatalf("failed to write metrics: %v", err)
+	}
+	if got, want := strings.Count(out.String(), "kube_customresource_foo_replicas{"), 10; got != want {
+		t.Fatalf("got %d series, want %d", got, want)
+	}
+}
+
+func TestStoreSortedOutput(t *testing.T) {
+	t.Parallel()
+
+	// Objects are named alike across namespaces, so the namespace is needed to tell their series apart.
+	plan, err := newStorePlan(&StoreType{
+		Group:   "samplecontroller.k8s.io",
+		Version: "v1alpha1",
+		Kind:    "Foo",
+		Families: []*FamilyType{{
+			Name: "foo_replicas",
+			Help: "Number of replicas for each Foo instance",
+			Metrics: []*MetricType{{
+				LabelKeys:   []string{"name", "namespace"},
+				LabelValues: []string{"metadata.name", "metadata.namespace"},
+				Value:       "spec.replicas",
+			}},
+		}},
+	}, resolver.Options{Logger: klog.Background()})
+	if err != nil {
+		t.Fatalf("failed to compile plan: %v", err)
+	}
+	s := newStore(context.Background(), klog.Background(), plan)
+	objects := []struct{ namespace, name string }{{"b", "foo"}, {"a-b", "foo"}, {"a", "foo"}, {"a", "bar"}, {"b", "bar"}}
+	for _, o := range objects {
+		object := newTestObject(o.name, 1)
+		object.SetNamespace(o.namespace)
+		if err := s.Add(object); err != nil {
+			t.Fatalf("failed to add object: %v", err)
+		}
+	}
+	deleted := newTestObject("foo", 1)
+	deleted.SetNamespace("b")
+	if err := s.Delete(deleted); err != nil {
+		t.Fatalf("failed to delete object: %v", err)
+	}
+
+	out := &strings.Builder{}
+	if err := newMetricsWriter(s).writeAllTo(out); err != nil {
+		t.Fatalf("failed to write metrics: %v", err)
+	}
+	want := `# HELP kube_customresource_foo_replicas Number of replicas for each Foo instance
+# TYPE kube_customresource_foo_replicas gauge
+kube_customresource_foo_replicas{name="bar",namespace="a",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1.000000
+kube_customresource_foo_replicas{name="foo",namespace="a",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1.000000
+kube_customresource_foo_replicas{name="foo",namespace="a-b",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1.000000
+kube_customresource_foo_replicas{name="bar",namespace="b",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1.000000
+`
+	if got := out.String(); got != want {
+		t.Fatalf("got metrics:\n%s\nwant:\n%s", got, want)
+	}
+	if got, want := s.keys, []string{"a/bar", "a/foo", "a-b/foo", "b/bar"}; !slices.Equal(got, want) {
+		t.Fatalf("got keys %q, want %q", got, want)
+	}
+}
+
+func TestStoreReplace(t *testing.T) {
+	t.Parallel()
+
+	plan, err := newStorePlan(&StoreType{
+		Group:   "samplecontroller.k8s.io",
+		Version: "v1alpha1",
+		Kind:    "Foo",
+		Families: []*FamilyType{{
+			Name:                "foo_replicas",
+			Help:                "Number of replicas for each Foo instance",
+			OnResolutionFailure: ResolutionFailurePolicyFailObject,
+			Metrics: []*MetricType{{
+				LabelKeys:   []string{"name"},
+				LabelValues: []string{"metadata.name"},
+				Value:       "spec.replicas",
+			}},
+		}},
+	}, resolver.Options{Logger: klog.Background()})
+	if err != nil {
+		t.Fatalf("failed to compile plan: %v", err)
+	}
+	s := newStore(context.Background(), klog.Background(), plan)
+	write := func() string {
+		t.Helper()
+
+		out := &strings.Builder{}
+		if err := newMetricsWriter(s).writeAllTo(out); err != nil {
+			t.Fatalf("failed to write metrics: %v", err)
+		}
+
+		return out.String()
+	}
+	failed := newTestObject("bar", 1)
+	unstructured.RemoveNestedField(failed.Object, "spec", "replicas")
+
+	// Objects that fail to render are reported when added, but kept, so that they are rendered anew on replans.
+	addTestObject(t, s, newTestObject("qux", 1))
+	if err = s.Add(failed); err == nil {
+		t.Fatal("got no error adding an object that fails to render")
+	}
+
+	// On replaces they are not reported at all, since relisting would not help. Objects absent from the list are dropped.
+	if err = s.Replace([]interface{}{newTestObject("foo", 1), failed}, ""); err != nil {
+		t.Fatalf("got error %v replacing objects, want none", err)
+	}
+	if _, ok, _ := s.GetByKey("default/bar"); !ok {
+		t.Fatal("got the failed object dropped from the cache")
+	}
+	if _, ok, _ := s.Get(newTestObject("qux", 1)); ok {
+		t.Fatal("got an object absent from the list kept in the cache")
+	}
+	if got, want := s.ListKeys(), []string{"default/bar", "default/foo"}; !slices.Equal(got, want) {
+		t.Fatalf("got keys %q, want %q", got, want)
+	}
+	if got, want := len(s.List()), 2; got != want {
+		t.Fatalf("got %d objects, want %d", got, want)
+	}
+	want := `# HELP kube_customresource_foo_replicas Number of replicas for each Foo instance
+# TYPE kube_customresource_foo_replicas gauge
+kube_customresource_foo_replicas{name="foo",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1.000000
+`
+	if got := write(); got != want {
+		t.Fatalf("got metrics:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Objects deleted while disconnected are handed over as tombstones, and their series dropped.
+	if err = s.Delete(cache.DeletedFinalStateUnknown{Key: "default/foo", Obj: newTestObject("foo", 1)}); err != nil {
+		t.Fatalf("failed to delete object: %v", err)
+	}
+	if got := write(); strings.Contains(got, `name="foo"`) {
+		t.Fatalf("got metrics for a deleted object:\n%s", got)
+	}
+
+	// Entries that are not objects are reported.
+	if err = s.Replace([]interface{}{"foo"}, ""); err == nil {
+		t.Fatal("got no error replacing a non-object entry")
+	}
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	versioncollector "github.com/prometheus/client_golang/prometheus/collectors/version"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rexagod/crdmetrics/internal/version"
+)
+
+// telemetry holds the telemetry registry, and the self metrics registered in it.
+type telemetry struct {
+
+	// registry is the telemetry registry, exposed by the self server.
+	registry *prometheus.Registry
+
+	// requestDurationVec is a histogram denoting the request durations for the main server's metrics endpoint.
+	requestDurationVec *prometheus.HistogramVec
+
+	// celCostTotalVec is a counter denoting the cumulative runtime cost of CEL evaluations, per managed resource.
+	celCostTotalVec *prometheus.CounterVec
+
+	// updatesSkippedTotalVec is a counter denoting the number of object updates that did not require re-rendering, per
+	// managed resource.
+	updatesSkippedTotalVec *prometheus.CounterVec
+
+	// updatesRenderedTotalVec is a counter denoting the number of object updates that were re-rendered, per managed
+	// resource.
+	updatesRenderedTotalVec *prometheus.CounterVec
+
+	// liveReflectors is a gauge denoting the number of running reflectors, one per shared informer.
+	liveReflectors prometheus.Gauge
+
+	// remoteWriteSamplesSentTotal is a counter denoting the number of samples pushed to the remote-write endpoint.
+	remoteWriteSamplesSentTotal prometheus.Counter
+
+	// remoteWriteSamplesFailedTotal is a counter denoting the number of samples that could not be pushed to the
+	// remote-write endpoint, and were dropped.
+	remoteWriteSamplesFailedTotal prometheus.Counter
+
+	// remoteWriteRetriesTotal is a counter denoting the number of retried remote-write requests.
+	remoteWriteRetriesTotal prometheus.Counter
+
+	// otlpDataPointsSentTotal is a counter denoting the number of data points exported to the OTLP endpoint.
+	otlpDataPointsSentTotal prometheus.Counter
+
+	// otlpDataPointsFailedTotal is a counter denoting the number of data points that could not be exported to the OTLP
+	// endpoint.
+	otlpDataPointsFailedTotal prometheus.Counter
+}
+
+// newTelemetry builds the telemetry registry, and registers all self metrics in it.
+func newTelemetry() *telemetry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		versioncollector.NewCollector(version.ControllerName),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{Namespace: version.ControllerName, ReportErrors: true}),
+	)
+
+	return &telemetry{
+		registry: registry,
+		requestDurationVec: promauto.With(registry).NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "http_request_duration_seconds",
+				Help:    "A histogram of requests for the main server's metrics endpoint.",
+				Buckets: prometheus.DefBuckets,
+			}, []string{"method", "code"},
+		),
+		celCostTotalVec: promauto.With(registry).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "cel_evaluation_cost_total",
+				Help: "The cumulative runtime cost of CEL evaluations per managed resource.",
+			}, []string{"resource"},
+		),
+		updatesSkippedTotalVec: promauto.With(registry).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "store_updates_skipped_total",
+				Help: "The number of object updates that did not change any field read by the stores, and were not re-rendered, per managed resource.",
+			}, []string{"resource"},
+		),
+		updatesRenderedTotalVec: promauto.With(registry).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "store_updates_rendered_total",
+				Help: "The number of object updates that were re-rendered, per managed resource.",
+			}, []string{"resource"},
+		),
+		liveReflectors: promauto.With(registry).NewGauge(
+			prometheus.GaugeOpts{
+				Name: "live_reflectors",
+				Help: "The number of running reflectors, one per shared informer across all stores.",
+			},
+		),
+		remoteWriteSamplesSentTotal: promauto.With(registry).NewCounter(
+			prometheus.CounterOpts{
+				Name: "remote_write_samples_sent_total",
+				Help: "The number of samples pushed to the remote-write endpoint.",
+			},
+		),
+		remoteWriteSamplesFailedTotal: promauto.With(registry).NewCounter(
+			prometheus.CounterOpts{
+				Name: "remote_write_samples_failed_total",
+				Help: "The number of samples that could not be pushed to the remote-write endpoint, and were dropped.",
+			},
+		),
+		remoteWriteRetriesTotal: promauto.With(registry).NewCounter(
+			prometheus.CounterOpts{
+				Name: "remote_write_retries_total",
+				Help: "The number of retried remote-write requests.",
+			},
+		),
+		otlpDataPointsSentTotal: promauto.With(registry).NewCounter(
+			prometheus.CounterOpts{
+				Name: "otlp_data_points_sent_total",
+				Help: "The number of data points exported to the OTLP endpoint.",
+			},
+		),
+		otlpDataPointsFailedTotal: promauto.With(registry).NewCounter(
+			prometheus.CounterOpts{
+				Name: "otlp_data_points_failed_total",
+				Help: "The number of data points that could not be exported to the OTLP endpoint.",
+			},
+		),
+	}
+}
+
+// storeTelemetry holds the self metrics that stores of a managed resource report to.
+type storeTelemetry struct {
+
+	// updatesSkipped counts the object updates that were not re-rendered.
+	updatesSkipped prometheus.Counter
+
+	// updatesRendered counts the object updates that were re-rendered.
+	updatesRendered prometheus.Counter
+}
+
+// forResource returns the store self metrics for the given managed resource.
+func (t *telemetry) forResource(resource string) storeTelemetry {
+	return storeTelemetry{
+		updatesSkipped:  t.updatesSkippedTotalVec.WithLabelValues(resource),
+		updatesRendered: t.updatesRenderedTotalVec.WithLabelValues(resource),
+	}
+}
+
+// deleteResource drops all self metrics for the given managed resource.
+func (t *telemetry) deleteResource(resource string) {
+	t.celCostTotalVec.DeleteLabelValues(resource)
+	t.updatesSkippedTotalVec.DeleteLabelValues(resource)
+	t.updatesRenderedTotalVec.DeleteLabelValues(resource)
+}
+
+// observeUpdate records whether an object update was skipped, or re-rendered. Stores without telemetry, for e.g., the
+// ones built in tests, record nothing.
+func (t storeTelemetry) observeUpdate(skipped bool) {
+	switch {
+	case skipped && t.updatesSkipped != nil:
+		t.updatesSkipped.Inc()
+	case !skipped && t.updatesRendered != nil:
+		t.updatesRendered.Inc()
+	}
+}
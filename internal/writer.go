@@ -17,51 +17,225 @@ limitations under the License.
 package internal
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"google.golang.org/protobuf/encoding/protowire"
 )
 
 // metricsWriter knows how to write metrics for the groups of metric families present in the group of stores it holds
 // to an io.Writer.
 type metricsWriter struct {
 	stores []*StoreType
+
+	// filter narrows down the families, and series, written out.
+	filter *seriesFilter
 }
 
 // newMetricsWriter returns a new metricsWriter.
 func newMetricsWriter(stores ...*StoreType) *metricsWriter {
+	return newFilteredMetricsWriter(&seriesFilter{}, stores...)
+}
+
+// newFilteredMetricsWriter returns a new metricsWriter that only writes out what passes the given filter.
+func newFilteredMetricsWriter(filter *seriesFilter, stores ...*StoreType) *metricsWriter {
 	return &metricsWriter{
 		stores: stores,
+		filter: filter,
 	}
 }
 
-// writeAllTo writes out metrics from the underlying stores to the given writer per resource. It writes metrics so that
-// the ones with the same name are grouped together when written out, and guarantees an exposition format that is safe
-// to be ingested by Prometheus.
+// familyGroup holds all families with the same name across stores, to be written out under a single header.
+type familyGroup struct {
+
+	// first is the first family with the name, whose header the group is written out under.
+	first *familySnapshot
+
+	// families are all families with the name, and the same headers, in the order of the stores.
+	families []*familySnapshot
+
+	// stores are the stores of each of the families.
+	stores []*StoreType
+
+	// selectors are the selectors of the filter that the families' series may match.
+	selectors [][]*labels.Matcher
+}
+
+// sameHeaders reports whether the given families have the same headers, under all exposition formats.
+func sameHeaders(a, b *familySnapshot) bool {
+	return bytes.Equal(a.header, b.header) && bytes.Equal(a.openMetricsHeader, b.openMetricsHeader)
+}
+
+// writeAllTo writes out metrics from the underlying stores to the given writer, in the Prometheus text format. Families
+// with the same name are merged across stores, and written out under a single header in the order they first appear
+// in, so that the exposition is safe to be ingested by Prometheus. Families whose headers conflict with the ones of the
+// first family with the same name are dropped, see registryConflicts. Each store's latest published snapshot is written
+// out, without locking the store, so slow writers never hold up the store's mutations.
 func (m metricsWriter) writeAllTo(w io.Writer) error {
-	if len(m.stores) == 0 {
-		return nil
+	return m.write(w, false)
+}
+
+// writeOpenMetricsTo writes out metrics from the underlying stores to the given writer, in the OpenMetrics format,
+// terminated by an EOF marker. Families are merged as with writeAllTo.
+func (m metricsWriter) writeOpenMetricsTo(w io.Writer) error {
+	if err := m.write(w, true); err != nil {
+		return err
 	}
-	for _, s := range m.stores {
-		s.mutex.RLock()
-		defer s.mutex.RUnlock()
+	n, err := io.WriteString(w, "# EOF\n")
+	if err != nil {
+		return fmt.Errorf("error writing EOF marker after %d bytes: %w", n, err)
 	}
-	for j := range len(m.stores) {
-		for i, header := range m.stores[j].headers {
-			if header != "" && header != "\n" {
-				header += "\n"
+
+	return nil
+}
+
+// writeProtobufTo writes out metrics from the underlying stores to the given writer, in the delimited protobuf format.
+// Families are merged as with writeAllTo, into a single MetricFamily message each. Families without any series are not
+// written out, since they cannot be represented.
+func (m metricsWriter) writeProtobufTo(w io.Writer) error {
+	for _, group := range m.groups() {
+		var size int
+		metrics := make([][]byte, 0, len(group.families))
+		for i, f := range group.families {
+			// Filtered series are encoded for the scrape alone.
+			encoder := f.protobufSeries
+			if filteredMetrics, filtered := filterMetrics(f, group.selectors); filtered {
+				encoder = &protobufSeries{metrics: filteredMetrics}
 			}
-			n, err := w.Write([]byte(header))
+			encoded := encoder.encode(group.stores[i].logger.WithValues("family", f.name))
+			size += len(encoded)
+			metrics = append(metrics, encoded)
+		}
+		if size == 0 {
+			continue
+		}
+
+		// Write out the message, prefixed with its length.
+		header := group.first.protobufHeader
+		n, err := w.Write(protowire.AppendVarint(nil, uint64(len(header)+size)))
+		if err != nil {
+			return fmt.Errorf("error writing message length after %d bytes: %w", n, err)
+		}
+		n, err = w.Write(header)
+		if err != nil {
+			return fmt.Errorf("error writing header fields after %d bytes: %w", n, err)
+		}
+		for _, encoded := range metrics {
+			n, err = w.Write(encoded)
 			if err != nil {
-				return fmt.Errorf("error writing Help text (%s) after %d bytes: %w", header, n, err)
+				return fmt.Errorf("error writing metric family after %d bytes: %w", n, err)
 			}
-			for _, metricFamilies := range m.stores[j].metrics {
-				n, err = w.Write([]byte(metricFamilies[i]))
-				if err != nil {
-					return fmt.Errorf("error writing metric family after %d bytes: %w", n, err)
-				}
+		}
+	}
+
+	return nil
+}
+
+// write writes out metrics from the underlying stores to the given writer, in either text exposition format.
+func (m metricsWriter) write(w io.Writer, openMetrics bool) error {
+	for _, group := range m.groups() {
+		var size int
+		allSeries := make([][]byte, 0, len(group.families))
+		for _, f := range group.families {
+			series, ends := f.series, f.seriesEnds
+			if openMetrics {
+				series, ends = f.openMetricsSeries, f.openMetricsSeriesEnds
+			}
+			series, _ = filterSeries(f, group.selectors, series, ends)
+			size += len(series)
+			allSeries = append(allSeries, series)
+		}
+
+		// Families left without any series by the selectors are not written out.
+		if size == 0 && len(group.selectors) > 0 {
+			continue
+		}
+		header := group.first.header
+		if openMetrics {
+			header = group.first.openMetricsHeader
+		}
+		n, err := w.Write(header)
+		if err != nil {
+			return fmt.Errorf("error writing Help text (%s) after %d bytes: %w", header, n, err)
+		}
+		for _, series := range allSeries {
+			n, err = w.Write(series)
+			if err != nil {
+				return fmt.Errorf("error writing metric family after %d bytes: %w", n, err)
 			}
 		}
 	}
 
 	return nil
 }
+
+// groups groups the families of the underlying stores by name, in the order they first appear in. Families whose
+// headers conflict with the ones of the first family with the same name are dropped, as are families that the filter
+// excludes.
+func (m metricsWriter) groups() []*familyGroup {
+	var groups []*familyGroup
+	groupsByName := map[string]*familyGroup{}
+	for _, s := range m.stores {
+		families := s.loadSnapshot().families
+		for i := range families {
+			f := &families[i]
+			group, ok := groupsByName[f.name]
+			if !ok {
+				// Excluded families are recorded without a group, so that later ones with the same name are excluded too.
+				if selectors, keep := m.filter.familySelectors(f); keep {
+					group = &familyGroup{first: f, selectors: selectors}
+					groups = append(groups, group)
+				}
+				groupsByName[f.name] = group
+			}
+			if group == nil || !sameHeaders(group.first, f) {
+				continue
+			}
+			group.families = append(group.families, f)
+			group.stores = append(group.stores, s)
+		}
+	}
+
+	return groups
+}
+
+// registryConflicts returns the families that the stores of each resource in the given registry snapshot define with
+// the same name as, but different headers than, a family defined before them, either by a previous store of the same
+// resource, or by any store of a resource with a preceding key. This mirrors the writers, that only write out the
+// family that appears first, in the order of resource keys. All resources are included, with or without conflicts.
+func registryConflicts(snapshot *registrySnapshot) map[string][]string {
+	type definition struct {
+		family *familySnapshot
+		key    string
+	}
+	definitions := map[string]definition{}
+	conflicts := make(map[string][]string, len(snapshot.keys))
+	for _, key := range snapshot.keys {
+		conflicts[key] = nil
+		for _, s := range snapshot.stores[key] {
+			families := s.loadSnapshot().families
+			for i := range families {
+				d, ok := definitions[families[i].name]
+				if !ok {
+					definitions[families[i].name] = definition{family: &families[i], key: key}
+
+					continue
+				}
+				if sameHeaders(d.family, &families[i]) {
+					continue
+				}
+				if d.key == key {
+					conflicts[key] = append(conflicts[key],
+						fmt.Sprintf("family %q is defined more than once with different help text, types, or units", families[i].name))
+				} else {
+					conflicts[key] = append(conflicts[key],
+						fmt.Sprintf("family %q is defined by %s with different help text, types, or units", families[i].name, d.key))
+				}
+			}
+		}
+	}
+
+	return conflicts
+}
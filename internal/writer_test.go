@@ -0,0 +1,352 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rexagod/crdmetrics/pkg/resolver"
+	"google.golang.org/protobuf/encoding/protodelim"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+func TestMetricsWriterMergesFamilies(t *testing.T) {
+	t.Parallel()
+
+	stores := []*StoreType{
+		newTestStore(t, []*FamilyType{newTestFamily("foo_replicas", "Replicas")}, newTestObject("a", 1)),
+		newTestStore(t, []*FamilyType{newTestFamily("foo_other", "Other")}, newTestObject("b", 1)),
+		newTestStore(t, []*FamilyType{newTestFamily("foo_replicas", "Replicas")}, newTestObject("c", 1)),
+		newTestStore(t, []*FamilyType{newTestFamily("foo_replicas", "Conflicting replicas")}, newTestObject("d", 1)),
+	}
+	out := &strings.Builder{}
+	if err := newMetricsWriter(stores...).writeAllTo(out); err != nil {
+		t.Fatalf("failed to write metrics: %v", err)
+	}
+	want := `# HELP kube_customresource_foo_replicas Replicas
+# TYPE kube_customresource_foo_replicas gauge
+kube_customresource_foo_replicas{name="a",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1.000000
+kube_customresource_foo_replicas{name="c",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1.000000
+# HELP kube_customresource_foo_other Other
+# TYPE kube_customresource_foo_other gauge
+kube_customresource_foo_other{name="b",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1.000000
+`
+	if got := out.String(); got != want {
+		t.Fatalf("got metrics:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestMetricsWriterProtobuf(t *testing.T) {
+	t.Parallel()
+
+	stores := []*StoreType{
+		newTestStore(t, []*FamilyType{newTestFamily("foo_replicas", "Replicas")}, newTestObject("a", 1)),
+		newTestStore(t, []*FamilyType{newTestFamily("foo_escaped", "Escaped")}, newTestObject("f\"\n", 1)),
+		newTestStore(t, []*FamilyType{newTestFamily("foo_other", "Other")}, newTestObject("b", 1)),
+		newTestStore(t, []*FamilyType{newTestFamily("foo_replicas", "Replicas")}, newTestObject("c", 1)),
+		newTestStore(t, []*FamilyType{newTestFamily("foo_replicas", "Conflicting replicas")}, newTestObject("d", 1)),
+	}
+
+	// Families without any series are not written out.
+	empty := newTestStore(t, []*FamilyType{newTestFamily("foo_empty", "Empty")}, newTestObject("e", 1))
+	if err := empty.Delete(newTestObject("e", 1)); err != nil {
+		t.Fatalf("failed to delete object: %v", err)
+	}
+	stores = append(stores, empty)
+
+	out := &bytes.Buffer{}
+	if err := newMetricsWriter(stores...).writeProtobufTo(out); err != nil {
+		t.Fatalf("failed to write metrics: %v", err)
+	}
+
+	// Write again, to exercise the encoded series cached by the first write.
+	cached := &bytes.Buffer{}
+	if err := newMetricsWriter(stores...).writeProtobufTo(cached); err != nil {
+		t.Fatalf("failed to write metrics: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), cached.Bytes()) {
+		t.Fatalf("got different metrics across writes")
+	}
+
+	decode := func(out *bytes.Buffer) []string {
+		var got []string
+		for {
+			family := &dto.MetricFamily{}
+			err := protodelim.UnmarshalFrom(out, family)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatalf("failed to decode metrics: %v", err)
+			}
+			if family.GetType() != dto.MetricType_GAUGE {
+				t.Errorf("got type %s for family %q, want %s", family.GetType(), family.GetName(), dto.MetricType_GAUGE)
+			}
+			for _, metric := range family.GetMetric() {
+				got = append(got, fmt.Sprintf("%s %s %q %v", family.GetName(), family.GetHelp(), metric.GetLabel()[0].GetValue(), metric.GetGauge().GetValue()))
+			}
+		}
+
+		return got
+	}
+
+	// Label values are not escaped under protobuf.
+	want := []string{
+		`kube_customresource_foo_replicas Replicas "a" 1`,
+		`kube_customresource_foo_replicas Replicas "c" 1`,
+		`kube_customresource_foo_escaped Escaped "f\"\n" 1`,
+		`kube_customresource_foo_other Other "b" 1`,
+	}
+	if got := decode(out); !slices.Equal(got, want) {
+		t.Fatalf("got metrics %q, want %q", got, want)
+	}
+
+	// Filtered series are encoded for the write alone.
+	filter, err := newSeriesFilter(url.Values{matchQueryParameter: []string{`{name="c"}`}})
+	if err != nil {
+		t.Fatalf("failed to create filter: %v", err)
+	}
+	filtered := &bytes.Buffer{}
+	if err = newFilteredMetricsWriter(filter, stores...).writeProtobufTo(filtered); err != nil {
+		t.Fatalf("failed to write metrics: %v", err)
+	}
+	want = []string{`kube_customresource_foo_replicas Replicas "c" 1`}
+	if got := decode(filtered); !slices.Equal(got, want) {
+		t.Fatalf("got filtered metrics %q, want %q", got, want)
+	}
+	cached.Reset()
+	if err = newMetricsWriter(stores...).writeProtobufTo(cached); err != nil {
+		t.Fatalf("failed to write metrics: %v", err)
+	}
+	if got := len(decode(cached)); got != 4 {
+		t.Fatalf("got %d metrics after a filtered write, want 4", got)
+	}
+}
+
+func TestRegistryConflicts(t *testing.T) {
+	t.Parallel()
+
+	registry := newStoreRegistry()
+	storeWithFamily := func(name, help string) *StoreType {
+		return newTestStore(t, []*FamilyType{newTestFamily(name, help)}, newTestObject("foo", 1))
+	}
+
+	// Conflicts are flagged on the resource that comes last in key order, whichever was reconciled last.
+	registry.swap("ns/c", nil, storeWithFamily("foo_replicas", "Other replicas"), storeWithFamily("foo_new", "New"), storeWithFamily("foo_new", "Newer"))
+	registry.swap("ns/b", nil, storeWithFamily("foo_replicas", "Replicas"))
+	registry.swap("ns/a", nil, storeWithFamily("foo_replicas", "Replicas"))
+	want := map[string][]string{
+		"ns/a": nil,
+		"ns/b": nil,
+		"ns/c": {
+			`family "foo_replicas" is defined by ns/a with different help text, types, or units`,
+			`family "foo_new" is defined more than once with different help text, types, or units`,
+		},
+	}
+	if diff := cmp.Diff(want, registryConflicts(registry.snapshot())); diff != "" {
+		t.Fatalf("unexpected conflicts (-want +got):\n%s", diff)
+	}
+
+	// Conflicts move along with the first definition as resources are dropped.
+	registry.drop("ns/a")
+	registry.drop("ns/b")
+	want = map[string][]string{
+		"ns/c": {`family "foo_new" is defined more than once with different help text, types, or units`},
+	}
+	if diff := cmp.Diff(want, registryConflicts(registry.snapshot())); diff != "" {
+		t.Fatalf("unexpected conflicts (-want +got):\n%s", diff)
+	}
+}
+
+func TestMetricsWriterOpenMetrics(t *testing.T) {
+	t.Parallel()
+
+	plan, err := newStorePlan(&StoreType{
+		Group:   "samplecontroller.k8s.io",
+		Version: "v1alpha1",
+		Kind:    "Foo",
+		Families: []*FamilyType{
+			{
+				Name: "foo_replicas",
+				Help: "Replicas",
+				Metrics: []*MetricType{{
+					LabelKeys:   []string{"name"},
+					LabelValues: []string{"metadata.name"},
+					Value:       "spec.replicas",
+				}},
+			},
+			{
+				Name:    "foo_restarts",
+				Help:    "Restarts",
+				Kind:    FamilyKindCounter,
+				Created: true,
+				Metrics: []*MetricType{{
+					LabelKeys:   []string{"name"},
+					LabelValues: []string{"metadata.name"},
+					Value:       "spec.replicas",
+				}},
+			},
+			{
+				Name: "foo_age_seconds",
+				Help: "Age",
+				Unit: "seconds",
+				Metrics: []*MetricType{{
+					LabelKeys:   []string{"name"},
+					LabelValues: []string{"metadata.name"},
+					Value:       "spec.replicas",
+				}},
+			},
+			{
+				Name: "foo",
+				Help: "Information",
+				Kind: FamilyKindInfo,
+				Metrics: []*MetricType{{
+					LabelKeys:   []string{"name", "namespace"},
+					LabelValues: []string{"metadata.name", "metadata.namespace"},
+				}},
+			},
+			{
+				Name: "foo_namespaced",
+				Help: "Namespaced",
+				Kind: FamilyKindStateSet,
+				Metrics: []*MetricType{{
+					LabelKeys:   []string{"name", "foo_namespaced"},
+					LabelValues: []string{"metadata.name", "metadata.namespace"},
+					Value:       "spec.replicas",
+				}},
+			},
+		},
+	}, resolver.Options{Logger: klog.Background()})
+	if err != nil {
+		t.Fatalf("failed to compile plan: %v", err)
+	}
+	s := newStore(context.Background(), klog.Background(), plan)
+	object := newTestObject("a", 2)
+	object.SetCreationTimestamp(metav1.Unix(1700000000, 0))
+	if err = s.Add(object); err != nil {
+		t.Fatalf("failed to add object: %v", err)
+	}
+
+	out := &strings.Builder{}
+	if err = newMetricsWriter(s).writeOpenMetricsTo(out); err != nil {
+		t.Fatalf("failed to write metrics: %v", err)
+	}
+	want := `# HELP kube_customresource_foo_replicas Replicas
+# TYPE kube_customresource_foo_replicas gauge
+kube_customresource_foo_replicas{name="a",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 2.000000
+# HELP kube_customresource_foo_restarts Restarts
+# TYPE kube_customresource_foo_restarts counter
+kube_customresource_foo_restarts_total{name="a",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 2.000000
+kube_customresource_foo_restarts_created{name="a",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1700000000
+# HELP kube_customresource_foo_age_seconds Age
+# TYPE kube_customresource_foo_age_seconds gauge
+# UNIT kube_customresource_foo_age_seconds seconds
+kube_customresource_foo_age_seconds{name="a",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 2.000000
+# HELP kube_customresource_foo Information
+# TYPE kube_customresource_foo info
+kube_customresource_foo_info{name="a",namespace="default",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1.000000
+# HELP kube_customresource_foo_namespaced Namespaced
+# TYPE kube_customresource_foo_namespaced stateset
+kube_customresource_foo_namespaced{name="a",kube_customresource_foo_namespaced="default",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1.000000
+# EOF
+`
+	if got := out.String(); got != want {
+		t.Fatalf("got metrics:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Created series follow the series they accompany through filters.
+	other := newTestObject("b", 3)
+	other.SetCreationTimestamp(metav1.Unix(1700000001, 0))
+	if err = s.Add(other); err != nil {
+		t.Fatalf("failed to add object: %v", err)
+	}
+	filter, err := newSeriesFilter(url.Values{matchQueryParameter: {`kube_customresource_foo_restarts_total{name="b"}`}})
+	if err != nil {
+		t.Fatalf("failed to create filter: %v", err)
+	}
+	out.Reset()
+	if err = newFilteredMetricsWriter(filter, s).writeOpenMetricsTo(out); err != nil {
+		t.Fatalf("failed to write metrics: %v", err)
+	}
+	want = `# HELP kube_customresource_foo_restarts Restarts
+# TYPE kube_customresource_foo_restarts counter
+kube_customresource_foo_restarts_total{name="b",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 3.000000
+kube_customresource_foo_restarts_created{name="b",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1700000001
+# EOF
+`
+	if got := out.String(); got != want {
+		t.Fatalf("got filtered metrics:\n%s\nwant:\n%s", got, want)
+	}
+
+	// The text format exposes all families as gauges, and does not expose created timestamps.
+	out.Reset()
+	if err = newMetricsWriter(s).writeAllTo(out); err != nil {
+		t.Fatalf("failed to write metrics: %v", err)
+	}
+	if got := out.String(); strings.Contains(got, "_created") || strings.Contains(got, "# UNIT") || strings.Contains(got, "# EOF") {
+		t.Fatalf("got OpenMetrics-only text in the text format:\n%s", got)
+	}
+}
+
+func TestFamilyValidate(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name    string
+		family  FamilyType
+		wantErr bool
+	}{
+		{
+			name:   "gauge",
+			family: FamilyType{Name: "foo_age_seconds", Unit: "seconds"},
+		},
+		{
+			name:    "unknown kind",
+			family:  FamilyType{Name: "foo", Kind: "summary"},
+			wantErr: true,
+		},
+		{
+			name:    "unit without suffix",
+			family:  FamilyType{Name: "foo_age", Unit: "seconds"},
+			wantErr: true,
+		},
+		{
+			name:   "created counter",
+			family: FamilyType{Name: "foo_restarts", Kind: FamilyKindCounter, Created: true},
+		},
+		{
+			name:    "created gauge",
+			family:  FamilyType{Name: "foo_restarts", Created: true},
+			wantErr: true,
+		},
+	} {
+		if err := tc.family.validate(); (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error %t", tc.name, err, tc.wantErr)
+		}
+	}
+}
@@ -29,6 +29,7 @@ import (
 	"go.uber.org/automaxprocs/maxprocs"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
 )
@@ -92,9 +93,14 @@ func main() {
 		logger.Error(err, "Error building dynamic clientset")
 		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 	}
+	metadataClientset, err := metadata.NewForConfig(cfg)
+	if err != nil {
+		logger.Error(err, "Error building metadata clientset")
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	}
 
 	// Start the controller.
-	c := internal.NewController(ctx, options, kubeClientset, crdmetricsClientset, dynamicClientset)
+	c := internal.NewController(ctx, options, kubeClientset, crdmetricsClientset, dynamicClientset, metadataClientset)
 	if err = c.Run(ctx, *options.Workers); err != nil {
 		logger.Error(err, "Error running controller")
 		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
@@ -30,30 +30,36 @@ const (
 
 	// ConditionTypeFailed represents the condition type for resource that has failed to process further.
 	ConditionTypeFailed
+
+	// ConditionTypeConflicted represents the condition type for a resource that defines metric families which conflict
+	// with the ones defined by itself, or by other resources.
+	ConditionTypeConflicted
 )
 
 var (
 
 	// ConditionType is a slice of strings representing the condition types.
-	ConditionType = []string{"Processed", "Failed"}
+	ConditionType = []string{"Processed", "Failed", "Conflicted"}
 
 	// ConditionMessageTrue is a group of condition messages applicable when the associated condition status is true.
 	ConditionMessageTrue = []string{
 		"Resource configuration has been processed successfully",
 		"Resource failed to process",
+		"Resource defines conflicting metric families, that will not be exposed",
 	}
 
 	// ConditionMessageFalse is a group of condition messages applicable when the associated condition status is false.
 	ConditionMessageFalse = []string{
 		"Resource configuration is yet to be processed",
 		"N/A",
+		"Resource defines no conflicting metric families",
 	}
 
 	// ConditionReasonTrue is a group of condition reasons applicable when the associated condition status is true.
-	ConditionReasonTrue = []string{"EventHandlerSucceeded", "EventHandlerFailed"}
+	ConditionReasonTrue = []string{"EventHandlerSucceeded", "EventHandlerFailed", "FamilyConflictsFound"}
 
 	// ConditionReasonFalse is a group of condition reasons applicable when the associated condition status is false.
-	ConditionReasonFalse = []string{"EventHandlerRunning", "N/A"}
+	ConditionReasonFalse = []string{"EventHandlerRunning", "N/A", "NoFamilyConflicts"}
 )
 
 // +genclient
@@ -61,6 +67,10 @@ var (
 // +kubebuilder:object:root=true
 // +kubebuilder:resource:singular=crdmetricsresource,scope=Cluster,shortName=crdmr
 // +kubebuilder:rbac:groups=crdmetrics.instrumentation.k8s-sigs.io,resources=crdmetricsresources;crdmetricsresources/status,verbs=*
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get
+// +kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get
+// +kubebuilder:rbac:groups=authentication.k8s.io,resources=tokenreviews,verbs=create
+// +kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
 // +kubebuilder:subresource:status
 
 // CRDMetricsResource is a specification for a CRDMetricsResource resource.
@@ -97,7 +107,7 @@ type CRDMetricsResourceStatus struct {
 	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
-// Set sets the given condition for the resource.
+// Set sets the given condition for the resource, keeping its transition time if it is unchanged.
 func (status *CRDMetricsResourceStatus) Set(
 	resource *CRDMetricsResource,
 	condition metav1.Condition,
@@ -122,6 +132,11 @@ func (status *CRDMetricsResourceStatus) Set(
 	// Check if the condition already exists.
 	for i, existingCondition := range status.Conditions {
 		if existingCondition.Type == condition.Type {
+			// Keep the transition time unless the condition's status changed.
+			if existingCondition.Status == condition.Status {
+				condition.LastTransitionTime = existingCondition.LastTransitionTime
+			}
+
 			// Update the existing condition.
 			status.Conditions[i] = condition
 
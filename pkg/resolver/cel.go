@@ -17,30 +17,145 @@ limitations under the License.
 package resolver
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker"
+	celast "github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/operators"
 	"github.com/google/cel-go/common/types"
 	"github.com/google/cel-go/common/types/ref"
 	"github.com/google/cel-go/interpreter"
 	"k8s.io/klog/v2"
 )
 
+// CELResolverName is the name the CEL resolver is registered under.
+const CELResolverName = "cel"
+
+// celObjectVariable is the variable that the object is injected as. Queries follow the format: o.<A>.<AB>.<ABC>...
+const celObjectVariable = "o"
+
+// DefaultCostLimit is the default runtime cost limit for a single CEL evaluation.
+// This gives ~0.1s for each CEL expression evaluation.
+const DefaultCostLimit uint64 = 1000000
+
+// CELOptions holds the configuration specific to the CEL resolver.
+type CELOptions struct {
+
+	// CostLimit is the maximum runtime cost a single evaluation may incur. Zero means DefaultCostLimit.
+	CostLimit uint64
+
+	// Timeout is the maximum wall-clock time a single evaluation may take. Zero means no timeout.
+	Timeout time.Duration
+
+	// CostObserver, if set, is called with the runtime cost of each evaluation, unless evaluated under a context returned
+	// by WithoutCostObserver.
+	CostObserver func(cost uint64)
+
+	// EnvOptions are additional CEL environment options, such as custom functions, made available to expressions.
+	EnvOptions []cel.EnvOption
+}
+
+// withoutCostObserverKey is the context key that marks evaluations whose cost is not observed.
+type withoutCostObserverKey struct{}
+
+// WithoutCostObserver returns a context whose evaluations are not reported to the CostObserver, for e.g., to evaluate
+// queries for introspection, without accounting their cost to the resource.
+func WithoutCostObserver(ctx context.Context) context.Context {
+	return context.WithValue(ctx, withoutCostObserverKey{}, true)
+}
+
 // CELResolver represents a resolver for CEL expressions.
 type CELResolver struct {
 	logger klog.Logger
+
+	// costLimit is the maximum runtime cost a single evaluation may incur.
+	costLimit uint64
+
+	// timeout is the maximum wall-clock time a single evaluation may take.
+	timeout time.Duration
+
+	// costObserver is called with the runtime cost of each evaluation.
+	costObserver func(cost uint64)
+
+	// env is the CEL environment all queries are compiled in.
+	env *cel.Env
+
+	// programsMutex guards programs.
+	programsMutex sync.RWMutex
+
+	// programs caches the compiled programs, indexed by their queries, so each query is only compiled once.
+	programs map[string]compiledQuery
+}
+
+// compiledQuery holds the outcome of compiling a query.
+type compiledQuery struct {
+
+	// program is the compiled program, if compilation succeeded.
+	program cel.Program
+
+	// err is the compilation error, if any.
+	err error
 }
 
 // CELResolver implements the Resolver interface.
 var _ Resolver = &CELResolver{}
 
+// CELResolver implements the Compiler interface.
+var _ Compiler = &CELResolver{}
+
+// CELResolver implements the PathAnalyzer interface.
+var _ PathAnalyzer = &CELResolver{}
+
+func init() {
+	Register(CELResolverName, func(options Options) (Resolver, error) {
+		return NewCELResolver(options.Logger, options.CEL)
+	})
+}
+
 // NewCELResolver returns a new CEL resolver.
-func NewCELResolver(logger klog.Logger) *CELResolver {
-	return &CELResolver{logger: logger}
+func NewCELResolver(logger klog.Logger, options CELOptions) (*CELResolver, error) {
+	costLimit := options.CostLimit
+	if costLimit == 0 {
+		costLimit = DefaultCostLimit
+	}
+
+	// Create a custom CEL environment.
+	env, err := cel.NewEnv(append([]cel.EnvOption{
+		cel.CrossTypeNumericComparisons(true),
+		cel.DefaultUTCTimeZone(true),
+		cel.EagerlyValidateDeclarations(true),
+		cel.Variable(celObjectVariable, cel.DynType),
+	}, options.EnvOptions...)...)
+	if err != nil {
+		return nil, fmt.Errorf("error creating CEL environment: %w", err)
+	}
+
+	return &CELResolver{
+		logger:       logger,
+		costLimit:    costLimit,
+		timeout:      options.Timeout,
+		costObserver: options.CostObserver,
+		env:          env,
+		programs:     map[string]compiledQuery{},
+	}, nil
 }
 
+// maxEstimatedSize is the size, i.e., the length or number of elements, that variable length data in the object is
+// assumed to be at most during static cost estimation. The object's schema is not known, so this does not bound all
+// objects, but objects seldom hold more in any one field, and it is low enough that, for e.g., nested comprehensions
+// are rejected while a single pass over a list is not. Objects beyond it are still bound by the runtime cost limit.
+const maxEstimatedSize = 10000
+
+// evaluationInterruptCheckFrequency is the number of comprehension iterations after which an evaluation checks if it
+// has been interrupted, i.e., if its context is done.
+const evaluationInterruptCheckFrequency = 100
+
 // costEstimator helps estimate the runtime cost of CEL queries.
 type costEstimator struct{}
 
@@ -61,67 +176,125 @@ func (ce costEstimator) CallCost(function, _ string, args []ref.Val, result ref.
 	return &estimatedCost
 }
 
-// Resolve resolves the given query against the given unstructured object.
-func (cr *CELResolver) Resolve(query string, unstructuredObjectMap map[string]interface{}) map[string]string {
-	logger := cr.logger.WithValues("query", query)
+// costEstimator implements the CostEstimator interface.
+var _ checker.CostEstimator = costEstimator{}
 
-	// Create a custom CEL environment.
-	env, err := cel.NewEnv(
-		cel.CrossTypeNumericComparisons(true),
-		cel.DefaultUTCTimeZone(true),
-		cel.EagerlyValidateDeclarations(true),
-	)
-	if err != nil {
-		logger.Error(fmt.Errorf("error creating CEL environment: %w", err), "ignoring resolution for query")
+// EstimateSize helps set the worst-case size of variable length data for static cost estimation. Nothing is known about
+// the object at compile time, so all such data is assumed to be at most maxEstimatedSize.
+func (ce costEstimator) EstimateSize(_ checker.AstNode) *checker.SizeEstimate {
+	return &checker.SizeEstimate{Min: 0, Max: maxEstimatedSize}
+}
+
+// EstimateCallCost helps set the worst-case cost of function calls for static cost estimation. Returning nil falls
+// back to the default estimates.
+func (ce costEstimator) EstimateCallCost(_, _ string, _ *checker.AstNode, _ []checker.AstNode) *checker.CallEstimate {
+	return nil
+}
 
-		return map[string]string{query: query}
+// Compile compiles the given query, so that it is only compiled once across resolutions. The cost of the query is
+// estimated, and the query is rejected if its worst-case cost exceeds the cost limit. The cost limit is also enforced
+// during evaluation, for objects whose data exceeds the sizes assumed by the estimate. Queries that do not compile are
+// not rejected, since they may still resolve under a literal resolution failure policy.
+func (cr *CELResolver) Compile(query string) error {
+	_, err := cr.compile(query)
+
+	return err
+}
+
+// compile returns the cached compiled program for the given query, compiling it if needed. Only errors pertaining to
+// the cost limit are returned, other compilation errors are cached alongside the query instead.
+func (cr *CELResolver) compile(query string) (compiledQuery, error) {
+	cr.programsMutex.RLock()
+	compiled, ok := cr.programs[query]
+	cr.programsMutex.RUnlock()
+	if ok {
+		return compiled, nil
 	}
 
 	// Parse.
-	ast, iss := env.Parse(query)
+	ast, iss := cr.env.Parse(query)
 	if iss.Err() != nil {
-		logger.Error(fmt.Errorf("error parsing CEL query: %w", iss.Err()), "ignoring resolution for query")
+		compiled.err = fmt.Errorf("error parsing CEL query: %w", iss.Err())
+	} else {
+
+		// Check, and estimate the worst-case cost for queries that type-check. Queries that do not are still compiled,
+		// in which case they fail during evaluation.
+		checkedAST, iss := cr.env.Check(ast)
+		if iss.Err() == nil {
+			estimate, err := cr.env.EstimateCost(checkedAST, costEstimator{})
+			if err != nil {
+				return compiled, fmt.Errorf("error estimating cost of CEL query %q: %w", query, err)
+			}
+			if estimate.Max > cr.costLimit {
+				return compiled, fmt.Errorf("estimated worst-case cost (%d) of CEL query %q exceeds the cost limit (%d)",
+					estimate.Max, query, cr.costLimit)
+			}
+			ast = checkedAST
+		} else {
+			cr.logger.V(4).Info("skipping cost estimation for query", "query", query, "reason", iss.Err())
+		}
 
-		return map[string]string{query: query}
+		// Compile.
+		var err error
+		compiled.program, err = cr.env.Program(
+			ast,
+			cel.CostLimit(cr.costLimit),
+			cel.CostTracking(new(costEstimator)),
+			cel.InterruptCheckFrequency(evaluationInterruptCheckFrequency),
+		)
+		if err != nil {
+			compiled.err = fmt.Errorf("error compiling CEL query: %w", err)
+		}
 	}
 
-	// Compile.
-	// costLimit gives ~0.1s for each CEL expression validation call.
-	const costLimit = 1000000
-	var program cel.Program
-	program, err = env.Program(
-		ast,
-		cel.CostLimit(costLimit),
-		cel.CostTracking(new(costEstimator)),
-	)
-	if err != nil {
-		logger.Error(fmt.Errorf("error compiling CEL query: %w", err), "ignoring resolution for query")
+	cr.programsMutex.Lock()
+	cr.programs[query] = compiled
+	cr.programsMutex.Unlock()
+
+	return compiled, nil
+}
 
-		return map[string]string{query: query}
+// Resolve resolves the given query against the given unstructured object.
+func (cr *CELResolver) Resolve(ctx context.Context, query string, unstructuredObjectMap map[string]interface{}) (map[string]string, error) {
+	logger := cr.logger.WithValues("query", query)
+
+	// Fetch the compiled program.
+	compiled, err := cr.compile(query)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrResolutionFailed, err)
+	}
+	if compiled.err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrResolutionFailed, compiled.err)
 	}
 
-	// Inject the object and evaluate.
+	// Inject the object and evaluate, within the evaluation timeout, if any.
+	if cr.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cr.timeout)
+		defer cancel()
+	}
 	var out ref.Val
 	var evalDetails *cel.EvalDetails
-	out, evalDetails, err = program.Eval(map[string]interface{}{
-		"o" /* Queries will follow the format: o.<A>.<AB>.<ABC>... */ : unstructuredObjectMap,
+	out, evalDetails, err = compiled.program.ContextEval(ctx, map[string]interface{}{
+		celObjectVariable: unstructuredObjectMap,
 	})
 	logger = logger.WithValues(
-		"costLimit", costLimit,
+		"costLimit", cr.costLimit,
 	)
-	if evalDetails != nil {
+	if evalDetails != nil && evalDetails.ActualCost() != nil {
 		logger = logger.WithValues(
 			"queryCost", *evalDetails.ActualCost(),
 		)
+		if unobserved, _ := ctx.Value(withoutCostObserverKey{}).(bool); cr.costObserver != nil && !unobserved {
+			cr.costObserver(*evalDetails.ActualCost())
+		}
 	}
 	if err != nil {
-		logger.V(1).Info("ignoring resolution for query", "info", err)
-
-		return map[string]string{query: query}
+		return nil, fmt.Errorf("%w: error evaluating CEL query: %w", ErrResolutionFailed, err)
 	}
 	logger.V(4).Info("CEL query runtime cost")
 
-	m := map[string]string{}
+	var m map[string]string
 	switch out.Type() {
 	case types.BoolType, types.DoubleType, types.IntType, types.StringType, types.UintType:
 
@@ -132,14 +305,73 @@ func (cr *CELResolver) Resolve(query string, unstructuredObjectMap map[string]in
 	case types.ListType:
 		m = cr.resolveList(&out)
 	default:
-		logger.Error(fmt.Errorf("unsupported output type %q", out.Type()), "ignoring resolution for query")
+		return nil, fmt.Errorf("%w: unsupported output type %q", ErrResolutionFailed, out.Type())
 	}
 
 	if m == nil {
-		m = map[string]string{query: query}
+		return nil, fmt.Errorf("%w: error casting output of type %q", ErrResolutionFailed, out.Type())
 	}
 
-	return m
+	return m, nil
+}
+
+// Paths returns the paths the given query reads, by following the chains of field selections, and constant indexes,
+// applied to the object variable. The paths cannot be determined if the object variable is used in any other way, for
+// e.g., passed as a whole to a function or macro. Queries that do not parse do not read the object.
+func (cr *CELResolver) Paths(query string) ([][]string, bool) {
+	parsedAST, iss := cr.env.Parse(query)
+	if iss.Err() != nil {
+		return nil, true
+	}
+
+	var paths [][]string
+	root := celast.NavigateAST(parsedAST.NativeRep())
+	for _, ident := range celast.MatchDescendants(root, func(e celast.NavigableExpr) bool {
+		return e.Kind() == celast.IdentKind && e.AsIdent() == celObjectVariable
+	}) {
+		var path []string
+		current := ident
+		for {
+			parent, ok := current.Parent()
+			if !ok {
+				break
+			}
+			field, ok := selectedField(parent, current)
+			if !ok {
+				break
+			}
+			path = append(path, field)
+			current = parent
+		}
+		if len(path) == 0 {
+			return nil, false
+		}
+		paths = append(paths, path)
+	}
+
+	return paths, true
+}
+
+// selectedField returns the field that the given parent expression selects from the given operand expression, if any.
+func selectedField(parent, operand celast.NavigableExpr) (string, bool) {
+	switch parent.Kind() {
+	case celast.SelectKind:
+		return parent.AsSelect().FieldName(), true
+	case celast.CallKind:
+		call := parent.AsCall()
+		if call.FunctionName() != operators.Index || len(call.Args()) != 2 || call.Args()[0].ID() != operand.ID() {
+			return "", false
+		}
+		index := call.Args()[1]
+		if index.Kind() != celast.LiteralKind {
+			return "", false
+		}
+		field, ok := index.AsLiteral().Value().(string)
+
+		return field, ok
+	default:
+		return "", false
+	}
 }
 
 func (cr *CELResolver) resolveList(out *ref.Val) map[string]string {
@@ -0,0 +1,184 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolver
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"k8s.io/klog/v2"
+)
+
+func TestCELResolverPaths(t *testing.T) {
+	t.Parallel()
+
+	cr, err := NewCELResolver(klog.Background(), CELOptions{})
+	if err != nil {
+		t.Fatalf("failed to create CEL resolver: %v", err)
+	}
+
+	for _, tc := range []struct {
+		query     string
+		wantPaths [][]string
+		wantOK    bool
+	}{
+		{
+			query:     "o.metadata.name",
+			wantPaths: [][]string{{"metadata", "name"}},
+			wantOK:    true,
+		},
+		{
+			query:     `o.metadata.labels["app.kubernetes.io/name"] + o.metadata.annotations.foo`,
+			wantPaths: [][]string{{"metadata", "labels", "app.kubernetes.io/name"}, {"metadata", "annotations", "foo"}},
+			wantOK:    true,
+		},
+		{
+			query:     "has(o.spec.replicas) ? o.spec.replicas : 0",
+			wantPaths: [][]string{{"spec", "replicas"}, {"spec", "replicas"}},
+			wantOK:    true,
+		},
+		{
+			query:     "o.spec.items.map(x, x.name)",
+			wantPaths: [][]string{{"spec", "items"}},
+			wantOK:    true,
+		},
+		{
+			query:     "o.metadata.labels[o.spec.key]",
+			wantPaths: [][]string{{"metadata", "labels"}, {"spec", "key"}},
+			wantOK:    true,
+		},
+		{
+			query:  "size(o)",
+			wantOK: false,
+		},
+		{
+			query:  "42",
+			wantOK: true,
+		},
+		{
+			query:  "o.metadata.",
+			wantOK: true,
+		},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			t.Parallel()
+
+			gotPaths, gotOK := cr.Paths(tc.query)
+			if gotOK != tc.wantOK {
+				t.Fatalf("got ok %t, want %t", gotOK, tc.wantOK)
+			}
+			if tc.wantOK && !reflect.DeepEqual(gotPaths, tc.wantPaths) {
+				t.Fatalf("got paths %q, want %q", gotPaths, tc.wantPaths)
+			}
+		})
+	}
+}
+
+func TestCELResolverCostLimit(t *testing.T) {
+	t.Parallel()
+
+	newObject := func(n int) map[string]interface{} {
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i] = map[string]interface{}{"name": "item"}
+		}
+
+		return map[string]interface{}{"spec": map[string]interface{}{"items": items}}
+	}
+
+	for _, tc := range []struct {
+		name           string
+		costLimit      uint64
+		query          string
+		items          int
+		wantCompileErr bool
+		wantResolveErr bool
+	}{
+		{
+			name:  "comprehension under the default limit",
+			query: "o.spec.items.map(x, x.name).size()",
+			items: 100,
+		},
+		{
+			name:           "nested comprehension exceeding the default limit",
+			query:          "o.spec.items.map(x, o.spec.items.map(y, y.name)).size()",
+			wantCompileErr: true,
+		},
+		{
+			name:           "worst-case cost exceeding the limit",
+			costLimit:      1,
+			query:          "o.spec.items[0].name + o.spec.items[1].name",
+			wantCompileErr: true,
+		},
+		{
+			// The limit admits the estimated worst-case cost, but not that of objects beyond the estimated sizes.
+			name:           "comprehension exceeding the limit at runtime",
+			costLimit:      2 * maxEstimatedSize * 10,
+			query:          "o.spec.items.map(x, x.name).size()",
+			items:          2 * maxEstimatedSize,
+			wantResolveErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cr, err := NewCELResolver(klog.Background(), CELOptions{CostLimit: tc.costLimit})
+			if err != nil {
+				t.Fatalf("failed to create CEL resolver: %v", err)
+			}
+			err = cr.Compile(tc.query)
+			if gotCompileErr := err != nil; gotCompileErr != tc.wantCompileErr {
+				t.Fatalf("got compile error %v, want error %t", err, tc.wantCompileErr)
+			}
+			if tc.wantCompileErr {
+				return
+			}
+			_, err = cr.Resolve(context.Background(), tc.query, newObject(tc.items))
+			if tc.wantResolveErr != errors.Is(err, ErrResolutionFailed) {
+				t.Fatalf("got resolve error %v, want error %t", err, tc.wantResolveErr)
+			}
+		})
+	}
+}
+
+func TestCELResolverCostObserver(t *testing.T) {
+	t.Parallel()
+
+	var observed uint64
+	cr, err := NewCELResolver(klog.Background(), CELOptions{CostObserver: func(cost uint64) { observed += cost }})
+	if err != nil {
+		t.Fatalf("failed to create CEL resolver: %v", err)
+	}
+	object := map[string]interface{}{"spec": map[string]interface{}{"replicas": 1}}
+	if _, err = cr.Resolve(context.Background(), "o.spec.replicas + 1", object); err != nil {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+	if observed == 0 {
+		t.Fatalf("got no observed cost, want some")
+	}
+
+	// Evaluations under a context without the observer are not reported.
+	want := observed
+	if _, err = cr.Resolve(WithoutCostObserver(context.Background()), "o.spec.replicas + 1", object); err != nil {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+	if observed != want {
+		t.Fatalf("got observed cost %d, want %d", observed, want)
+	}
+}
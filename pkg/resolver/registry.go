@@ -0,0 +1,103 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolver
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+// Options holds the configuration passed to resolver factories. Resolvers ignore the sections that do not apply to them.
+type Options struct {
+
+	// Logger is the logger the resolver should use.
+	Logger klog.Logger
+
+	// CEL holds the options specific to the CEL resolver.
+	CEL CELOptions
+}
+
+// Factory knows how to build a Resolver with the given options.
+type Factory func(options Options) (Resolver, error)
+
+var (
+
+	// factoriesMutex guards factories.
+	factoriesMutex sync.RWMutex
+
+	// factories holds all registered resolver factories, indexed by name.
+	factories = map[string]Factory{}
+)
+
+// Register makes a resolver factory available under the given name. It panics if the name is empty, the factory is nil,
+// or if a factory is already registered under the same name.
+func Register(name string, factory Factory) {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+
+	if name == "" {
+		panic("resolver: Register called with an empty name")
+	}
+	if factory == nil {
+		panic(fmt.Sprintf("resolver: Register called with a nil factory for %q", name))
+	}
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("resolver: Register called twice for %q", name))
+	}
+	factories[name] = factory
+}
+
+// Lookup returns the resolver factory registered under the given name, if any.
+func Lookup(name string) (Factory, bool) {
+	factoriesMutex.RLock()
+	defer factoriesMutex.RUnlock()
+
+	factory, ok := factories[name]
+
+	return factory, ok
+}
+
+// Names returns the sorted names of all registered resolver factories.
+func Names() []string {
+	factoriesMutex.RLock()
+	defer factoriesMutex.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// New builds a new Resolver using the factory registered under the given name.
+func New(name string, options Options) (Resolver, error) {
+	factory, ok := Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown resolver %q, expected one of %q", name, Names())
+	}
+	r, err := factory(options)
+	if err != nil {
+		return nil, fmt.Errorf("error building resolver %q: %w", name, err)
+	}
+
+	return r, nil
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2024 The Kubernetes crdmetrics Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolver
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"k8s.io/klog/v2"
+)
+
+func TestRegistryBuiltins(t *testing.T) {
+	t.Parallel()
+
+	for _, name := range []string{CELResolverName, UnstructuredResolverName} {
+		if !slices.Contains(Names(), name) {
+			t.Fatalf("got names %q, want %q among them", Names(), name)
+		}
+		if _, ok := Lookup(name); !ok {
+			t.Fatalf("failed to look up %q", name)
+		}
+		if _, err := New(name, Options{Logger: klog.Background()}); err != nil {
+			t.Fatalf("failed to build %q: %v", name, err)
+		}
+	}
+	if !slices.IsSorted(Names()) {
+		t.Fatalf("got names %q, want them sorted", Names())
+	}
+}
+
+func TestRegistryLookup(t *testing.T) {
+	t.Parallel()
+
+	errFactory := errors.New("factory error")
+	Register("test-failing", func(_ Options) (Resolver, error) {
+		return nil, errFactory
+	})
+
+	if _, ok := Lookup("test-missing"); ok {
+		t.Fatal("got a factory for an unregistered name")
+	}
+	if _, err := New("test-missing", Options{}); err == nil {
+		t.Fatal("got no error building an unregistered resolver")
+	}
+	if _, err := New("test-failing", Options{}); !errors.Is(err, errFactory) {
+		t.Fatalf("got error %v, want one wrapping %v", err, errFactory)
+	}
+}
+
+func TestRegistryRegisterPanics(t *testing.T) {
+	t.Parallel()
+
+	factory := func(_ Options) (Resolver, error) {
+		return NewUnstructuredResolver(Options{}), nil
+	}
+	for _, tc := range []struct {
+		name        string
+		factoryName string
+		factory     Factory
+	}{
+		{
+			name:        "empty name",
+			factoryName: "",
+			factory:     factory,
+		},
+		{
+			name:        "nil factory",
+			factoryName: "test-nil",
+		},
+		{
+			name:        "duplicate name",
+			factoryName: CELResolverName,
+			factory:     factory,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			defer func() {
+				if recover() == nil {
+					t.Fatal("got no panic")
+				}
+			}()
+			Register(tc.factoryName, tc.factory)
+		})
+	}
+}
@@ -16,11 +16,40 @@ limitations under the License.
 
 package resolver
 
+import (
+	"context"
+	"errors"
+)
+
+// ErrResolutionFailed is wrapped by all errors returned by resolvers when a query could not be resolved against the
+// given object. This allows callers to distinguish failures from resolutions that legitimately resolve to the query
+// itself.
+var ErrResolutionFailed = errors.New("failed to resolve query")
+
 // Resolver defines behaviors for resolving a given expression.
 type Resolver interface {
 
 	// Resolve resolves the given expression.
 	// NOTE: The returned map should have a single key:value (query:resolved[LabelValues,Value], of unit length) pair if
-	// the expression is resolved to a non-composite value.
-	Resolve(query string, unstructuredObjectMap map[string]interface{}) map[string]string
+	// the expression is resolved to a non-composite value. If the expression cannot be resolved, an error wrapping
+	// ErrResolutionFailed is returned instead.
+	Resolve(ctx context.Context, query string, unstructuredObjectMap map[string]interface{}) (map[string]string, error)
+}
+
+// Compiler defines behaviors for validating a given expression ahead of its resolution. Resolvers may optionally
+// implement it, in which case expressions are validated when the configuration is parsed.
+type Compiler interface {
+
+	// Compile returns an error if the given expression should be rejected.
+	Compile(query string) error
+}
+
+// PathAnalyzer defines behaviors for determining the parts of an object a given expression depends on. Resolvers may
+// optionally implement it, in which case watches and renders are narrowed down to those parts, where possible.
+type PathAnalyzer interface {
+
+	// Paths returns the paths, as sequences of field names from the root of the object, that the given expression may
+	// read. Each path covers everything nested under it. ok is false if the paths cannot be determined, in which case
+	// the expression must be assumed to read the whole object.
+	Paths(query string) (paths [][]string, ok bool)
 }
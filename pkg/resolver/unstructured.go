@@ -17,6 +17,7 @@ limitations under the License.
 package resolver
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
@@ -24,6 +25,9 @@ import (
 	"k8s.io/klog/v2"
 )
 
+// UnstructuredResolverName is the name the unstructured resolver is registered under.
+const UnstructuredResolverName = "unstructured"
+
 // UnstructuredResolver represents a resolver for unstructured objects.
 type UnstructuredResolver struct {
 	logger klog.Logger
@@ -32,26 +36,40 @@ type UnstructuredResolver struct {
 // UnstructuredResolver implements the Resolver interface.
 var _ Resolver = &UnstructuredResolver{}
 
+// UnstructuredResolver implements the PathAnalyzer interface.
+var _ PathAnalyzer = &UnstructuredResolver{}
+
+func init() {
+	Register(UnstructuredResolverName, func(options Options) (Resolver, error) {
+		return NewUnstructuredResolver(options), nil
+	})
+}
+
 // NewUnstructuredResolver returns a new unstructured resolver.
-func NewUnstructuredResolver(logger klog.Logger) *UnstructuredResolver {
-	return &UnstructuredResolver{logger: logger}
+func NewUnstructuredResolver(options Options) *UnstructuredResolver {
+	return &UnstructuredResolver{logger: options.Logger}
 }
 
 // Resolve resolves the given query against the given unstructured object.
 // NOTE: Resolutions resulting in composite values for label keys and values are not supported, owing to upstream
 // limitations: https://github.com/kubernetes/apimachinery/blob/v0.31.0/pkg/apis/meta/v1/unstructured/helpers_test.go#L121.
-func (ur *UnstructuredResolver) Resolve(query string, unstructuredObjectMap map[string]interface{}) map[string]string {
+func (ur *UnstructuredResolver) Resolve(_ context.Context, query string, unstructuredObjectMap map[string]interface{}) (map[string]string, error) {
 	logger := ur.logger.WithValues("query", query)
 
 	resolvedI, found, err := unstructured.NestedFieldNoCopy(unstructuredObjectMap, strings.Split(query, ".")...)
-	if !found {
-		return map[string]string{query: query}
-	}
 	if err != nil {
 		logger.V(1).Info("ignoring resolution for query", "info", err)
 
-		return map[string]string{query: query}
+		return nil, fmt.Errorf("%w: %w", ErrResolutionFailed, err)
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: field not found", ErrResolutionFailed)
 	}
 
-	return map[string]string{query: fmt.Sprintf("%v", resolvedI)}
+	return map[string]string{query: fmt.Sprintf("%v", resolvedI)}, nil
+}
+
+// Paths returns the single path the given query reads.
+func (ur *UnstructuredResolver) Paths(query string) ([][]string, bool) {
+	return [][]string{strings.Split(query, ".")}, true
 }
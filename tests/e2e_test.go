@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/rexagod/crdmetrics/tests/framework"
 )
 
@@ -40,9 +41,23 @@ kube_customresource_foos_info{static="42",dynamicshouldresolvetoname="test-sampl
 # HELP kube_customresource_foo_replicas Number of replicas for each Foo instance
 # TYPE kube_customresource_foo_replicas gauge
 kube_customresource_foo_replicas{name="test-sample",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1.000000
+kube_customresource_foo_replicas{name="test-sample",missing="unknown",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1.000000
 # HELP kube_customresource_platform_info_conformance Information about each MyPlatform instance (using existing exhaustive CRS feature-set for conformance)
 # TYPE kube_customresource_platform_info_conformance gauge
 kube_customresource_platform_info_conformance{id="1000",os="linux",job="crdmetrics",name="test-sample",appid="test-sample",language="csharp",label_bar="2",label_foo="1",label_job="crdmetrics",instancesize="small",environmenttype="dev",group="contoso.com",version="v1alpha1",kind="MyPlatform"} 2.000000
+# HELP kube_customresource_foo_generation_total Generation of each Foo instance
+# TYPE kube_customresource_foo_generation_total gauge
+kube_customresource_foo_generation_total{name="test-sample",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1.000000
+# HELP kube_customresource_foo_deployment_info Deployment of each Foo instance
+# TYPE kube_customresource_foo_deployment_info gauge
+kube_customresource_foo_deployment_info{name="test-sample",deployment="test-sample",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1.000000
+# HELP kube_customresource_foo_scaled Whether each Foo instance is scaled up or down
+# TYPE kube_customresource_foo_scaled gauge
+kube_customresource_foo_scaled{name="test-sample",kube_customresource_foo_scaled="up",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1.000000
+kube_customresource_foo_scaled{name="test-sample",kube_customresource_foo_scaled="down",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 0.000000
+# HELP kube_customresource_foo_desired_replicas Desired replicas of each Foo instance
+# TYPE kube_customresource_foo_desired_replicas gauge
+kube_customresource_foo_desired_replicas{name="test-sample",group="samplecontroller.k8s.io",version="v1alpha1",kind="Foo"} 1.000000
 `
 	if equal := cmp.Equal(gotRaw, wantRaw); !equal {
 		t.Fatalf("[-got +want]:\n%s", cmp.Diff(gotRaw, wantRaw))
@@ -56,19 +71,7 @@ func TestSelfServer(t *testing.T) {
 	const httpRequestDurationSeconds = "http_request_duration_seconds"
 
 	// Fetch the recorded in-flight time for main /metrics endpoint.
-	selfPort, found := os.LookupEnv(CRDMetricsSelfPort)
-	if !found {
-		t.Fatal(CRDMetricsSelfPort + "is not set")
-	}
-	selfMetricsURL := &url.URL{
-		Host:   "localhost:" + selfPort,
-		Path:   "/metrics",
-		Scheme: "http",
-	}
-	telemetryMetrics, err := runner.GetMetrics(selfMetricsURL)
-	if err != nil {
-		t.Fatalf("failed to get metrics: %v", err)
-	}
+	telemetryMetrics := getSelfMetrics(t, runner)
 	inFlightDurationTotal := 0.0
 	inFlightDurationFamily, ok := telemetryMetrics[httpRequestDurationSeconds]
 	if ok {
@@ -85,18 +88,85 @@ func TestSelfServer(t *testing.T) {
 		Path:   "/metrics",
 		Scheme: "http",
 	}
-	_, err = runner.GetRaw(mainURL)
+	_, err := runner.GetRaw(mainURL)
 	if err != nil {
 		t.Fatalf("failed to get metrics: %v", err)
 	}
 
 	// Check if the recorded in-flight time for main /metrics requests increased.
-	telemetryMetrics, err = runner.GetMetrics(selfMetricsURL)
-	if err != nil {
-		t.Fatalf("failed to get metrics: %v", err)
+	telemetryMetrics = getSelfMetrics(t, runner)
+	inFlightDurationMetrics := telemetryMetrics[httpRequestDurationSeconds].GetMetric()
+	if len(inFlightDurationMetrics) == 0 {
+		t.Fatalf("%s is not exposed", httpRequestDurationSeconds)
 	}
-	newInFlightDurationTotal := telemetryMetrics[httpRequestDurationSeconds].GetMetric()[0].GetHistogram().GetSampleSum()
+	newInFlightDurationTotal := inFlightDurationMetrics[0].GetHistogram().GetSampleSum()
 	if newInFlightDurationTotal == inFlightDurationTotal {
 		t.Fatalf("got in-flight duration total %f, want %f", newInFlightDurationTotal, inFlightDurationTotal)
 	}
 }
+
+func TestSelfServerCELCost(t *testing.T) {
+	t.Parallel()
+
+	const celEvaluationCostTotal = "cel_evaluation_cost_total"
+
+	// Fetch the cumulative CEL cost recorded for the managed resources.
+	telemetryMetrics := getSelfMetrics(t, framework.NewRunner())
+	celEvaluationCostFamily, ok := telemetryMetrics[celEvaluationCostTotal]
+	if !ok {
+		t.Fatalf("%s is not exposed", celEvaluationCostTotal)
+	}
+	costTotal := 0.0
+	for _, metric := range celEvaluationCostFamily.GetMetric() {
+		costTotal += metric.GetCounter().GetValue()
+	}
+	if costTotal == 0 {
+		t.Fatalf("got %s %f, want > 0", celEvaluationCostTotal, costTotal)
+	}
+}
+
+func TestSelfServerLiveReflectors(t *testing.T) {
+	t.Parallel()
+
+	const liveReflectors = "live_reflectors"
+
+	// The managed resource in manifests/custom-resource.yaml configures three stores with distinct GVR and selectors, so
+	// three shared informers, each running a single reflector. Any reflectors leaked from previous generations of the
+	// stores would show up here.
+	const wantLiveReflectors = 3.0
+
+	// Fetch the number of running reflectors.
+	telemetryMetrics := getSelfMetrics(t, framework.NewRunner())
+	liveReflectorsFamily, ok := telemetryMetrics[liveReflectors]
+	if !ok {
+		t.Fatalf("%s is not exposed", liveReflectors)
+	}
+	metrics := liveReflectorsFamily.GetMetric()
+	if len(metrics) != 1 {
+		t.Fatalf("got %d %s series, want 1", len(metrics), liveReflectors)
+	}
+	if got := metrics[0].GetGauge().GetValue(); got != wantLiveReflectors {
+		t.Fatalf("got %s %f, want %f", liveReflectors, got, wantLiveReflectors)
+	}
+}
+
+// getSelfMetrics fetches the metrics exposed on the self /metrics endpoint.
+func getSelfMetrics(t *testing.T, runner *framework.Runner) map[string]*dto.MetricFamily {
+	t.Helper()
+
+	selfPort, found := os.LookupEnv(CRDMetricsSelfPort)
+	if !found {
+		t.Fatal(CRDMetricsSelfPort + "is not set")
+	}
+	selfMetricsURL := &url.URL{
+		Host:   "localhost:" + selfPort,
+		Path:   "/metrics",
+		Scheme: "http",
+	}
+	telemetryMetrics, err := runner.GetMetrics(selfMetricsURL)
+	if err != nil {
+		t.Fatalf("failed to get metrics: %v", err)
+	}
+
+	return telemetryMetrics
+}
@@ -31,12 +31,21 @@ func NewRunner() *Runner {
 
 // GetRaw writes the GetRaw response from the provided endpoint to the provided writer.
 func (r *Runner) GetRaw(endpoint *url.URL) (string, error) {
+	raw, _, err := r.GetRawWithHeader(endpoint, http.Header{})
+
+	return raw, err
+}
+
+// GetRawWithHeader returns the raw response, and its headers, from the provided endpoint, requested with the provided
+// headers.
+func (r *Runner) GetRawWithHeader(endpoint *url.URL, header http.Header) (string, http.Header, error) {
 	resp, err := r.Do(&http.Request{
 		Method: http.MethodGet,
 		URL:    endpoint,
+		Header: header,
 	})
 	if err != nil {
-		return "", fmt.Errorf("failed to get response: %w", err)
+		return "", nil, fmt.Errorf("failed to get response: %w", err)
 	}
 	defer func() {
 		_, err = io.Copy(io.Discard, resp.Body)
@@ -49,15 +58,15 @@ func (r *Runner) GetRaw(endpoint *url.URL) (string, error) {
 		}
 	}()
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("server returned status %s", resp.Status)
+		return "", nil, fmt.Errorf("server returned status %s", resp.Status)
 	}
 	raw := new(strings.Builder)
 	_, err = io.Copy(raw, resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("failed to write response: %w", err)
+		return "", nil, fmt.Errorf("failed to write response: %w", err)
 	}
 
-	return raw.String(), nil
+	return raw.String(), resp.Header, nil
 }
 
 // GetMetrics parses the textual response from the provided endpoint.
@@ -0,0 +1,147 @@
+package crdmetrics_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/textparse"
+	"github.com/rexagod/crdmetrics/tests/framework"
+)
+
+func TestMainServerOpenMetrics(t *testing.T) {
+	t.Parallel()
+
+	r := framework.NewRunner()
+	mainPort, found := os.LookupEnv(CRDMetricsMainPort)
+	if !found {
+		t.Fatal(CRDMetricsMainPort + "is not set")
+	}
+	mainMetricsURL := &url.URL{
+		Host:   "localhost:" + mainPort,
+		Path:   "/metrics",
+		Scheme: "http",
+	}
+
+	// Request OpenMetrics the way Prometheus does.
+	header := http.Header{}
+	header.Set("Accept", "application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1")
+	gotRaw, gotHeader, err := r.GetRawWithHeader(mainMetricsURL, header)
+	if err != nil {
+		t.Fatalf("failed to get metrics: %v", err)
+	}
+	if got, want := gotHeader.Get("Content-Type"), string(expfmt.NewFormat(expfmt.TypeOpenMetrics)); got != want {
+		t.Fatalf("got content type %q, want %q", got, want)
+	}
+
+	// Parse the exposition, attributing every sample to the family it is exposed under.
+	gotTypes := map[string]model.MetricType{}
+	gotUnits := map[string]string{}
+	gotSamples := map[string]float64{}
+	allowedSuffixes := map[model.MetricType][]string{
+		model.MetricTypeCounter:  {"_total", "_created"},
+		model.MetricTypeGauge:    {""},
+		model.MetricTypeInfo:     {"_info"},
+		model.MetricTypeStateset: {""},
+	}
+	var family string
+	p := textparse.NewOpenMetricsParser([]byte(gotRaw))
+	for {
+		entry, err := p.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to parse OpenMetrics exposition: %v\n%s", err, gotRaw)
+		}
+		switch entry {
+		case textparse.EntryType:
+			name, typ := p.Type()
+			family = string(name)
+			if _, ok := gotTypes[family]; ok {
+				t.Fatalf("got family %q more than once:\n%s", family, gotRaw)
+			}
+			gotTypes[family] = typ
+		case textparse.EntryUnit:
+			name, unit := p.Unit()
+			if string(name) != family {
+				t.Fatalf("got unit for %q under family %q:\n%s", name, family, gotRaw)
+			}
+			if !strings.HasSuffix(family, "_"+string(unit)) {
+				t.Fatalf("got family %q without its unit %q as a suffix", family, unit)
+			}
+			gotUnits[family] = string(unit)
+		case textparse.EntrySeries:
+			_, _, value := p.Series()
+			var lset labels.Labels
+			p.Metric(&lset)
+			name := lset.Get(labels.MetricName)
+			suffix, ok := strings.CutPrefix(name, family)
+			if !ok {
+				t.Fatalf("got sample %q under family %q:\n%s", name, family, gotRaw)
+			}
+			allowed := false
+			for _, s := range allowedSuffixes[gotTypes[family]] {
+				allowed = allowed || s == suffix
+			}
+			if !allowed {
+				t.Fatalf("got sample %q not allowed for %s family %q", name, gotTypes[family], family)
+			}
+			if gotTypes[family] == model.MetricTypeStateset {
+				name += "/" + lset.Get(family)
+			}
+			gotSamples[name] = value
+		}
+	}
+
+	wantTypes := map[string]model.MetricType{
+		"kube_customresource_foo_generation":       model.MetricTypeCounter,
+		"kube_customresource_foo_deployment":       model.MetricTypeInfo,
+		"kube_customresource_foo_scaled":           model.MetricTypeStateset,
+		"kube_customresource_foo_desired_replicas": model.MetricTypeGauge,
+		"kube_customresource_foo_replicas":         model.MetricTypeGauge,
+	}
+	for name, want := range wantTypes {
+		if got := gotTypes[name]; got != want {
+			t.Fatalf("got type %q for family %q, want %q", got, name, want)
+		}
+	}
+	if got, want := gotUnits["kube_customresource_foo_desired_replicas"], "replicas"; got != want {
+		t.Fatalf("got unit %q, want %q", got, want)
+	}
+	wantSamples := map[string]float64{
+		"kube_customresource_foo_generation_total": 1,
+		"kube_customresource_foo_deployment_info":  1,
+		"kube_customresource_foo_scaled/up":        1,
+		"kube_customresource_foo_scaled/down":      0,
+		"kube_customresource_foo_desired_replicas": 1,
+	}
+	for name, want := range wantSamples {
+		if got, ok := gotSamples[name]; !ok || got != want {
+			t.Fatalf("got sample %q = %v (found: %t), want %v", name, got, ok, want)
+		}
+	}
+	if got := gotSamples["kube_customresource_foo_generation_created"]; got <= 0 {
+		t.Fatalf("got creation timestamp %v, want a positive one", got)
+	}
+
+	// Both formats expose the same families.
+	textRaw, err := r.GetRaw(mainMetricsURL)
+	if err != nil {
+		t.Fatalf("failed to get metrics: %v", err)
+	}
+	textFamilies, err := new(expfmt.TextParser).TextToMetricFamilies(strings.NewReader(textRaw))
+	if err != nil {
+		t.Fatalf("failed to parse text exposition: %v", err)
+	}
+	if got, want := len(gotTypes), len(textFamilies); got != want {
+		t.Fatalf("got %d families, want %d", got, want)
+	}
+}